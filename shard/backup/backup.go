@@ -0,0 +1,335 @@
+package backup
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"prismarine/shard/runtime"
+	"prismarine/shard/runtime/filesystem"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/klauspost/compress/gzip"
+	"github.com/pkg/errors"
+	ignore "github.com/sabhiram/go-gitignore"
+)
+
+const (
+	AdapterLocal = "local"
+)
+
+// IgnoreFile is read from the root of the data directory and lists the files
+// to leave out of backups, in the same format as a .gitignore
+const IgnoreFile = ".prismarineignore"
+
+// ChecksumType is the hash used for backup checksums
+const ChecksumType = "sha256"
+
+// stopTimeout is how long an instance is given to stop before a restore
+// terminates it
+const stopTimeout = 2 * time.Minute
+
+var (
+	ErrBackupNotFound    = errors.New("backup: backup does not exist")
+	ErrInvalidIdentifier = errors.New("backup: invalid backup identifier")
+	ErrUnknownAdapter    = errors.New("backup: unknown backup adapter")
+)
+
+var identifierRegex = regexp.MustCompile(`^[a-zA-Z0-9-]{1,64}$`)
+
+// Details describes a completed backup, and is published with the
+// BackupCompletedEvent
+type Details struct {
+	Uuid         string    `json:"uuid"`
+	Adapter      string    `json:"adapter"`
+	Successful   bool      `json:"successful"`
+	Checksum     string    `json:"checksum"`
+	ChecksumType string    `json:"checksum_type"`
+	Size         int64     `json:"size"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// RestoreReport is published with the BackupRestoreEvent
+type RestoreReport struct {
+	Uuid       string `json:"uuid"`
+	Successful bool   `json:"successful"`
+}
+
+// Backup is a single backup of an instance, stored by one of the adapters
+type Backup interface {
+	// Identifier returns the uuid of the backup
+	Identifier() string
+
+	// Adapter returns the name of the adapter storing the backup
+	Adapter() string
+
+	// Generate creates the backup from the data directory of an instance,
+	// leaving out any files matched by the ignore patterns
+	Generate(ctx context.Context, fs *filesystem.Filesystem, ignore string) (*Details, error)
+
+	// Open returns the gzipped tar archive of the backup
+	Open(ctx context.Context) (io.ReadCloser, error)
+
+	// Remove deletes the backup
+	Remove() error
+}
+
+// ValidIdentifier determines if a backup uuid is safe to use in a path
+func ValidIdentifier(uuid string) bool {
+	return identifierRegex.MatchString(uuid)
+}
+
+// Create generates a backup of the instance and publishes the result as a
+// "backup completed:<uuid>" event, whether or not it succeeded
+func Create(ctx context.Context, i runtime.Instance, b Backup, ignore string) (*Details, error) {
+	l := log.With("instance", i.Id()).With("backup", b.Identifier())
+	l.Info("creating backup", "adapter", b.Adapter())
+
+	d, err := b.Generate(ctx, i.Filesystem(), ignore)
+	if err != nil {
+		l.Error("failed to create backup", "err", err)
+		i.Events().Publish(runtime.BackupCompletedEvent+":"+b.Identifier(), Details{
+			Uuid:    b.Identifier(),
+			Adapter: b.Adapter(),
+		})
+		return nil, err
+	}
+
+	l.Info("backup created", "size", d.Size)
+	i.Events().Publish(runtime.BackupCompletedEvent+":"+b.Identifier(), *d)
+	return d, nil
+}
+
+// Restore replaces the files of an instance with those in the backup. The
+// instance is claimed for the restore before it is stopped, so that it cannot
+// be started again or restored twice at once. If truncate is set everything
+// in the data directory is removed before the backup is extracted, otherwise
+// files not in the backup are left in place.
+func Restore(ctx context.Context, i runtime.Instance, b Backup, truncate bool) (err error) {
+	// The request was accepted before the restore began, so the result is
+	// published however it ends, including when it is refused
+	defer func() {
+		i.Events().Publish(runtime.BackupRestoreEvent+":"+b.Identifier(), RestoreReport{
+			Uuid:       b.Identifier(),
+			Successful: err == nil,
+		})
+	}()
+
+	if !i.SetRestoring(true) {
+		return runtime.ErrInstanceRestoring
+	}
+	defer i.SetRestoring(false)
+
+	if i.IsInstalling() {
+		return runtime.ErrInstanceInstalling
+	} else if i.IsTransferring() {
+		return runtime.ErrInstanceTransferring
+	}
+	if i.State() != runtime.ProcessOfflineState {
+		// Skipping the lock gets past the claim made above
+		if err := i.WaitForStop(ctx, stopTimeout, true, true, 0); err != nil {
+			return errors.Wrap(err, "backup: failed to stop instance")
+		}
+	}
+
+	l := log.With("instance", i.Id()).With("backup", b.Identifier())
+	l.Info("restoring backup", "adapter", b.Adapter(), "truncate", truncate)
+
+	r, err := b.Open(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if truncate {
+		if err := i.Filesystem().TruncateRootDirectory(); err != nil {
+			return err
+		}
+	}
+	if err := i.Filesystem().ExtractTarGz("/", r); err != nil {
+		return err
+	}
+
+	l.Info("backup restored")
+	return nil
+}
+
+// compileIgnore combines the ignore patterns given for the backup with those in
+// the ignore file of the instance
+func compileIgnore(fs *filesystem.Filesystem, patterns string) (*ignore.GitIgnore, error) {
+	lines := strings.Split(patterns, "\n")
+
+	f, _, err := fs.File(IgnoreFile)
+	if err == nil {
+		b, err := io.ReadAll(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "backup: failed to read ignore file")
+		}
+		lines = append(lines, strings.Split(string(b), "\n")...)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	return ignore.CompileIgnoreLines(lines...), nil
+}
+
+// generate writes a gzipped tar archive of the filesystem to the writer and
+// returns its size and checksum
+func generate(ctx context.Context, w io.Writer, fs *filesystem.Filesystem, patterns string) (int64, string, error) {
+	ig, err := compileIgnore(fs, patterns)
+	if err != nil {
+		return 0, "", err
+	}
+
+	h := sha256.New()
+	cw := &countingWriter{}
+	if err := writeArchive(ctx, io.MultiWriter(w, h, cw), fs, ig); err != nil {
+		return 0, "", err
+	}
+	return cw.n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// WriteArchive writes a gzipped tar archive of the whole data directory to the
+// writer, ignoring nothing
+func WriteArchive(ctx context.Context, w io.Writer, fs *filesystem.Filesystem) error {
+	return writeArchive(ctx, w, fs, ignore.CompileIgnoreLines())
+}
+
+// writeArchive writes every file in the data directory that is not ignored to
+// a gzipped tar archive. Symlinks are stored as links rather than followed.
+func writeArchive(ctx context.Context, w io.Writer, fs *filesystem.Filesystem, ig *ignore.GitIgnore) error {
+	root, err := filepath.EvalSymlinks(fs.Path())
+	if err != nil {
+		return errors.Wrap(err, "backup: failed to resolve data directory")
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	err = filepath.WalkDir(root, func(p string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			// Files can disappear while walking a live directory
+			if errors.Is(err, iofs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if p == root {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if d.IsDir() {
+			name += "/"
+		}
+		if ig.MatchesPath(name) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		return addFile(tw, p, name)
+	})
+	if err != nil {
+		_ = tw.Close()
+		_ = gw.Close()
+		return errors.Wrap(err, "backup: failed to write archive")
+	}
+
+	if err := tw.Close(); err != nil {
+		_ = gw.Close()
+		return errors.Wrap(err, "backup: failed to write archive")
+	}
+	if err := gw.Close(); err != nil {
+		return errors.Wrap(err, "backup: failed to write archive")
+	}
+	return nil
+}
+
+func addFile(tw *tar.Writer, p, name string) error {
+	info, err := os.Lstat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var link string
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		if link, err = os.Readlink(p); err != nil {
+			return err
+		}
+	case !info.IsDir() && !info.Mode().IsRegular():
+		// Sockets, devices and pipes cannot be restored
+		return nil
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+
+	if !info.Mode().IsRegular() {
+		return tw.WriteHeader(hdr)
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	// The file may be written to while the backup runs, so never copy more
+	// than the size that was written in the header
+	n, err := io.Copy(tw, io.LimitReader(f, hdr.Size))
+	if err != nil {
+		return err
+	}
+	if n < hdr.Size {
+		// Pad out files that shrunk so that the archive stays valid
+		_, err = io.CopyN(tw, zeroReader{}, hdr.Size-n)
+	}
+	return err
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.n += int64(len(p))
+	return len(p), nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
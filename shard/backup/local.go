@@ -0,0 +1,193 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"prismarine/shard/config"
+	"prismarine/shard/runtime/filesystem"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var _ Backup = (*LocalBackup)(nil)
+
+// LocalBackup is a backup stored in the backup directory of the shard. The
+// details are stored in a JSON file next to the archive, so that backups can
+// be listed without the panel.
+type LocalBackup struct {
+	instance string
+	uuid     string
+}
+
+// NewLocal returns the local backup with the given uuid for an instance. The
+// backup does not need to exist yet.
+func NewLocal(instance, uuid string) (*LocalBackup, error) {
+	if !ValidIdentifier(uuid) || !ValidIdentifier(instance) {
+		return nil, ErrInvalidIdentifier
+	}
+	return &LocalBackup{instance: instance, uuid: uuid}, nil
+}
+
+// localDirectory returns the directory holding the local backups of an
+// instance
+func localDirectory(instance string) string {
+	return filepath.Join(config.Get().System.BackupDirectory, instance)
+}
+
+func (b *LocalBackup) Identifier() string {
+	return b.uuid
+}
+
+func (b *LocalBackup) Adapter() string {
+	return AdapterLocal
+}
+
+// Path returns the location of the archive on disk
+func (b *LocalBackup) Path() string {
+	return filepath.Join(localDirectory(b.instance), b.uuid+".tar.gz")
+}
+
+func (b *LocalBackup) detailsPath() string {
+	return filepath.Join(localDirectory(b.instance), b.uuid+".json")
+}
+
+// Generate writes the archive to a temporary file first, so that a failed
+// backup never replaces an existing one
+func (b *LocalBackup) Generate(ctx context.Context, fs *filesystem.Filesystem, ignore string) (*Details, error) {
+	dir := localDirectory(b.instance)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, errors.Wrap(err, "backup: failed to create backup directory")
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+b.uuid+".*.tmp")
+	if err != nil {
+		return nil, errors.Wrap(err, "backup: failed to create backup file")
+	}
+	defer os.Remove(tmp.Name())
+
+	size, checksum, err := generate(ctx, tmp, fs, ignore)
+	if cerr := tmp.Close(); err == nil && cerr != nil {
+		err = errors.Wrap(cerr, "backup: failed to write backup file")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(tmp.Name(), b.Path()); err != nil {
+		return nil, errors.Wrap(err, "backup: failed to write backup file")
+	}
+
+	d := &Details{
+		Uuid:         b.uuid,
+		Adapter:      AdapterLocal,
+		Successful:   true,
+		Checksum:     checksum,
+		ChecksumType: ChecksumType,
+		Size:         size,
+		CreatedAt:    time.Now().UTC(),
+	}
+	raw, err := json.Marshal(d)
+	if err != nil {
+		return nil, errors.Wrap(err, "backup: failed to marshal backup details")
+	}
+	if err := os.WriteFile(b.detailsPath(), raw, 0o600); err != nil {
+		return nil, errors.Wrap(err, "backup: failed to write backup details")
+	}
+	return d, nil
+}
+
+func (b *LocalBackup) Open(_ context.Context) (io.ReadCloser, error) {
+	f, err := os.Open(b.Path())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrBackupNotFound
+		}
+		return nil, errors.Wrap(err, "backup: failed to open backup")
+	}
+	return f, nil
+}
+
+func (b *LocalBackup) Remove() error {
+	if err := os.Remove(b.Path()); err != nil {
+		if os.IsNotExist(err) {
+			return ErrBackupNotFound
+		}
+		return errors.Wrap(err, "backup: failed to remove backup")
+	}
+	if err := os.Remove(b.detailsPath()); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "backup: failed to remove backup details")
+	}
+	return nil
+}
+
+// Details returns the details recorded when the backup was created
+func (b *LocalBackup) Details() (*Details, error) {
+	raw, err := os.ReadFile(b.detailsPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrBackupNotFound
+		}
+		return nil, errors.Wrap(err, "backup: failed to read backup details")
+	}
+
+	var d Details
+	if err := json.Unmarshal(raw, &d); err != nil {
+		return nil, errors.Wrap(err, "backup: failed to parse backup details")
+	}
+	return &d, nil
+}
+
+// List returns the details of every local backup of an instance, newest first
+func List(instance string) ([]Details, error) {
+	if !ValidIdentifier(instance) {
+		return nil, ErrInvalidIdentifier
+	}
+
+	entries, err := os.ReadDir(localDirectory(instance))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Details{}, nil
+		}
+		return nil, errors.Wrap(err, "backup: failed to read backup directory")
+	}
+
+	out := make([]Details, 0, len(entries))
+	for _, e := range entries {
+		uuid, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || e.IsDir() {
+			continue
+		}
+		b, err := NewLocal(instance, uuid)
+		if err != nil {
+			continue
+		}
+		d, err := b.Details()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *d)
+	}
+
+	sort.Slice(out, func(a, b int) bool {
+		return out[a].CreatedAt.After(out[b].CreatedAt)
+	})
+	return out, nil
+}
+
+// RemoveAll removes every local backup of an instance, along with any S3
+// uploads that were left partially complete
+func RemoveAll(instance string) error {
+	if !ValidIdentifier(instance) {
+		return ErrInvalidIdentifier
+	}
+	if err := os.RemoveAll(localDirectory(instance)); err != nil {
+		return errors.Wrap(err, "backup: failed to remove backups")
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"prismarine/shard/runtime"
+	"prismarine/shard/runtime/events"
+	"prismarine/shard/runtime/filesystem"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLocalBackup(t *testing.T, instance, uuid string) *LocalBackup {
+	t.Helper()
+	b, err := NewLocal(instance, uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestNewLocal_InvalidIdentifier(t *testing.T) {
+	for _, ids := range [][2]string{
+		{"instance", "../backup"},
+		{"instance", ""},
+		{"../instance", "backup"},
+		{"instance", strings.Repeat("a", 65)},
+	} {
+		if _, err := NewLocal(ids[0], ids[1]); err != ErrInvalidIdentifier {
+			t.Fatalf("expected %v to be rejected, got %v", ids, err)
+		}
+	}
+}
+
+func TestLocalBackup_GenerateAndRestore(t *testing.T) {
+	fs, files := setup(t)
+	if err := fs.Write(IgnoreFile, strings.NewReader("world/region/\n")); err != nil {
+		t.Fatal(err)
+	}
+	b := newTestLocalBackup(t, "instance", "backup-1")
+
+	d, err := b.Generate(context.Background(), fs, "plugins/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := os.ReadFile(b.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(raw)
+	if !d.Successful || d.Adapter != AdapterLocal || d.Size != int64(len(raw)) || d.Checksum != hex.EncodeToString(sum[:]) {
+		t.Fatalf("expected the details to match the archive, got %+v", d)
+	}
+	if stored, err := b.Details(); err != nil || *stored != *d {
+		t.Fatalf("expected the details to be stored, got %+v (%v)", stored, err)
+	}
+
+	r, err := b.Open(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	restored := filesystem.New(t.TempDir())
+	if err := restored.ExtractTarGz("/", r); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(restored.Path(), name))
+		ignored := strings.HasPrefix(name, "plugins/") || strings.HasPrefix(name, "world/region/")
+		if ignored && !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be ignored", name)
+		}
+		if !ignored && (err != nil || !bytes.Equal(got, want)) {
+			t.Fatalf("expected %s to be restored (%v)", name, err)
+		}
+	}
+}
+
+func TestLocalBackup_Remove(t *testing.T) {
+	fs, _ := setup(t)
+	b := newTestLocalBackup(t, "instance", "backup-1")
+	if _, err := b.Generate(context.Background(), fs, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{b.Path(), b.detailsPath()} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed", p)
+		}
+	}
+
+	if err := b.Remove(); err != ErrBackupNotFound {
+		t.Fatalf("expected ErrBackupNotFound, got %v", err)
+	}
+	if _, err := b.Open(context.Background()); err != ErrBackupNotFound {
+		t.Fatalf("expected ErrBackupNotFound, got %v", err)
+	}
+	if _, err := b.Details(); err != ErrBackupNotFound {
+		t.Fatalf("expected ErrBackupNotFound, got %v", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	fs, _ := setup(t)
+
+	if got, err := List("instance"); err != nil || len(got) != 0 {
+		t.Fatalf("expected no backups before any were made, got %v (%v)", got, err)
+	}
+	if _, err := List("../instance"); err != ErrInvalidIdentifier {
+		t.Fatalf("expected ErrInvalidIdentifier, got %v", err)
+	}
+
+	for _, uuid := range []string{"older", "newer"} {
+		if _, err := newTestLocalBackup(t, "instance", uuid).Generate(context.Background(), fs, ""); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// A backup of another instance, and leftovers that are not backups
+	if _, err := newTestLocalBackup(t, "other", "other").Generate(context.Background(), fs, ""); err != nil {
+		t.Fatal(err)
+	}
+	dir := localDirectory("instance")
+	if err := os.WriteFile(filepath.Join(dir, ".partial.123.tmp"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "directory.json"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := List("instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Uuid != "newer" || got[1].Uuid != "older" {
+		t.Fatalf("expected the backups newest first, got %+v", got)
+	}
+}
+
+func TestRemoveAll(t *testing.T) {
+	fs, _ := setup(t)
+	for _, instance := range []string{"instance", "other"} {
+		if _, err := newTestLocalBackup(t, instance, "backup-1").Generate(context.Background(), fs, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := RemoveAll("instance"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(localDirectory("instance")); !os.IsNotExist(err) {
+		t.Fatal("expected the backup directory to be removed")
+	}
+	if got, err := List("other"); err != nil || len(got) != 1 {
+		t.Fatalf("expected the backups of other instances to be kept, got %v (%v)", got, err)
+	}
+
+	// Nothing to remove is not an error
+	if err := RemoveAll("instance"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveAll("../instance"); err != ErrInvalidIdentifier {
+		t.Fatalf("expected ErrInvalidIdentifier, got %v", err)
+	}
+}
+
+// restoreInstance implements just enough of an instance to be restored, any
+// other method panics
+type restoreInstance struct {
+	runtime.Instance
+	fs        *filesystem.Filesystem
+	bus       *events.Bus
+	restoring *runtime.AtomicBool
+	running   bool
+
+	// Called while the instance is being stopped
+	onStop func()
+	// Returned from stopping the instance
+	stopErr error
+}
+
+func (i *restoreInstance) Id() string                         { return "instance" }
+func (i *restoreInstance) Filesystem() *filesystem.Filesystem { return i.fs }
+func (i *restoreInstance) Events() *events.Bus                { return i.bus }
+func (i *restoreInstance) IsInstalling() bool                 { return false }
+func (i *restoreInstance) IsTransferring() bool               { return false }
+func (i *restoreInstance) IsRestoring() bool                  { return i.restoring.Load() }
+func (i *restoreInstance) SetRestoring(v bool) bool           { return i.restoring.SwapIf(v) }
+func (i *restoreInstance) State() string {
+	if i.running {
+		return runtime.ProcessRunningState
+	}
+	return runtime.ProcessOfflineState
+}
+
+func (i *restoreInstance) WaitForStop(_ context.Context, _ time.Duration, _ bool, skipLock bool, _ int) error {
+	// Like the docker runtime, the claim only lets the restore itself through
+	if !skipLock && i.IsRestoring() {
+		return runtime.ErrInstanceRestoring
+	}
+	if i.onStop != nil {
+		i.onStop()
+	}
+	if i.stopErr != nil {
+		return i.stopErr
+	}
+	i.running = false
+	return nil
+}
+
+func TestRestore(t *testing.T) {
+	fs, files := setup(t)
+	b := newTestLocalBackup(t, "instance", "backup-1")
+	if _, err := b.Generate(context.Background(), fs, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	i := &restoreInstance{
+		fs:        filesystem.New(t.TempDir()),
+		bus:       events.NewBus(),
+		restoring: runtime.NewAtomicBool(false),
+		running:   true,
+	}
+	if err := i.fs.Write("stale", strings.NewReader("stale")); err != nil {
+		t.Fatal(err)
+	}
+
+	var stopped bool
+	i.onStop = func() {
+		stopped = true
+		if !i.IsRestoring() {
+			t.Error("expected the restore to be claimed before stopping")
+		}
+		if err := Restore(context.Background(), i, b, false); err != runtime.ErrInstanceRestoring {
+			t.Errorf("expected a second restore to be refused, got %v", err)
+		}
+	}
+
+	if err := Restore(context.Background(), i, b, true); err != nil {
+		t.Fatal(err)
+	}
+	if !stopped {
+		t.Fatal("expected the instance to be stopped")
+	}
+	if i.IsRestoring() {
+		t.Fatal("expected the restore to be released once done")
+	}
+
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(i.fs.Path(), name))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("expected %s to be restored (%v)", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(i.fs.Path(), "stale")); !os.IsNotExist(err) {
+		t.Fatal("expected truncating to remove files not in the backup")
+	}
+}
+
+func TestRestore_ReportsFailure(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(i *restoreInstance)
+	}{
+		{"already restoring", func(i *restoreInstance) { i.restoring.Store(true) }},
+		{"stop failure", func(i *restoreInstance) { i.stopErr = errors.New("no such container") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			b := newTestLocalBackup(t, "instance", "backup-1")
+			i := &restoreInstance{
+				fs:        filesystem.New(t.TempDir()),
+				bus:       events.NewBus(),
+				restoring: runtime.NewAtomicBool(false),
+				running:   true,
+			}
+			defer i.bus.Destroy()
+			tt.setup(i)
+
+			reports := make(chan RestoreReport, 1)
+			i.bus.Subscribe(runtime.BackupRestoreEvent+":backup-1", func(e events.Event) {
+				reports <- e.Data.(RestoreReport)
+			})
+
+			if err := Restore(context.Background(), i, b, false); err == nil {
+				t.Fatal("expected the restore to fail")
+			}
+			select {
+			case r := <-reports:
+				if r.Successful || r.Uuid != "backup-1" {
+					t.Fatalf("expected a failed restore to be reported, got %+v", r)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for the restore to be reported")
+			}
+		})
+	}
+}
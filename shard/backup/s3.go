@@ -0,0 +1,349 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"prismarine/shard/remote"
+	"prismarine/shard/runtime/filesystem"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/pkg/errors"
+)
+
+const AdapterS3 = "s3"
+
+var _ Backup = (*S3Backup)(nil)
+
+// S3Backup is a backup stored in S3 compatible storage. The shard never holds
+// any S3 credentials, the panel hands out presigned urls for every part of the
+// upload and for the download.
+//
+// The archive is written to the backup directory before it is uploaded, along
+// with a state file recording the parts that have been uploaded. If the upload
+// fails, generating the same backup again resumes from the first part that
+// was not uploaded rather than starting over.
+type S3Backup struct {
+	instance string
+	uuid     string
+
+	client     *remote.Client
+	httpClient *http.Client
+
+	// How many times a part is attempted before the upload fails, and the
+	// initial delay between attempts which doubles after every failure
+	maxAttempts int
+	backoff     time.Duration
+}
+
+// uploadState is persisted between upload attempts so that they can be
+// resumed
+type uploadState struct {
+	Size      int64               `json:"size"`
+	Checksum  string              `json:"checksum"`
+	CreatedAt time.Time           `json:"created_at"`
+	UploadId  string              `json:"upload_id"`
+	PartSize  int64               `json:"part_size"`
+	Parts     []remote.BackupPart `json:"parts"`
+}
+
+func (s *uploadState) completed(part int) bool {
+	for _, p := range s.Parts {
+		if p.PartNumber == part {
+			return true
+		}
+	}
+	return false
+}
+
+// NewS3 returns the S3 backup with the given uuid for an instance, using the
+// panel client to request presigned urls
+func NewS3(client *remote.Client, instance, uuid string) (*S3Backup, error) {
+	if !ValidIdentifier(uuid) || !ValidIdentifier(instance) {
+		return nil, ErrInvalidIdentifier
+	}
+	return &S3Backup{
+		instance: instance,
+		uuid:     uuid,
+		client:   client,
+		// Parts can be large, so rely on the context rather than a timeout
+		httpClient:  &http.Client{},
+		maxAttempts: 5,
+		backoff:     time.Second,
+	}, nil
+}
+
+func (b *S3Backup) Identifier() string {
+	return b.uuid
+}
+
+func (b *S3Backup) Adapter() string {
+	return AdapterS3
+}
+
+func (b *S3Backup) archivePath() string {
+	return filepath.Join(localDirectory(b.instance), b.uuid+".s3.tar.gz")
+}
+
+func (b *S3Backup) statePath() string {
+	return filepath.Join(localDirectory(b.instance), b.uuid+".s3.json")
+}
+
+func (b *S3Backup) Generate(ctx context.Context, fs *filesystem.Filesystem, ignore string) (_ *Details, err error) {
+	l := log.With("instance", b.instance).With("backup", b.uuid)
+
+	// The panel is waiting on the result of the upload, so it is told about
+	// failures too. The context may be what failed, so a fresh one is used.
+	defer func() {
+		if err == nil {
+			return
+		}
+		if rerr := b.client.SetBackupStatus(context.Background(), b.uuid, remote.BackupStatusRequest{Successful: false}); rerr != nil {
+			l.Warn("failed to report backup failure to panel", "err", rerr)
+		}
+	}()
+
+	st, err := b.loadState()
+	if err != nil {
+		if st, err = b.writeArchive(ctx, fs, ignore); err != nil {
+			return nil, err
+		}
+	} else {
+		l.Info("resuming backup upload", "uploaded_parts", len(st.Parts))
+	}
+
+	urls, err := b.client.GetBackupUploadUrls(ctx, b.uuid, st.Size)
+	if err != nil {
+		return nil, errors.Wrap(err, "backup: failed to get upload urls")
+	}
+	if urls.PartSize <= 0 || int64(len(urls.Parts))*urls.PartSize < st.Size {
+		return nil, errors.New("backup: panel returned too few upload parts for the backup")
+	}
+
+	// The parts of a previous attempt only count if they belong to the same
+	// upload and were split the same way
+	if urls.UploadId != st.UploadId || urls.PartSize != st.PartSize {
+		st.UploadId = urls.UploadId
+		st.PartSize = urls.PartSize
+		st.Parts = nil
+	}
+
+	f, err := os.Open(b.archivePath())
+	if err != nil {
+		return nil, errors.Wrap(err, "backup: failed to open backup file")
+	}
+	defer f.Close()
+
+	for idx, u := range urls.Parts {
+		number := idx + 1
+		offset := int64(idx) * st.PartSize
+		if offset >= st.Size {
+			break
+		}
+		if st.completed(number) {
+			continue
+		}
+
+		size := min(st.PartSize, st.Size-offset)
+		etag, err := b.uploadPart(ctx, u, f, offset, size)
+		if err != nil {
+			return nil, errors.Wrapf(err, "backup: failed to upload part %d", number)
+		}
+
+		st.Parts = append(st.Parts, remote.BackupPart{ETag: etag, PartNumber: number})
+		if err := b.saveState(st); err != nil {
+			return nil, err
+		}
+	}
+
+	err = b.client.SetBackupStatus(ctx, b.uuid, remote.BackupStatusRequest{
+		Successful:   true,
+		Checksum:     st.Checksum,
+		ChecksumType: ChecksumType,
+		Size:         st.Size,
+		Parts:        st.Parts,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "backup: failed to complete upload")
+	}
+
+	if err := b.removeLocal(); err != nil {
+		l.Warn("failed to remove uploaded backup file", "err", err)
+	}
+
+	return &Details{
+		Uuid:         b.uuid,
+		Adapter:      AdapterS3,
+		Successful:   true,
+		Checksum:     st.Checksum,
+		ChecksumType: ChecksumType,
+		Size:         st.Size,
+		CreatedAt:    st.CreatedAt,
+	}, nil
+}
+
+// writeArchive writes the archive to disk ready to be uploaded, and saves a
+// fresh upload state for it
+func (b *S3Backup) writeArchive(ctx context.Context, fs *filesystem.Filesystem, ignore string) (*uploadState, error) {
+	dir := localDirectory(b.instance)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, errors.Wrap(err, "backup: failed to create backup directory")
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+b.uuid+".*.tmp")
+	if err != nil {
+		return nil, errors.Wrap(err, "backup: failed to create backup file")
+	}
+	defer os.Remove(tmp.Name())
+
+	size, checksum, err := generate(ctx, tmp, fs, ignore)
+	if cerr := tmp.Close(); err == nil && cerr != nil {
+		err = errors.Wrap(cerr, "backup: failed to write backup file")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), b.archivePath()); err != nil {
+		return nil, errors.Wrap(err, "backup: failed to write backup file")
+	}
+
+	st := &uploadState{Size: size, Checksum: checksum, CreatedAt: time.Now().UTC()}
+	if err := b.saveState(st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// loadState returns the state of a previous upload attempt. An error is
+// returned if there is nothing to resume.
+func (b *S3Backup) loadState() (*uploadState, error) {
+	raw, err := os.ReadFile(b.statePath())
+	if err != nil {
+		return nil, err
+	}
+
+	var st uploadState
+	if err := json.Unmarshal(raw, &st); err != nil {
+		return nil, errors.Wrap(err, "backup: failed to parse upload state")
+	}
+
+	// The state is useless without the archive it describes
+	info, err := os.Stat(b.archivePath())
+	if err != nil || info.Size() != st.Size {
+		return nil, errors.New("backup: backup file does not match upload state")
+	}
+	return &st, nil
+}
+
+func (b *S3Backup) saveState(st *uploadState) error {
+	raw, err := json.Marshal(st)
+	if err != nil {
+		return errors.Wrap(err, "backup: failed to marshal upload state")
+	}
+	if err := os.WriteFile(b.statePath(), raw, 0o600); err != nil {
+		return errors.Wrap(err, "backup: failed to write upload state")
+	}
+	return nil
+}
+
+// removeLocal removes the archive and upload state from disk
+func (b *S3Backup) removeLocal() error {
+	for _, p := range []string{b.archivePath(), b.statePath()} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "backup: failed to remove backup file")
+		}
+	}
+	return nil
+}
+
+// uploadPart uploads a single part of the archive, retrying on failure, and
+// returns the ETag S3 assigned to it
+func (b *S3Backup) uploadPart(ctx context.Context, url string, f *os.File, offset, size int64) (string, error) {
+	backoff := b.backoff
+	for attempt := 1; ; attempt++ {
+		etag, err := b.putPart(ctx, url, io.NewSectionReader(f, offset, size), size)
+		if err == nil {
+			return etag, nil
+		}
+		if attempt >= b.maxAttempts || ctx.Err() != nil {
+			return "", err
+		}
+
+		log.
+			With("backup", b.uuid).
+			With("offset", offset).
+			With("attempt", attempt).
+			Warn("failed to upload backup part, retrying", "err", err)
+
+		select {
+		case <-ctx.Done():
+			return "", errors.WithStack(ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (b *S3Backup) putPart(ctx context.Context, url string, body io.Reader, size int64) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, body)
+	if err != nil {
+		return "", errors.Wrap(err, "backup: failed to create upload request")
+	}
+	req.ContentLength = size
+
+	res, err := b.httpClient.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "backup: failed to upload part")
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode != http.StatusOK {
+		return "", errors.Errorf("backup: part upload failed with status %d", res.StatusCode)
+	}
+	etag := res.Header.Get("ETag")
+	if etag == "" {
+		return "", errors.New("backup: part upload response is missing an etag")
+	}
+	return etag, nil
+}
+
+// Open streams the archive down from S3
+func (b *S3Backup) Open(ctx context.Context) (io.ReadCloser, error) {
+	url, err := b.client.GetBackupDownloadUrl(ctx, b.uuid)
+	if err != nil {
+		var rerr *remote.RequestError
+		if errors.As(err, &rerr) && rerr.Status == http.StatusNotFound {
+			return nil, ErrBackupNotFound
+		}
+		return nil, errors.Wrap(err, "backup: failed to get download url")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "backup: failed to create download request")
+	}
+	res, err := b.httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "backup: failed to download backup")
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		if res.StatusCode == http.StatusNotFound {
+			return nil, ErrBackupNotFound
+		}
+		return nil, errors.Errorf("backup: download failed with status %d", res.StatusCode)
+	}
+	return res.Body, nil
+}
+
+// Remove only cleans up a partial upload left on disk. Objects in S3 are
+// deleted by the panel, which holds the credentials to do so.
+func (b *S3Backup) Remove() error {
+	return b.removeLocal()
+}
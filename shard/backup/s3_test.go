@@ -0,0 +1,303 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"prismarine/shard/config"
+	"prismarine/shard/remote"
+	"prismarine/shard/runtime/filesystem"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testPartSize = 1024
+
+// fakeS3 is a stand-in for both the panel endpoints handing out presigned urls
+// and the S3 bucket they point to
+type fakeS3 struct {
+	srv *httptest.Server
+
+	mu      sync.Mutex
+	uploads map[string]string         // backup uuid to active upload id
+	parts   map[string]map[int][]byte // upload id to uploaded parts
+	puts    map[int]int               // part number to upload attempts
+	fail    map[int]int               // part number to remaining failures
+	objects map[string][]byte
+	status  map[string]remote.BackupStatusRequest
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	f := &fakeS3{
+		uploads: make(map[string]string),
+		parts:   make(map[string]map[int][]byte),
+		puts:    make(map[int]int),
+		fail:    make(map[int]int),
+		objects: make(map[string][]byte),
+		status:  make(map[string]remote.BackupStatusRequest),
+	}
+	f.srv = httptest.NewServer(f)
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := r.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/api/remote/backups/") && strings.HasSuffix(path, "/download"):
+		uuid := strings.TrimSuffix(strings.TrimPrefix(path, "/api/remote/backups/"), "/download")
+		if _, ok := f.objects[uuid]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"url": f.srv.URL + "/bucket/" + uuid})
+	case strings.HasPrefix(path, "/api/remote/backups/") && r.Method == http.MethodGet:
+		f.presign(w, r, strings.TrimPrefix(path, "/api/remote/backups/"))
+	case strings.HasPrefix(path, "/api/remote/backups/") && r.Method == http.MethodPost:
+		f.complete(w, r, strings.TrimPrefix(path, "/api/remote/backups/"))
+	case strings.HasPrefix(path, "/bucket/") && r.Method == http.MethodPut:
+		f.putPart(w, r)
+	case strings.HasPrefix(path, "/bucket/") && r.Method == http.MethodGet:
+		obj, ok := f.objects[strings.TrimPrefix(path, "/bucket/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(obj)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// presign starts a multipart upload, or continues the active one, and returns
+// a url for every part
+func (f *fakeS3) presign(w http.ResponseWriter, r *http.Request, uuid string) {
+	size, _ := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+
+	id, ok := f.uploads[uuid]
+	if !ok {
+		id = fmt.Sprintf("upload-%d", len(f.parts)+1)
+		f.uploads[uuid] = id
+		f.parts[id] = make(map[int][]byte)
+	}
+
+	res := remote.BackupUploadUrls{UploadId: id, PartSize: testPartSize}
+	for n := 1; int64(n-1)*testPartSize < size; n++ {
+		res.Parts = append(res.Parts, fmt.Sprintf("%s/bucket/%s?uploadId=%s&partNumber=%d", f.srv.URL, uuid, id, n))
+	}
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+func (f *fakeS3) putPart(w http.ResponseWriter, r *http.Request) {
+	n, _ := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	f.puts[n]++
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil || int64(len(body)) != r.ContentLength {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if f.fail[n] > 0 {
+		f.fail[n]--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	f.parts[r.URL.Query().Get("uploadId")][n] = body
+	sum := md5.Sum(body)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+// complete assembles the object from the parts the shard reported, failing if
+// any of them do not match what was uploaded
+func (f *fakeS3) complete(w http.ResponseWriter, r *http.Request, uuid string) {
+	var data remote.BackupStatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.status[uuid] = data
+	// Failed uploads are kept so that they can be resumed
+	if !data.Successful {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	id := f.uploads[uuid]
+	var obj []byte
+	for idx, p := range data.Parts {
+		body, ok := f.parts[id][p.PartNumber]
+		sum := md5.Sum(body)
+		if !ok || p.PartNumber != idx+1 || p.ETag != `"`+hex.EncodeToString(sum[:])+`"` {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		obj = append(obj, body...)
+	}
+
+	f.objects[uuid] = obj
+	delete(f.uploads, uuid)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setup configures a temporary backup directory and an instance filesystem
+// with a few files of random data, large enough to need several parts
+func setup(t *testing.T) (*filesystem.Filesystem, map[string][]byte) {
+	t.Helper()
+
+	cfg := config.Default()
+	cfg.System.BackupDirectory = t.TempDir()
+	config.Set(cfg)
+	t.Cleanup(func() { config.Set(nil) })
+
+	fs := filesystem.New(t.TempDir())
+	files := map[string][]byte{
+		"server.properties":   []byte("motd=hello"),
+		"world/level.dat":     make([]byte, 3000),
+		"world/region/r.0.0":  make([]byte, 2000),
+		"plugins/config.yaml": []byte("enabled: true"),
+	}
+	for name, b := range files {
+		if len(b) > 100 {
+			_, _ = rand.Read(b)
+		}
+		if err := fs.Write(name, bytes.NewReader(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return fs, files
+}
+
+func newTestS3Backup(t *testing.T, f *fakeS3, uuid string) *S3Backup {
+	t.Helper()
+	client := remote.New(f.srv.URL, remote.WithRetries(1, 0))
+	b, err := NewS3(client, "instance", uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.maxAttempts = 3
+	b.backoff = 0
+	return b
+}
+
+func TestS3Backup_GenerateAndRestore(t *testing.T) {
+	fs, files := setup(t)
+	f := newFakeS3(t)
+	b := newTestS3Backup(t, f, "backup-1")
+
+	d, err := b.Generate(context.Background(), fs, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj := f.objects["backup-1"]
+	sum := sha256.Sum256(obj)
+	if int64(len(obj)) != d.Size || hex.EncodeToString(sum[:]) != d.Checksum {
+		t.Fatalf("expected object to match the backup details, got %d bytes", len(obj))
+	}
+	if len(f.status["backup-1"].Parts) < 2 {
+		t.Fatalf("expected the backup to be uploaded in several parts, got %d", len(f.status["backup-1"].Parts))
+	}
+	if _, err := os.Stat(b.archivePath()); !os.IsNotExist(err) {
+		t.Fatal("expected the local archive to be removed after uploading")
+	}
+
+	r, err := b.Open(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	restored := filesystem.New(t.TempDir())
+	if err := restored.ExtractTarGz("/", r); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(restored.Path(), name))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("expected %s to be restored (%v)", name, err)
+		}
+	}
+}
+
+func TestS3Backup_RetriesParts(t *testing.T) {
+	fs, _ := setup(t)
+	f := newFakeS3(t)
+	f.fail[2] = 2
+	b := newTestS3Backup(t, f, "backup-1")
+
+	if _, err := b.Generate(context.Background(), fs, ""); err != nil {
+		t.Fatalf("expected transient part failures to be retried, got %v", err)
+	}
+	if f.puts[2] != 3 {
+		t.Fatalf("expected part 2 to be attempted 3 times, got %d", f.puts[2])
+	}
+	if _, ok := f.objects["backup-1"]; !ok {
+		t.Fatal("expected the upload to be completed")
+	}
+}
+
+func TestS3Backup_Resume(t *testing.T) {
+	fs, _ := setup(t)
+	f := newFakeS3(t)
+	f.fail[3] = 100
+	b := newTestS3Backup(t, f, "backup-1")
+
+	if _, err := b.Generate(context.Background(), fs, ""); err == nil {
+		t.Fatal("expected the upload to fail")
+	}
+	if st, ok := f.status["backup-1"]; !ok || st.Successful {
+		t.Fatalf("expected the failure to be reported to the panel, got %+v", st)
+	}
+	if _, err := os.Stat(b.statePath()); err != nil {
+		t.Fatal("expected the upload state to be kept for resuming")
+	}
+
+	f.mu.Lock()
+	f.fail[3] = 0
+	f.mu.Unlock()
+
+	// Changing the files must not matter, the archive that was already
+	// partially uploaded is the one that gets resumed
+	if err := fs.Write("server.properties", strings.NewReader("motd=changed")); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := b.Generate(context.Background(), fs, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.puts[1] != 1 || f.puts[2] != 1 {
+		t.Fatalf("expected uploaded parts to be skipped when resuming, got %v", f.puts)
+	}
+	sum := sha256.Sum256(f.objects["backup-1"])
+	if hex.EncodeToString(sum[:]) != d.Checksum {
+		t.Fatal("expected the resumed object to match the backup checksum")
+	}
+}
+
+func TestS3Backup_OpenMissing(t *testing.T) {
+	setup(t)
+	f := newFakeS3(t)
+	b := newTestS3Backup(t, f, "missing")
+
+	if _, err := b.Open(context.Background()); err != ErrBackupNotFound {
+		t.Fatalf("expected ErrBackupNotFound, got %v", err)
+	}
+}
@@ -2,39 +2,120 @@ package cmd
 
 import (
 	"context"
+	"flag"
+	"os/signal"
+	"prismarine/shard/config"
 	"prismarine/shard/manager"
+	"prismarine/shard/remote"
 	"prismarine/shard/router"
+	"prismarine/shard/sftp"
+	"syscall"
+	"time"
 
 	"github.com/charmbracelet/log"
+	"github.com/pkg/errors"
 )
 
+// httpShutdownTimeout is how long in-flight requests are given to finish when
+// the shard shuts down
+const httpShutdownTimeout = 30 * time.Second
+
 func Execute() {
-	log.SetLevel(log.DebugLevel)
-	manager, err := manager.NewManager(context.Background())
+	configPath := flag.String("config", config.DefaultLocation, "path to the shard configuration file")
+	debug := flag.Bool("debug", false, "enable debug logging, ignoring the configured log level")
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath)
+	if errors.Is(err, config.ErrNotConfigured) {
+		log.Fatal("a new configuration file was created, set remote.url and remote.token in it and start the shard again", "path", *configPath)
+		return
+	} else if err != nil {
+		log.Fatal("failed to load configuration", "path", *configPath, "err", err)
+		return
+	}
+	config.Set(cfg)
+
+	log.SetLevel(cfg.ParsedLogLevel())
+	if *debug {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	client := remote.New(cfg.Remote.Url, remote.WithCredentials(cfg.Remote.Token))
+
+	manager, err := manager.NewManager(context.Background(), client)
 	if err != nil {
-		log.Fatal("failed to initialize manager")
+		log.Fatal("failed to initialize manager", "err", err)
 		return
 	}
 
-	for _, s := range manager.All() {
-		log.Debugf("server %s loaded", s.Id())
+	// Only instances that were running before the shard restarted are
+	// started again
+	manager.RestoreStates(context.Background())
 
-		if err := s.Start(s.Context(), false, 0); err != nil {
-			log.Error(err, "Failed to start server")
-		}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
 
+	if cfg.Sftp.Enabled {
+		if err := startSftp(ctx, cfg, manager); err != nil {
+			log.Fatal("failed to start sftp server", "err", err)
+			return
+		}
 	}
 
 	routes := router.Create(manager)
-	routes.Listen(":3000")
+	errCh := make(chan error, 1)
+	go func() {
+		if cfg.Api.Ssl.Enabled {
+			errCh <- routes.ListenTLS(cfg.Address(), cfg.Api.Ssl.CertificateFile, cfg.Api.Ssl.KeyFile)
+		} else {
+			errCh <- routes.Listen(cfg.Address())
+		}
+	}()
 
-	// log.Debug("Waiting...")
-	// time.Sleep(10 * time.Second)
-	// log.Debug("Executing again...")
+	select {
+	case <-ctx.Done():
+	case err := <-errCh:
+		log.Fatal("failed to serve api", "err", err)
+		return
+	}
+	// A second signal skips the graceful shutdown
+	stop()
 
-	// for _, s := range manager.All() {
-	// 	if err := s.WaitForStop(s.Context(), 30, true, false, 0); err != nil {
-	// 		log.Error(err, "Failed to stop server")
-	// 	}
-	// }
+	log.Info("shutting down", "policy", cfg.System.ShutdownPolicy)
+
+	// Let in-flight requests finish before the instances they act on go away
+	if err := routes.ShutdownWithTimeout(httpShutdownTimeout); err != nil {
+		log.Warn("failed to shut down api", "err", err)
+	}
+
+	timeout := time.Duration(cfg.System.ShutdownTimeout) * time.Second
+	if err := manager.Shutdown(cfg.System.ShutdownPolicy == config.ShutdownStop, timeout); err != nil {
+		log.Error("failed to shut down instances", "err", err)
+	}
+
+	log.Info("shutdown complete")
+}
+
+// startSftp starts the SFTP server in the background using the configured
+// authenticator, until the context is canceled
+func startSftp(ctx context.Context, cfg *config.Configuration, m *manager.Manager) error {
+	var auth sftp.Authenticator = sftp.NewPanelAuthenticator(m.Client())
+	if cfg.Sftp.Auth == config.SftpAuthFile {
+		fa, err := sftp.NewFileAuthenticator(cfg.Sftp.UsersFile)
+		if err != nil {
+			return err
+		}
+		auth = fa
+	}
+
+	srv, err := sftp.New(m, auth)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := srv.Run(ctx); err != nil {
+			log.Error("sftp server stopped", "err", err)
+		}
+	}()
+	return nil
 }
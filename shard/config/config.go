@@ -0,0 +1,455 @@
+package config
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/charmbracelet/log"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultLocation is where the configuration file is read from when no other
+// path is provided
+const DefaultLocation = "/etc/prismarine/config.yml"
+
+var (
+	mu      sync.RWMutex
+	_config *Configuration
+)
+
+// ErrNotConfigured is returned by Load when the configuration file did not
+// exist and was created with the default values, which cannot connect to a
+// panel. The file has to be edited before the shard can start.
+var ErrNotConfigured = errors.New("config: configuration file was created with default values, set the remote url and token to connect to the panel")
+
+type Configuration struct {
+	// The location the configuration was loaded from, and will be written to
+	path string
+
+	// LogLevel is the minimum level of messages that are logged, one of debug,
+	// info, warn or error
+	LogLevel string `yaml:"log_level" env:"PRISMARINE_LOG_LEVEL"`
+
+	System SystemConfiguration `yaml:"system"`
+	Api    ApiConfiguration    `yaml:"api"`
+	Docker DockerConfiguration `yaml:"docker"`
+	Remote RemoteConfiguration `yaml:"remote"`
+	Sftp   SftpConfiguration   `yaml:"sftp"`
+}
+
+// SystemConfiguration defines where the shard stores its data on the host
+type SystemConfiguration struct {
+	// RootDirectory is where the shard stores all of its own data
+	RootDirectory string `yaml:"root_directory" env:"PRISMARINE_ROOT_DIRECTORY"`
+
+	// DataDirectory is where the data directories of instances are stored
+	DataDirectory string `yaml:"data" env:"PRISMARINE_DATA_DIRECTORY"`
+
+	// BackupDirectory is where local backups of instances are stored
+	BackupDirectory string `yaml:"backups" env:"PRISMARINE_BACKUP_DIRECTORY"`
+
+	// LogDirectory is where the shard writes logs, such as the output of
+	// install scripts
+	LogDirectory string `yaml:"log_directory" env:"PRISMARINE_LOG_DIRECTORY"`
+
+	// DiskCheckInterval is how long in seconds the disk usage of an instance
+	// is cached for before its data directory is walked again
+	DiskCheckInterval int `yaml:"disk_check_interval" env:"PRISMARINE_DISK_CHECK_INTERVAL"`
+
+	// BootWorkers is how many instances are initialized in parallel when the
+	// shard starts
+	BootWorkers int `yaml:"boot_workers" env:"PRISMARINE_BOOT_WORKERS"`
+
+	// ShutdownPolicy is what happens to running instances when the shard
+	// shuts down, either "detach" or "stop"
+	ShutdownPolicy string `yaml:"shutdown_policy" env:"PRISMARINE_SHUTDOWN_POLICY"`
+
+	// ShutdownTimeout is how long in seconds instances are given to stop
+	// when shutting down with the stop policy before they are terminated
+	ShutdownTimeout int `yaml:"shutdown_timeout" env:"PRISMARINE_SHUTDOWN_TIMEOUT"`
+}
+
+const (
+	// ShutdownDetach leaves containers running when the shard shuts down, to
+	// be attached to again when it starts
+	ShutdownDetach = "detach"
+	// ShutdownStop stops every instance when the shard shuts down
+	ShutdownStop = "stop"
+)
+
+// ApiConfiguration defines how the shard API is served
+type ApiConfiguration struct {
+	Host string `yaml:"host" env:"PRISMARINE_API_HOST"`
+	Port int    `yaml:"port" env:"PRISMARINE_API_PORT"`
+
+	Ssl struct {
+		Enabled         bool   `yaml:"enabled" env:"PRISMARINE_API_SSL_ENABLED"`
+		CertificateFile string `yaml:"cert" env:"PRISMARINE_API_SSL_CERT"`
+		KeyFile         string `yaml:"key" env:"PRISMARINE_API_SSL_KEY"`
+	} `yaml:"ssl"`
+}
+
+// DockerConfiguration defines how the shard connects to Docker and the
+// settings applied to every container it creates
+type DockerConfiguration struct {
+	// Socket is the address of the Docker daemon
+	Socket string `yaml:"socket" env:"PRISMARINE_DOCKER_SOCKET"`
+
+	Network DockerNetworkConfiguration `yaml:"network"`
+
+	// Policy restricts the container settings instances are allowed to use
+	Policy ContainerPolicy `yaml:"policy"`
+
+	// StatsInterval is how often in seconds resource usage is published for
+	// running instances
+	StatsInterval int `yaml:"stats_interval" env:"PRISMARINE_DOCKER_STATS_INTERVAL"`
+
+	// UsePerformantInspect uses a faster JSON decoder when inspecting
+	// containers. Disable this if inspecting containers starts failing.
+	UsePerformantInspect bool `yaml:"use_performant_inspect" env:"PRISMARINE_DOCKER_USE_PERFORMANT_INSPECT"`
+}
+
+type DockerNetworkConfiguration struct {
+	// Mode is the network mode containers are attached to
+	Mode string `yaml:"mode" env:"PRISMARINE_DOCKER_NETWORK_MODE"`
+
+	// Interface is the host IP that ports are bound to when an allocation
+	// does not specify one
+	Interface string `yaml:"interface" env:"PRISMARINE_DOCKER_NETWORK_INTERFACE"`
+
+	// Dns are the DNS servers given to containers
+	Dns []string `yaml:"dns" env:"PRISMARINE_DOCKER_NETWORK_DNS"`
+}
+
+// ContainerPolicy is enforced on every instance container before it is created
+// so that the panel cannot configure a container that compromises the host
+type ContainerPolicy struct {
+	// AllowedMounts are the host directories that instances may mount from
+	AllowedMounts []string `yaml:"allowed_mounts"`
+
+	// AllowRootUser allows instances to explicitly run their process as root
+	AllowRootUser bool `yaml:"allow_root_user"`
+
+	// AllowPrivilegedPorts allows instances to bind host ports below 1024
+	AllowPrivilegedPorts bool `yaml:"allow_privileged_ports"`
+
+	// PidsLimit is the process limit for instances that do not set one, and
+	// the highest limit an instance may request
+	PidsLimit int64 `yaml:"pids_limit"`
+
+	// TmpfsSize is the size in MiB of the /tmp directory given to every
+	// container
+	TmpfsSize int64 `yaml:"tmpfs_size"`
+}
+
+// RemoteConfiguration defines how the shard connects to the panel
+type RemoteConfiguration struct {
+	Url   string `yaml:"url" env:"PRISMARINE_PANEL_URL"`
+	Token string `yaml:"token" env:"PRISMARINE_PANEL_TOKEN"`
+}
+
+const (
+	// SftpAuthPanel validates SFTP credentials against the panel
+	SftpAuthPanel = "panel"
+	// SftpAuthFile validates SFTP credentials against a local users file
+	SftpAuthFile = "file"
+)
+
+// SftpConfiguration defines the embedded SFTP server
+type SftpConfiguration struct {
+	Enabled bool   `yaml:"enabled" env:"PRISMARINE_SFTP_ENABLED"`
+	Host    string `yaml:"host" env:"PRISMARINE_SFTP_HOST"`
+	Port    int    `yaml:"port" env:"PRISMARINE_SFTP_PORT"`
+
+	// ReadOnly refuses every change to instance files over SFTP, regardless
+	// of the permissions of the user
+	ReadOnly bool `yaml:"read_only" env:"PRISMARINE_SFTP_READ_ONLY"`
+
+	// HostKey is the private key the server identifies itself with. It is
+	// generated if it does not exist
+	HostKey string `yaml:"host_key" env:"PRISMARINE_SFTP_HOST_KEY"`
+
+	// Auth is how credentials are validated, either "panel" or "file"
+	Auth string `yaml:"auth" env:"PRISMARINE_SFTP_AUTH"`
+	// UsersFile is the users file read when using file authentication
+	UsersFile string `yaml:"users_file" env:"PRISMARINE_SFTP_USERS_FILE"`
+}
+
+// SftpAddress returns the address the SFTP server listens on
+func (c *Configuration) SftpAddress() string {
+	return c.Sftp.Host + ":" + strconv.Itoa(c.Sftp.Port)
+}
+
+// Default returns a configuration with all the default values set
+func Default() *Configuration {
+	c := &Configuration{
+		path:     DefaultLocation,
+		LogLevel: "info",
+		System: SystemConfiguration{
+			RootDirectory:   "/var/lib/prismarine",
+			DataDirectory:   "/var/lib/prismarine/volumes",
+			BackupDirectory: "/var/lib/prismarine/backups",
+			LogDirectory:    "/var/log/prismarine",
+
+			DiskCheckInterval: 150,
+			BootWorkers:       8,
+			ShutdownPolicy:    ShutdownDetach,
+			ShutdownTimeout:   60,
+		},
+		Api: ApiConfiguration{
+			Host: "0.0.0.0",
+			Port: 3000,
+		},
+		Docker: DockerConfiguration{
+			Socket: "unix:///var/run/docker.sock",
+			Network: DockerNetworkConfiguration{
+				Mode:      "bridge",
+				Interface: "0.0.0.0",
+				Dns:       []string{"1.1.1.1", "1.0.0.1"},
+			},
+			Policy: ContainerPolicy{
+				PidsLimit: 512,
+				TmpfsSize: 100,
+			},
+			StatsInterval:        1,
+			UsePerformantInspect: true,
+		},
+		Sftp: SftpConfiguration{
+			Enabled: true,
+			Host:    "0.0.0.0",
+			Port:    2022,
+			HostKey: "/var/lib/prismarine/.sftp/id_ed25519",
+			Auth:    SftpAuthPanel,
+		},
+	}
+	return c
+}
+
+// Get returns a copy of the global configuration
+func Get() *Configuration {
+	mu.RLock()
+	defer mu.RUnlock()
+	if _config == nil {
+		return Default()
+	}
+	c := *_config
+	return &c
+}
+
+// Set replaces the global configuration
+func Set(c *Configuration) {
+	mu.Lock()
+	defer mu.Unlock()
+	_config = c
+}
+
+// Load reads the configuration file at the given path on top of the default
+// values, applies any environment variable overrides, and validates the
+// result. If the file does not exist it is created with the default values,
+// and ErrNotConfigured is returned unless the environment sets the panel to
+// connect to.
+func Load(path string) (*Configuration, error) {
+	c := Default()
+	c.path = path
+
+	b, err := os.ReadFile(path)
+	created := os.IsNotExist(err)
+	if err != nil {
+		if !created {
+			return nil, errors.Wrap(err, "config: failed to read configuration file")
+		}
+
+		log.With("path", path).Warn("configuration file does not exist, writing defaults")
+		if err := c.WriteToDisk(); err != nil {
+			return nil, err
+		}
+	} else if err := yaml.Unmarshal(b, c); err != nil {
+		return nil, errors.Wrap(err, "config: failed to parse configuration file")
+	}
+
+	if err := applyEnvironment(reflect.ValueOf(c).Elem()); err != nil {
+		return nil, err
+	}
+
+	if created && (c.Remote.Url == "" || c.Remote.Token == "") {
+		return nil, ErrNotConfigured
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Path returns the location of the configuration file
+func (c *Configuration) Path() string {
+	return c.path
+}
+
+// Address returns the address the API listens on
+func (c *Configuration) Address() string {
+	return c.Api.Host + ":" + strconv.Itoa(c.Api.Port)
+}
+
+// ParsedLogLevel returns the log level for the logger
+func (c *Configuration) ParsedLogLevel() log.Level {
+	l, _ := log.ParseLevel(c.LogLevel)
+	return l
+}
+
+// Validate checks that the configuration is usable
+func (c *Configuration) Validate() error {
+	if _, err := log.ParseLevel(c.LogLevel); err != nil {
+		return errors.Errorf("config: invalid log level: %s", c.LogLevel)
+	}
+
+	if c.Api.Port < 1 || c.Api.Port > 65535 {
+		return errors.Errorf("config: invalid api port: %d", c.Api.Port)
+	}
+	if c.Api.Ssl.Enabled && (c.Api.Ssl.CertificateFile == "" || c.Api.Ssl.KeyFile == "") {
+		return errors.New("config: ssl is enabled but the certificate or key file is missing")
+	}
+
+	if !filepath.IsAbs(c.System.RootDirectory) || !filepath.IsAbs(c.System.DataDirectory) || !filepath.IsAbs(c.System.BackupDirectory) || !filepath.IsAbs(c.System.LogDirectory) {
+		return errors.New("config: system directories must be absolute paths")
+	}
+	if c.System.DiskCheckInterval < 1 {
+		return errors.New("config: disk check interval must be at least one second")
+	}
+	if c.System.BootWorkers < 1 {
+		return errors.New("config: boot workers must be at least one")
+	}
+	if c.System.ShutdownPolicy != ShutdownDetach && c.System.ShutdownPolicy != ShutdownStop {
+		return errors.Errorf("config: invalid shutdown policy: %s", c.System.ShutdownPolicy)
+	}
+	if c.System.ShutdownTimeout < 1 {
+		return errors.New("config: shutdown timeout must be at least one second")
+	}
+
+	if c.Docker.Socket == "" {
+		return errors.New("config: docker socket cannot be empty")
+	}
+
+	if c.Docker.StatsInterval < 1 {
+		return errors.New("config: docker stats interval must be at least one second")
+	}
+
+	if c.Docker.Policy.PidsLimit < 0 || c.Docker.Policy.TmpfsSize < 0 {
+		return errors.New("config: docker policy limits cannot be negative")
+	}
+	for _, m := range c.Docker.Policy.AllowedMounts {
+		if !filepath.IsAbs(m) {
+			return errors.Errorf("config: allowed mount must be an absolute path: %s", m)
+		}
+	}
+
+	if c.Sftp.Enabled {
+		if c.Sftp.Port < 1 || c.Sftp.Port > 65535 {
+			return errors.Errorf("config: invalid sftp port: %d", c.Sftp.Port)
+		}
+		if !filepath.IsAbs(c.Sftp.HostKey) {
+			return errors.New("config: sftp host key must be an absolute path")
+		}
+		switch c.Sftp.Auth {
+		case SftpAuthPanel:
+		case SftpAuthFile:
+			if c.Sftp.UsersFile == "" {
+				return errors.New("config: sftp users file is required for file authentication")
+			}
+		default:
+			return errors.Errorf("config: invalid sftp auth: %s", c.Sftp.Auth)
+		}
+	}
+
+	if c.Remote.Url == "" {
+		return errors.New("config: remote url is required")
+	}
+	if u, err := url.Parse(c.Remote.Url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.Errorf("config: invalid remote url: %s", c.Remote.Url)
+	}
+	if c.Remote.Token == "" {
+		return errors.New("config: remote token is required")
+	}
+
+	return nil
+}
+
+// WriteToDisk writes the configuration to the file it was loaded from
+func (c *Configuration) WriteToDisk() error {
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return errors.Wrap(err, "config: failed to marshal configuration")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return errors.Wrap(err, "config: failed to create configuration directory")
+	}
+
+	// The file contains the panel token, so keep it private
+	if err := os.WriteFile(c.path, b, 0o600); err != nil {
+		return errors.Wrap(err, "config: failed to write configuration file")
+	}
+	return nil
+}
+
+// applyEnvironment walks the configuration struct and overrides every field
+// with an env tag if that environment variable is set
+func applyEnvironment(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+
+		if f.Kind() == reflect.Struct {
+			if err := applyEnvironment(f); err != nil {
+				return err
+			}
+			continue
+		}
+
+		key := sf.Tag.Get("env")
+		if key == "" {
+			continue
+		}
+		val, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(val)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return errors.Errorf("config: invalid boolean for %s: %s", key, val)
+			}
+			f.SetBool(b)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return errors.Errorf("config: invalid integer for %s: %s", key, val)
+			}
+			f.SetInt(n)
+		case reflect.Slice:
+			var parts []string
+			for _, p := range strings.Split(val, ",") {
+				if p = strings.TrimSpace(p); p != "" {
+					parts = append(parts, p)
+				}
+			}
+			f.Set(reflect.ValueOf(parts))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// configured returns the default configuration with a panel to connect to
+func configured() *Configuration {
+	c := Default()
+	c.Remote.Url = "https://panel.example.com"
+	c.Remote.Token = "token"
+	return c
+}
+
+func TestDefault(t *testing.T) {
+	if err := configured().Validate(); err != nil {
+		t.Fatalf("expected the defaults to be valid, got %v", err)
+	}
+	if err := Default().Validate(); err == nil {
+		t.Fatal("expected the defaults to need a panel")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := map[string]func(c *Configuration){
+		"log level":             func(c *Configuration) { c.LogLevel = "loud" },
+		"api port":              func(c *Configuration) { c.Api.Port = 0 },
+		"api port too high":     func(c *Configuration) { c.Api.Port = 65536 },
+		"ssl without files":     func(c *Configuration) { c.Api.Ssl.Enabled = true },
+		"relative root":         func(c *Configuration) { c.System.RootDirectory = "prismarine" },
+		"relative data":         func(c *Configuration) { c.System.DataDirectory = "volumes" },
+		"disk check interval":   func(c *Configuration) { c.System.DiskCheckInterval = 0 },
+		"boot workers":          func(c *Configuration) { c.System.BootWorkers = 0 },
+		"shutdown policy":       func(c *Configuration) { c.System.ShutdownPolicy = "explode" },
+		"shutdown timeout":      func(c *Configuration) { c.System.ShutdownTimeout = 0 },
+		"docker socket":         func(c *Configuration) { c.Docker.Socket = "" },
+		"stats interval":        func(c *Configuration) { c.Docker.StatsInterval = 0 },
+		"negative pids limit":   func(c *Configuration) { c.Docker.Policy.PidsLimit = -1 },
+		"relative mount":        func(c *Configuration) { c.Docker.Policy.AllowedMounts = []string{"srv"} },
+		"sftp port":             func(c *Configuration) { c.Sftp.Port = 0 },
+		"relative host key":     func(c *Configuration) { c.Sftp.HostKey = "id_ed25519" },
+		"sftp auth":             func(c *Configuration) { c.Sftp.Auth = "ldap" },
+		"sftp file without one": func(c *Configuration) { c.Sftp.Auth = SftpAuthFile },
+		"no remote url":         func(c *Configuration) { c.Remote.Url = "" },
+		"remote url scheme":     func(c *Configuration) { c.Remote.Url = "ftp://panel.example.com" },
+		"remote url host":       func(c *Configuration) { c.Remote.Url = "https://" },
+		"no remote token":       func(c *Configuration) { c.Remote.Token = "" },
+	}
+	for name, mutate := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := configured()
+			mutate(c)
+			if err := c.Validate(); err == nil {
+				t.Fatal("expected the configuration to be invalid")
+			}
+		})
+	}
+
+	// Settings of a disabled sftp server are not checked
+	c := configured()
+	c.Sftp.Enabled = false
+	c.Sftp.Port = 0
+	if err := c.Validate(); err != nil {
+		t.Fatalf("expected a disabled sftp server to be ignored, got %v", err)
+	}
+}
+
+func TestLoad_Missing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "config.yml")
+
+	if _, err := Load(path); err != ErrNotConfigured {
+		t.Fatalf("expected ErrNotConfigured on first boot, got %v", err)
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("expected the defaults to be written: %v", err)
+	}
+	if st.Mode().Perm() != 0o600 {
+		t.Fatalf("expected the file to be private, got %v", st.Mode())
+	}
+
+	// The generated file only needs the panel filling in
+	t.Setenv("PRISMARINE_PANEL_URL", "https://panel.example.com")
+	t.Setenv("PRISMARINE_PANEL_TOKEN", "token")
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Remote.Url != "https://panel.example.com" || c.Api.Port != Default().Api.Port || c.Sftp.HostKey != Default().Sftp.HostKey {
+		t.Fatalf("expected the defaults to be loaded, got %+v", c)
+	}
+}
+
+func TestLoad_MissingWithEnvironment(t *testing.T) {
+	t.Setenv("PRISMARINE_PANEL_URL", "https://panel.example.com")
+	t.Setenv("PRISMARINE_PANEL_TOKEN", "token")
+
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if _, err := Load(path); err != nil {
+		t.Fatalf("expected the panel set by the environment to be enough, got %v", err)
+	}
+}
+
+func TestLoad_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	yml := `
+log_level: debug
+api:
+  port: 8080
+remote:
+  url: https://panel.example.com
+  token: token
+docker:
+  network:
+    dns: [8.8.8.8]
+`
+	if err := os.WriteFile(path, []byte(yml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.LogLevel != "debug" || c.Api.Port != 8080 || !reflect.DeepEqual(c.Docker.Network.Dns, []string{"8.8.8.8"}) {
+		t.Fatalf("expected the file to override the defaults, got %+v", c)
+	}
+	if c.Api.Host != "0.0.0.0" || c.System.BootWorkers != 8 {
+		t.Fatalf("expected the defaults to fill in the rest, got %+v", c)
+	}
+	if c.Path() != path {
+		t.Fatalf("expected the path to be kept, got %s", c.Path())
+	}
+
+	if err := os.WriteFile(path, []byte("api: [not, a, map]"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Fatal("expected a malformed file to fail")
+	}
+
+	if err := os.WriteFile(path, []byte("api:\n  port: 0\nremote:\n  url: https://panel.example.com\n  token: token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Fatal("expected an invalid file to fail validation")
+	}
+}
+
+func TestLoad_Environment(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := configured().withPath(path).WriteToDisk(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PRISMARINE_LOG_LEVEL", "warn")
+	t.Setenv("PRISMARINE_API_PORT", "9000")
+	t.Setenv("PRISMARINE_SFTP_READ_ONLY", "true")
+	t.Setenv("PRISMARINE_DOCKER_NETWORK_DNS", "9.9.9.9, ,149.112.112.112")
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.LogLevel != "warn" || c.Api.Port != 9000 || !c.Sftp.ReadOnly {
+		t.Fatalf("expected the environment to override the file, got %+v", c)
+	}
+	if !reflect.DeepEqual(c.Docker.Network.Dns, []string{"9.9.9.9", "149.112.112.112"}) {
+		t.Fatalf("expected a comma separated list, got %v", c.Docker.Network.Dns)
+	}
+
+	for key, val := range map[string]string{
+		"PRISMARINE_API_PORT":       "many",
+		"PRISMARINE_SFTP_READ_ONLY": "maybe",
+	} {
+		t.Run(key, func(t *testing.T) {
+			t.Setenv(key, val)
+			if _, err := Load(path); err == nil {
+				t.Fatalf("expected %s=%s to be rejected", key, val)
+			}
+		})
+	}
+}
+
+func (c *Configuration) withPath(path string) *Configuration {
+	c.path = path
+	return c
+}
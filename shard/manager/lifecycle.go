@@ -0,0 +1,160 @@
+package manager
+
+import (
+	"context"
+	"prismarine/shard/backup"
+	"prismarine/shard/runtime"
+	"sync"
+
+	"github.com/charmbracelet/log"
+	"github.com/pkg/errors"
+)
+
+// ErrInstanceExists is returned when creating an instance with the uuid of one
+// that is already on this shard
+var ErrInstanceExists = errors.New("manager: an instance with that uuid already exists")
+
+// Create creates a new instance from the configuration, creating its data
+// directory and container before adding it to the manager. The uuid is
+// reserved for the whole time, so concurrent creations of the same instance
+// fail rather than both creating a container. Instances that failed to
+// initialize may be created again, replacing the errored entry.
+func (m *Manager) Create(cfg *runtime.Configuration) (runtime.Instance, error) {
+	if cfg.RWMutex == nil {
+		cfg.RWMutex = &sync.RWMutex{}
+	}
+	if err := m.Reserve(cfg.Uuid); err != nil {
+		return nil, err
+	}
+	defer m.Release(cfg.Uuid)
+
+	i, err := newInstance(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	l := log.With("instance", i.Id())
+	if err := i.Filesystem().EnsureRoot(); err != nil {
+		return nil, err
+	}
+	if err := i.Create(); err != nil {
+		if rerr := i.Filesystem().RemoveRootDirectory(); rerr != nil {
+			l.Warn("failed to remove files of instance that could not be created", "err", rerr)
+		}
+		return nil, err
+	}
+
+	m.Add(i)
+	l.Info("instance created")
+	return i, nil
+}
+
+// Reserve claims a uuid for an instance that is being created, failing with
+// ErrInstanceExists if the uuid is already in use or reserved
+func (m *Manager) Reserve(uuid string) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.servers[uuid]; ok {
+		return ErrInstanceExists
+	}
+	if _, ok := m.creating[uuid]; ok {
+		return ErrInstanceExists
+	}
+	m.creating[uuid] = struct{}{}
+	return nil
+}
+
+// Release frees a uuid reserved by Reserve, once the instance has either been
+// added or failed to be created
+func (m *Manager) Release(uuid string) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.creating, uuid)
+}
+
+// Delete stops an instance and removes it from the manager, along with its
+// container, data directory and backups. The instance is left untouched if it
+// cannot be stopped.
+func (m *Manager) Delete(ctx context.Context, i runtime.Instance) error {
+	if i.IsTransferring() {
+		return runtime.ErrInstanceTransferring
+	} else if i.IsRestoring() {
+		return runtime.ErrInstanceRestoring
+	}
+
+	i.CancelInstall()
+	if i.State() != runtime.ProcessOfflineState {
+		if err := i.WaitForStop(ctx, stopTimeout, true, false, 0); err != nil {
+			return errors.Wrap(err, "manager: failed to stop instance")
+		}
+	}
+
+	id := i.Id()
+	m.Remove(func(match runtime.Instance) bool {
+		return match.Id() == id
+	})
+
+	// Destroying the bus first stops the container removal from being seen as
+	// a crash, and disconnects any websockets
+	i.Events().Destroy()
+	i.ContextCancel()
+
+	err := purge(i)
+	log.With("instance", id).Info("instance deleted")
+	return err
+}
+
+// DeleteErrored removes an instance that failed to initialize, along with any
+// container, data directory and backups it left behind
+func (m *Manager) DeleteErrored(uuid string) error {
+	if _, ok := m.FindErrored(uuid); !ok {
+		return errors.New("manager: no errored instance with that uuid")
+	}
+	// Errored instances are listed whatever their uuid, and it is about to be
+	// used to find directories to remove
+	if !runtime.ValidUuid(uuid) {
+		return errors.Errorf("manager: invalid uuid: %q", uuid)
+	}
+
+	// The settings are what failed, so only the uuid is used to find what
+	// needs removing
+	i, err := newRuntime(&runtime.Configuration{RWMutex: &sync.RWMutex{}, Uuid: uuid})
+	if err != nil {
+		return err
+	}
+	defer i.ContextCancel()
+
+	m.Lock()
+	m.removeErrored(uuid)
+	m.Unlock()
+	if err := m.states.Delete(uuid); err != nil {
+		log.With("instance", uuid).Warn("failed to remove instance state", "err", err)
+	}
+
+	err = purge(i)
+	log.With("instance", uuid).Info("errored instance deleted")
+	return err
+}
+
+// purge removes everything belonging to an instance from the runtime and
+// disk. Every step is attempted even if an earlier one fails.
+func purge(i runtime.Instance) error {
+	var errs []error
+	if err := i.Destroy(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := i.Filesystem().RemoveRootDirectory(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := backup.RemoveAll(i.Id()); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		for _, err := range errs[1:] {
+			log.With("instance", i.Id()).Warn("failed to remove instance", "err", err)
+		}
+		return errs[0]
+	}
+	return nil
+}
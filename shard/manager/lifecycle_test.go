@@ -0,0 +1,199 @@
+package manager
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"prismarine/shard/config"
+	"prismarine/shard/runtime"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func newConfiguration(uuid string) *runtime.Configuration {
+	return &runtime.Configuration{Uuid: uuid, Container: &runtime.Container{Image: "alpine"}}
+}
+
+func TestManager_Create(t *testing.T) {
+	m := setup(t)
+	useTestRuntime(t, nil)
+
+	i, err := m.Create(newConfiguration("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := m.Get("a"); !ok || got != i {
+		t.Fatal("expected the instance to be added")
+	}
+	if _, err := os.Stat(i.Filesystem().Path()); err != nil {
+		t.Fatalf("expected the data directory to be created: %v", err)
+	}
+
+	if _, err := m.Create(newConfiguration("a")); err != ErrInstanceExists {
+		t.Fatalf("expected ErrInstanceExists, got %v", err)
+	}
+	if _, err := m.Create(newConfiguration("../a")); err == nil {
+		t.Fatal("expected an invalid configuration to be rejected")
+	}
+}
+
+func TestManager_CreateFailure(t *testing.T) {
+	m := setup(t)
+	fail := true
+	useTestRuntime(t, func(i *testInstance) {
+		if fail {
+			i.createErr = errors.New("no such image")
+		}
+	})
+
+	if _, err := m.Create(newConfiguration("a")); err == nil {
+		t.Fatal("expected the creation to fail")
+	}
+	if _, ok := m.Get("a"); ok {
+		t.Fatal("expected the instance not to be added")
+	}
+	if _, err := os.Stat(filepath.Join(config.Get().System.DataDirectory, "a")); !os.IsNotExist(err) {
+		t.Fatal("expected the data directory to be removed")
+	}
+
+	// The uuid is released for another attempt
+	fail = false
+	if _, err := m.Create(newConfiguration("a")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManager_CreateConcurrent(t *testing.T) {
+	m := setup(t)
+	creating := make(chan struct{})
+	proceed := make(chan struct{})
+	first := true
+	useTestRuntime(t, func(i *testInstance) {
+		if first {
+			first = false
+			i.onCreate = func() {
+				close(creating)
+				<-proceed
+			}
+		}
+	})
+
+	done := make(chan error)
+	go func() {
+		_, err := m.Create(newConfiguration("a"))
+		done <- err
+	}()
+
+	// The uuid is taken while the first container is still being created
+	<-creating
+	if _, err := m.Create(newConfiguration("a")); err != ErrInstanceExists {
+		t.Errorf("expected ErrInstanceExists while creating, got %v", err)
+	}
+	close(proceed)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != 1 {
+		t.Fatalf("expected one instance, got %v", m.Keys())
+	}
+}
+
+func TestManager_Delete(t *testing.T) {
+	m := setup(t)
+	var created *testInstance
+	useTestRuntime(t, func(i *testInstance) { created = i })
+
+	if _, err := m.Create(newConfiguration("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := created.Start(context.Background(), false, 0); err != nil {
+		t.Fatal(err)
+	}
+	backups := filepath.Join(config.Get().System.BackupDirectory, "a")
+	if err := os.MkdirAll(backups, 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	created.transferring = true
+	if err := m.Delete(context.Background(), created); err != runtime.ErrInstanceTransferring {
+		t.Fatalf("expected ErrInstanceTransferring, got %v", err)
+	}
+	if _, ok := m.Get("a"); !ok || created.stops != 0 {
+		t.Fatal("expected the instance to be left untouched")
+	}
+	created.transferring = false
+
+	if err := m.Delete(context.Background(), created); err != nil {
+		t.Fatal(err)
+	}
+	if created.stops != 1 || !created.destroyed {
+		t.Fatalf("expected the instance to be stopped and destroyed, got %d stops", created.stops)
+	}
+	if _, ok := m.Get("a"); ok {
+		t.Fatal("expected the instance to be removed")
+	}
+	for _, p := range []string{created.Filesystem().Path(), backups} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed", p)
+		}
+	}
+	if state := m.states.Get("a"); state != runtime.ProcessOfflineState {
+		t.Fatalf("expected the state to be forgotten, got %s", state)
+	}
+}
+
+func TestManager_DeleteErrored(t *testing.T) {
+	m := setup(t)
+	var created *testInstance
+	useTestRuntime(t, func(i *testInstance) { created = i })
+
+	if err := m.DeleteErrored("a"); err == nil {
+		t.Fatal("expected an unknown instance to be rejected")
+	}
+	if created != nil {
+		t.Fatal("expected nothing to be removed")
+	}
+
+	m.addErrored("a", errors.New("invalid settings"))
+	if err := m.states.Set("a", runtime.ProcessRunningState); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.DeleteErrored("a"); err != nil {
+		t.Fatal(err)
+	}
+	if created == nil || created.Id() != "a" || !created.destroyed {
+		t.Fatal("expected the runtime instance to be destroyed")
+	}
+	if _, ok := m.FindErrored("a"); ok {
+		t.Fatal("expected the errored instance to be forgotten")
+	}
+	if state := m.states.Get("a"); state != runtime.ProcessOfflineState {
+		t.Fatalf("expected the state to be forgotten, got %s", state)
+	}
+}
+
+func TestManager_DeleteErroredInvalidUuid(t *testing.T) {
+	m := setup(t)
+	var created *testInstance
+	useTestRuntime(t, func(i *testInstance) { created = i })
+
+	data := config.Get().System.DataDirectory
+	if err := os.MkdirAll(data, 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	m.addErrored("..", errors.New("invalid settings"))
+	if err := m.DeleteErrored(".."); err == nil {
+		t.Fatal("expected an invalid uuid to be rejected")
+	}
+	if created != nil {
+		t.Fatal("expected nothing to be removed")
+	}
+	if _, ok := m.FindErrored(".."); !ok {
+		t.Fatal("expected the errored instance to be kept")
+	}
+	if _, err := os.Stat(data); err != nil {
+		t.Fatalf("expected the data directory to be left alone: %v", err)
+	}
+}
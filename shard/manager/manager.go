@@ -2,72 +2,255 @@ package manager
 
 import (
 	"context"
+	"encoding/json"
+	"path/filepath"
+	"prismarine/shard/config"
 	"prismarine/shard/remote"
 	"prismarine/shard/runtime"
 	"prismarine/shard/runtime/docker"
+	"prismarine/shard/runtime/events"
 	"sync"
 	"time"
 
 	"github.com/charmbracelet/log"
+	"github.com/pkg/errors"
 )
 
+// stopTimeout is how long an instance is given to stop before the manager
+// terminates it
+const stopTimeout = 2 * time.Minute
+
+// ErroredState is reported through the API for instances that failed to
+// initialize
+const ErroredState = "errored"
+
+// ErroredInstance is an instance that failed to initialize. It is kept so that
+// the failure is visible through the API rather than the instance silently
+// disappearing.
+type ErroredInstance struct {
+	Uuid  string `json:"uuid"`
+	Error string `json:"error"`
+}
+
+// Hook is called with an instance when it is added to or removed from the
+// manager
+type Hook func(i runtime.Instance)
+
+type hookEntry struct {
+	id int
+	fn Hook
+}
+
+// Manager holds every instance on this shard, keyed by uuid. The order that
+// instances were added in is kept, so that listing them is stable.
 type Manager struct {
 	sync.RWMutex
-	// client remote.Client
-	servers []runtime.Instance
+	client  *remote.Client
+	servers map[string]runtime.Instance
+	order   []string
+	errored []ErroredInstance
+
+	hooksMu     sync.RWMutex
+	hookId      int
+	addHooks    []hookEntry
+	removeHooks []hookEntry
+
+	states    *stateStore
+	stateSubs map[string]*events.Subscription
+
+	// creating holds the uuids of instances that are being created and have
+	// not been added yet
+	creating map[string]struct{}
 }
 
-func NewManager(ctx context.Context) (*Manager, error) {
-	m := &Manager{}
+func NewManager(ctx context.Context, client *remote.Client) (*Manager, error) {
+	m := newManager(client)
 	if err := m.init(ctx); err != nil {
 		return nil, err
 	}
 	return m, nil
 }
 
+// newManager returns an empty manager without loading anything from the panel
+func newManager(client *remote.Client) *Manager {
+	return &Manager{
+		client:    client,
+		servers:   make(map[string]runtime.Instance),
+		states:    loadStateStore(filepath.Join(config.Get().System.RootDirectory, stateFile)),
+		stateSubs: make(map[string]*events.Subscription),
+		creating:  make(map[string]struct{}),
+	}
+}
+
 // Len returns the number of stored servers
 func (m *Manager) Len() int {
 	m.RLock()
 	defer m.RUnlock()
-	return len(m.servers)
+	return len(m.order)
 }
 
-// Keys returns all the stored server UUIDs
+// Keys returns all the stored server UUIDs in the order they were added
 func (m *Manager) Keys() []string {
 	m.RLock()
 	defer m.RUnlock()
 
-	keys := make([]string, len(m.servers))
-	for i, s := range m.servers {
-		keys[i] = s.Id()
-	}
+	keys := make([]string, len(m.order))
+	copy(keys, m.order)
 	return keys
 }
 
-// All returns all the items in the collection
+// All returns a copy of every stored server in the order they were added.
+// Changes to the manager after calling All are not reflected in the result.
 func (m *Manager) All() []runtime.Instance {
 	m.RLock()
 	defer m.RUnlock()
-	return m.servers
+
+	out := make([]runtime.Instance, len(m.order))
+	for idx, id := range m.order {
+		out[idx] = m.servers[id]
+	}
+	return out
+}
+
+// Get returns the server with the given uuid
+func (m *Manager) Get(uuid string) (runtime.Instance, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	i, ok := m.servers[uuid]
+	return i, ok
 }
 
-// Add adds an item to the collection
+// Filter returns every server matching the filter, in the order they were
+// added
+func (m *Manager) Filter(filter func(match runtime.Instance) bool) []runtime.Instance {
+	var out []runtime.Instance
+	for _, v := range m.All() {
+		if filter(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// Add adds an item to the collection, persisting its state from then on. An
+// item with the same uuid is replaced, keeping its position.
 func (m *Manager) Add(s runtime.Instance) {
+	id := s.Id()
+
 	m.Lock()
-	defer m.Unlock()
-	m.servers = append(m.servers, s)
+	old, replaced := m.servers[id]
+	if replaced {
+		m.untrackState(old)
+	} else {
+		m.order = append(m.order, id)
+	}
+	m.servers[id] = s
+	m.stateSubs[id] = m.trackState(s)
+	m.removeErrored(id)
+	m.Unlock()
+
+	if replaced {
+		m.runHooks(&m.removeHooks, old)
+	}
+	m.runHooks(&m.addHooks, s)
 }
 
-// TODO Get
+// OnAdd registers a hook that is called after an instance is added. The
+// returned function unregisters the hook.
+func (m *Manager) OnAdd(fn Hook) func() {
+	return m.registerHook(&m.addHooks, fn)
+}
 
-// TODO Filter
+// OnRemove registers a hook that is called after an instance is removed. The
+// returned function unregisters the hook.
+func (m *Manager) OnRemove(fn Hook) func() {
+	return m.registerHook(&m.removeHooks, fn)
+}
 
-// Find returns a single server matching the filter
-func (m *Manager) Find(filter func(match runtime.Instance) bool) runtime.Instance {
+func (m *Manager) registerHook(hooks *[]hookEntry, fn Hook) func() {
+	m.hooksMu.Lock()
+	defer m.hooksMu.Unlock()
+
+	m.hookId++
+	id := m.hookId
+	*hooks = append(*hooks, hookEntry{id: id, fn: fn})
+
+	return func() {
+		m.hooksMu.Lock()
+		defer m.hooksMu.Unlock()
+		for idx, h := range *hooks {
+			if h.id == id {
+				*hooks = append((*hooks)[:idx:idx], (*hooks)[idx+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// runHooks calls every registered hook in the order they were registered.
+// Hooks run without the manager locked, so they are free to use it.
+func (m *Manager) runHooks(hooks *[]hookEntry, i runtime.Instance) {
+	m.hooksMu.RLock()
+	fns := make([]Hook, len(*hooks))
+	for idx, h := range *hooks {
+		fns[idx] = h.fn
+	}
+	m.hooksMu.RUnlock()
+
+	for _, fn := range fns {
+		fn(i)
+	}
+}
+
+// Errored returns the instances that failed to initialize
+func (m *Manager) Errored() []ErroredInstance {
 	m.RLock()
 	defer m.RUnlock()
+	out := make([]ErroredInstance, len(m.errored))
+	copy(out, m.errored)
+	return out
+}
 
-	for _, v := range m.servers {
+// FindErrored returns the instance with the given uuid if it failed to
+// initialize
+func (m *Manager) FindErrored(uuid string) (ErroredInstance, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	for _, e := range m.errored {
+		if e.Uuid == uuid {
+			return e, true
+		}
+	}
+	return ErroredInstance{}, false
+}
+
+// addErrored records an instance that failed to initialize
+func (m *Manager) addErrored(uuid string, err error) {
+	m.Lock()
+	defer m.Unlock()
+	m.removeErrored(uuid)
+	m.errored = append(m.errored, ErroredInstance{Uuid: uuid, Error: err.Error()})
+}
+
+// removeErrored forgets an instance that failed to initialize, such as once it
+// has been initialized successfully. The caller must hold the lock.
+func (m *Manager) removeErrored(uuid string) {
+	for idx, e := range m.errored {
+		if e.Uuid == uuid {
+			m.errored = append(m.errored[:idx:idx], m.errored[idx+1:]...)
+			return
+		}
+	}
+}
+
+// Client returns the panel client used by the manager
+func (m *Manager) Client() *remote.Client {
+	return m.client
+}
+
+// Find returns a single server matching the filter
+func (m *Manager) Find(filter func(match runtime.Instance) bool) runtime.Instance {
+	for _, v := range m.All() {
 		if filter(v) {
 			return v
 		}
@@ -78,28 +261,61 @@ func (m *Manager) Find(filter func(match runtime.Instance) bool) runtime.Instanc
 // Remove removes all items from the collection that match a filter function
 func (m *Manager) Remove(filter func(match runtime.Instance) bool) {
 	m.Lock()
-	defer m.Unlock()
-
-	r := make([]runtime.Instance, 0)
-	for _, v := range m.servers {
+	var removed []runtime.Instance
+	order := make([]string, 0, len(m.order))
+	for _, id := range m.order {
+		v := m.servers[id]
 		if !filter(v) {
-			r = append(r, v)
+			order = append(order, id)
+			continue
+		}
+
+		removed = append(removed, v)
+		delete(m.servers, id)
+		m.untrackState(v)
+		if err := m.states.Delete(id); err != nil {
+			log.With("instance", id).Warn("failed to remove instance state", "err", err)
+		}
+	}
+	m.order = order
+	m.Unlock()
+
+	for _, v := range removed {
+		m.runHooks(&m.removeHooks, v)
+	}
+}
+
+// InitServer creates a runtime instance from the server data returned by the
+// panel
+func (m *Manager) InitServer(data remote.RawServerData) (runtime.Instance, error) {
+	cfg := &runtime.Configuration{RWMutex: &sync.RWMutex{}}
+	if len(data.Settings) > 0 {
+		if err := json.Unmarshal(data.Settings, cfg); err != nil {
+			return nil, errors.Wrap(err, "manager: failed to parse server settings")
 		}
 	}
+	// The panel is the source of truth for which server this is, regardless of
+	// what the settings say
+	cfg.Uuid = data.Uuid
+
+	return newInstance(cfg)
+}
+
+// newInstance validates the configuration and creates a runtime instance from
+// it, without creating anything on disk or in the runtime
+func newInstance(cfg *runtime.Configuration) (runtime.Instance, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Wrap(err, "manager: invalid server settings")
+	}
 
-	m.servers = r
+	return newRuntime(cfg)
 }
 
-func (m *Manager) InitServer(data remote.ServerData) (runtime.Instance, error) {
+// newRuntime creates the runtime instance for a configuration, and is replaced
+// in tests so that no container runtime is needed
+var newRuntime = func(cfg *runtime.Configuration) (runtime.Instance, error) {
 	// Would change this for other runtimes
-	s, err := docker.New(&runtime.Configuration{
-		Name: "Zoom",
-		Uuid: data.Uuid,
-		Stop: "",
-		Container: &runtime.Container{
-			Image: "busybox",
-		},
-	})
+	s, err := docker.New(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -107,32 +323,129 @@ func (m *Manager) InitServer(data remote.ServerData) (runtime.Instance, error) {
 	return s, nil
 }
 
+// Install runs the install script of an instance, stopping it first if this
+// is a reinstall, and reports the result to the panel
+func (m *Manager) Install(ctx context.Context, i runtime.Instance, reinstall bool) error {
+	var err error
+	if reinstall {
+		err = i.Reinstall(ctx)
+	} else {
+		err = i.Install(ctx)
+	}
+
+	// Another installation is already running and will report its own result
+	if errors.Is(err, runtime.ErrInstanceInstalling) {
+		return err
+	}
+
+	status := remote.InstallStatusRequest{Successful: err == nil, Reinstall: reinstall}
+	if rerr := m.client.SetInstallationStatus(context.Background(), i.Id(), status); rerr != nil {
+		log.With("instance", i.Id()).Warn("failed to report installation status to panel", "err", rerr)
+	}
+	return err
+}
+
+// Shutdown releases every instance before the shard exits. If stop is set
+// every instance is stopped in parallel, and terminated if it does not stop
+// within the timeout, otherwise containers are left running. The persisted
+// states are those from before the shutdown, so that the same instances are
+// running again when the shard starts.
+func (m *Manager) Shutdown(stop bool, timeout time.Duration) error {
+	all := m.All()
+
+	// Stop persisting state changes first, since everything is about to go
+	// offline as far as this process is concerned
+	m.Lock()
+	for _, i := range all {
+		m.untrackState(i)
+	}
+	m.Unlock()
+
+	if stop {
+		var wg sync.WaitGroup
+		for _, i := range all {
+			if i.State() == runtime.ProcessOfflineState {
+				continue
+			}
+			wg.Add(1)
+			go func(i runtime.Instance) {
+				defer wg.Done()
+				if err := i.WaitForStop(context.Background(), timeout, true, false, 0); err != nil {
+					log.With("instance", i.Id()).Error("failed to stop instance", "err", err)
+				}
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	// Destroy the bus before canceling so the attach streams closing are not
+	// treated as crashes
+	for _, i := range all {
+		i.Events().Destroy()
+		i.ContextCancel()
+	}
+
+	return m.states.Flush()
+}
+
+// init loads every instance assigned to this shard from the panel. Instances
+// are initialized by a bounded pool of workers, and an instance that fails is
+// recorded as errored rather than stopping the others from loading.
 func (m *Manager) init(ctx context.Context) error {
 	log.Debug("Initializing Manager...")
-	servers := make([]remote.ServerData, 1)
-	servers[0] = remote.ServerData{
-		Uuid: "493a41d5-2769-40ff-8003-6a8a717bfccb",
+	servers, err := m.client.GetServers(ctx, 50)
+	if err != nil {
+		return errors.Wrap(err, "manager: failed to load servers from panel")
 	}
 
 	start := time.Now()
-	log.Debugf("Total game servers: %o", len(servers))
+	workers := min(config.Get().System.BootWorkers, len(servers))
+	log.Info("initializing instances", "total", len(servers), "workers", workers)
 
-	// TODO Parallelize server initialization
-	for _, data := range servers {
-		data := data
+	// Results are stored by position so that instances are added in the
+	// order the panel returned them, regardless of which finished first
+	instances := make([]runtime.Instance, len(servers))
+	errs := make([]error, len(servers))
 
-		s, err := m.InitServer(data)
-		if err != nil {
-			log.Fatal("Failed to load server...")
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				began := time.Now()
+				instances[idx], errs[idx] = m.InitServer(servers[idx])
+
+				l := log.With("instance", servers[idx].Uuid).With("duration", time.Since(began))
+				if errs[idx] != nil {
+					l.Error("failed to initialize instance", "err", errs[idx])
+					continue
+				}
+				l.Debug("instance initialized")
+			}
+		}()
+	}
+	for idx := range servers {
+		jobs <- idx
+	}
+	close(jobs)
+	wg.Wait()
 
-			// TODO Fix w/ above comment.. should skip server if it fails to init
+	for idx, data := range servers {
+		if errs[idx] != nil {
+			m.addErrored(data.Uuid, errs[idx])
 			continue
 		}
-		m.Add(s)
+		m.Add(instances[idx])
 	}
 
-	diff := time.Since(start)
-	log.Debugf("Duration of startup: %s", diff)
+	log.Info(
+		"instances initialized",
+		"loaded", m.Len(),
+		"errored", len(m.Errored()),
+		"duration", time.Since(start),
+	)
 
 	return nil
 }
@@ -0,0 +1,398 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"prismarine/shard/config"
+	"prismarine/shard/remote"
+	"prismarine/shard/runtime"
+	"prismarine/shard/runtime/events"
+	"prismarine/shard/runtime/filesystem"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testInstance implements just enough of an instance for the manager, any
+// other method panics
+type testInstance struct {
+	runtime.Instance
+	id  string
+	bus *events.Bus
+	cfg *runtime.Configuration
+	fs  *filesystem.Filesystem
+
+	mu           sync.Mutex
+	state        string
+	running      bool
+	transferring bool
+	destroyed    bool
+	starts       int
+	stops        int
+	attached     bool
+
+	// Returned by Create, which calls onCreate first if it is set
+	createErr error
+	onCreate  func()
+}
+
+func (i *testInstance) Id() string                         { return i.id }
+func (i *testInstance) Events() *events.Bus                { return i.bus }
+func (i *testInstance) Config() *runtime.Configuration     { return i.cfg }
+func (i *testInstance) Filesystem() *filesystem.Filesystem { return i.fs }
+func (i *testInstance) IsTransferring() bool               { return i.transferring }
+func (i *testInstance) IsRestoring() bool                  { return false }
+func (i *testInstance) CancelInstall()                     {}
+func (i *testInstance) ContextCancel()                     {}
+func (i *testInstance) Exists() (bool, error)              { return true, nil }
+
+func (i *testInstance) Create() error {
+	if i.onCreate != nil {
+		i.onCreate()
+	}
+	return i.createErr
+}
+
+func (i *testInstance) Destroy() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.destroyed = true
+	return nil
+}
+
+func (i *testInstance) State() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.state
+}
+
+func (i *testInstance) SetState(state string) {
+	i.mu.Lock()
+	i.state = state
+	i.mu.Unlock()
+	i.bus.Publish(runtime.StateChangeEvent, state)
+}
+
+func (i *testInstance) IsRunning(context.Context) (bool, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.running, nil
+}
+
+func (i *testInstance) Attach(context.Context) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.attached = true
+	return nil
+}
+
+func (i *testInstance) Start(context.Context, bool, int) error {
+	i.mu.Lock()
+	i.starts++
+	i.running = true
+	i.mu.Unlock()
+	i.SetState(runtime.ProcessRunningState)
+	return nil
+}
+
+func (i *testInstance) WaitForStop(context.Context, time.Duration, bool, bool, int) error {
+	i.mu.Lock()
+	i.stops++
+	i.running = false
+	i.mu.Unlock()
+	i.SetState(runtime.ProcessOfflineState)
+	return nil
+}
+
+func newTestInstance(id string) *testInstance {
+	return &testInstance{
+		id:    id,
+		bus:   events.NewBus(),
+		cfg:   &runtime.Configuration{RWMutex: &sync.RWMutex{}, Uuid: id},
+		state: runtime.ProcessOfflineState,
+	}
+}
+
+// setup returns an empty manager storing its states, instance files and
+// backups in a temporary directory
+func setup(t *testing.T) *Manager {
+	t.Helper()
+
+	root := t.TempDir()
+	cfg := config.Default()
+	cfg.System.RootDirectory = root
+	cfg.System.DataDirectory = filepath.Join(root, "volumes")
+	cfg.System.BackupDirectory = filepath.Join(root, "backups")
+	config.Set(cfg)
+	t.Cleanup(func() { config.Set(nil) })
+
+	// Stop persisting states before the temporary directory is removed
+	m := newManager(nil)
+	t.Cleanup(func() { _ = m.Shutdown(false, 0) })
+	return m
+}
+
+// useTestRuntime makes the manager create test instances rather than
+// containers. Every instance is passed to fn before it is returned, if set.
+func useTestRuntime(t *testing.T, fn func(i *testInstance)) {
+	t.Helper()
+
+	previous := newRuntime
+	newRuntime = func(cfg *runtime.Configuration) (runtime.Instance, error) {
+		i := newTestInstance(cfg.Uuid)
+		i.cfg = cfg
+		i.fs = filesystem.New(filepath.Join(config.Get().System.DataDirectory, cfg.Uuid))
+		if fn != nil {
+			fn(i)
+		}
+		return i, nil
+	}
+	t.Cleanup(func() { newRuntime = previous })
+}
+
+func ids(instances []runtime.Instance) []string {
+	out := make([]string, len(instances))
+	for idx, i := range instances {
+		out[idx] = i.Id()
+	}
+	return out
+}
+
+func TestManager_Order(t *testing.T) {
+	m := setup(t)
+	for _, id := range []string{"c", "a", "b"} {
+		m.Add(newTestInstance(id))
+	}
+
+	if got := m.Keys(); !slices.Equal(got, []string{"c", "a", "b"}) {
+		t.Fatalf("keys are %v", got)
+	}
+	if got := ids(m.All()); !slices.Equal(got, []string{"c", "a", "b"}) {
+		t.Fatalf("all is %v", got)
+	}
+
+	m.Remove(func(match runtime.Instance) bool { return match.Id() == "a" })
+	m.Add(newTestInstance("a"))
+	if got := m.Keys(); !slices.Equal(got, []string{"c", "b", "a"}) {
+		t.Fatalf("keys after removing and adding are %v", got)
+	}
+	if m.Len() != 3 {
+		t.Fatalf("length is %d", m.Len())
+	}
+}
+
+func TestManager_AddReplaces(t *testing.T) {
+	m := setup(t)
+	m.Add(newTestInstance("a"))
+	m.Add(newTestInstance("b"))
+
+	replacement := newTestInstance("a")
+	m.Add(replacement)
+
+	if got := m.Keys(); !slices.Equal(got, []string{"a", "b"}) {
+		t.Fatalf("keys are %v", got)
+	}
+	if i, _ := m.Get("a"); i != replacement {
+		t.Fatal("the instance was not replaced")
+	}
+}
+
+func TestManager_GetAndFilter(t *testing.T) {
+	m := setup(t)
+	for _, id := range []string{"a1", "b1", "a2"} {
+		m.Add(newTestInstance(id))
+	}
+
+	if i, ok := m.Get("b1"); !ok || i.Id() != "b1" {
+		t.Fatal("failed to get an added instance")
+	}
+	if _, ok := m.Get("missing"); ok {
+		t.Fatal("got an instance that was never added")
+	}
+
+	got := m.Filter(func(match runtime.Instance) bool { return match.Id()[0] == 'a' })
+	if !slices.Equal(ids(got), []string{"a1", "a2"}) {
+		t.Fatalf("filter returned %v", ids(got))
+	}
+	if got := m.Filter(func(runtime.Instance) bool { return false }); len(got) != 0 {
+		t.Fatalf("filter returned %v", ids(got))
+	}
+}
+
+func TestManager_AllIsCopy(t *testing.T) {
+	m := setup(t)
+	m.Add(newTestInstance("a"))
+	m.Add(newTestInstance("b"))
+
+	all := m.All()
+	all[0] = newTestInstance("changed")
+	m.Remove(func(match runtime.Instance) bool { return match.Id() == "b" })
+
+	if got := ids(all); !slices.Equal(got, []string{"changed", "b"}) {
+		t.Fatalf("copy changed to %v", got)
+	}
+	if got := m.Keys(); !slices.Equal(got, []string{"a"}) {
+		t.Fatalf("manager changed to %v", got)
+	}
+}
+
+func TestManager_Hooks(t *testing.T) {
+	m := setup(t)
+
+	var added, removed []string
+	unregister := m.OnAdd(func(i runtime.Instance) {
+		// Hooks run without the manager locked
+		if _, ok := m.Get(i.Id()); !ok {
+			t.Errorf("%s was not stored before the hook ran", i.Id())
+		}
+		added = append(added, i.Id())
+	})
+	m.OnRemove(func(i runtime.Instance) {
+		if _, ok := m.Get(i.Id()); ok {
+			t.Errorf("%s was still stored when the hook ran", i.Id())
+		}
+		removed = append(removed, i.Id())
+	})
+
+	m.Add(newTestInstance("a"))
+	m.Add(newTestInstance("b"))
+	m.Remove(func(match runtime.Instance) bool { return true })
+
+	if !slices.Equal(added, []string{"a", "b"}) {
+		t.Fatalf("added hook saw %v", added)
+	}
+	if !slices.Equal(removed, []string{"a", "b"}) {
+		t.Fatalf("removed hook saw %v", removed)
+	}
+
+	unregister()
+	m.Add(newTestInstance("c"))
+	if len(added) != 2 {
+		t.Fatalf("unregistered hook saw %v", added)
+	}
+}
+
+func TestManager_Concurrent(t *testing.T) {
+	m := setup(t)
+
+	var added, removed atomic.Int64
+	m.OnAdd(func(runtime.Instance) { added.Add(1) })
+	m.OnRemove(func(runtime.Instance) { removed.Add(1) })
+
+	const workers = 8
+	const perWorker = 50
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for n := 0; n < perWorker; n++ {
+				id := fmt.Sprintf("%d-%d", w, n)
+				m.Add(newTestInstance(id))
+				if _, ok := m.Get(id); !ok {
+					t.Errorf("%s was not stored", id)
+				}
+				// Readers iterate over their own copy while others write
+				for _, i := range m.All() {
+					_ = i.Id()
+				}
+				_ = m.Filter(func(match runtime.Instance) bool { return match.Id() == id })
+				if n%2 == 0 {
+					m.Remove(func(match runtime.Instance) bool { return match.Id() == id })
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	want := workers * perWorker / 2
+	if m.Len() != want || len(m.Keys()) != want || len(m.All()) != want {
+		t.Fatalf("expected %d instances, got %d", want, m.Len())
+	}
+	if added.Load() != workers*perWorker {
+		t.Fatalf("added hook ran %d times", added.Load())
+	}
+	if removed.Load() != int64(want) {
+		t.Fatalf("removed hook ran %d times", removed.Load())
+	}
+}
+
+// newPanel returns a client for a panel serving the given servers, a page of
+// two at a time
+func newPanel(t *testing.T, servers []remote.RawServerData) *remote.Client {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/servers") {
+			http.NotFound(w, r)
+			return
+		}
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		last := (len(servers) + 1) / 2
+		data := servers[min((page-1)*2, len(servers)):min(page*2, len(servers))]
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"data": data,
+			"meta": remote.Pagination{CurrentPage: page, LastPage: last, PerPage: 2, Total: len(servers)},
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return remote.New(srv.URL, remote.WithRetries(1, 0))
+}
+
+func TestManager_Init(t *testing.T) {
+	m := setup(t)
+	config.Get().System.BootWorkers = 4
+
+	valid := json.RawMessage(`{"container": {"image": "alpine"}}`)
+	uuids := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	var servers []remote.RawServerData
+	for _, uuid := range uuids {
+		settings := valid
+		switch uuid {
+		case "c":
+			settings = json.RawMessage(`{"container": {}}`)
+		case "f":
+			settings = json.RawMessage(`{"container": "alpine"}`)
+		}
+		servers = append(servers, remote.RawServerData{Uuid: uuid, Settings: settings})
+	}
+
+	// Later instances finish initializing first, so the order only holds if
+	// the results are kept in panel order
+	useTestRuntime(t, func(i *testInstance) {
+		time.Sleep(time.Duration(len(uuids)-slices.Index(uuids, i.Id())) * 5 * time.Millisecond)
+	})
+
+	m.client = newPanel(t, servers)
+	if err := m.init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := m.Keys(); !slices.Equal(got, []string{"a", "b", "d", "e", "g", "h"}) {
+		t.Fatalf("expected the instances in panel order, got %v", got)
+	}
+	errored := m.Errored()
+	if len(errored) != 2 || errored[0].Uuid != "c" || errored[1].Uuid != "f" || errored[0].Error == "" {
+		t.Fatalf("expected the invalid instances to be errored, got %+v", errored)
+	}
+}
+
+func TestManager_InitPanelFailure(t *testing.T) {
+	m := setup(t)
+	srv := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(srv.Close)
+
+	m.client = remote.New(srv.URL, remote.WithRetries(1, 0))
+	if err := m.init(context.Background()); err == nil {
+		t.Fatal("expected a panel failure to fail initialization")
+	}
+}
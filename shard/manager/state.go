@@ -0,0 +1,197 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"prismarine/shard/runtime"
+	"prismarine/shard/runtime/events"
+	"sync"
+
+	"github.com/charmbracelet/log"
+	"github.com/pkg/errors"
+)
+
+// stateFile is where the last known states of instances are stored, within
+// the root directory of the shard
+const stateFile = "states.json"
+
+// stateStore persists the last known state of every instance so that they
+// can be restored after the shard restarts
+type stateStore struct {
+	mu     sync.Mutex
+	path   string
+	states map[string]string
+}
+
+// loadStateStore reads the states written by a previous run of the shard. A
+// missing or unreadable file starts with no states rather than failing.
+func loadStateStore(path string) *stateStore {
+	s := &stateStore{path: path, states: make(map[string]string)}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.With("path", path).Warn("failed to read instance states", "err", err)
+		}
+		return s
+	}
+	if err := json.Unmarshal(b, &s.states); err != nil {
+		log.With("path", path).Warn("failed to parse instance states, ignoring them", "err", err)
+		s.states = make(map[string]string)
+	}
+	return s
+}
+
+// Get returns the last known state of an instance, or offline if there is
+// none
+func (s *stateStore) Get(uuid string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state, ok := s.states[uuid]; ok {
+		return state
+	}
+	return runtime.ProcessOfflineState
+}
+
+// Set records the state of an instance and writes every state to disk
+func (s *stateStore) Set(uuid, state string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.states[uuid] == state {
+		return nil
+	}
+	s.states[uuid] = state
+	return s.flush()
+}
+
+// Delete forgets the state of an instance
+func (s *stateStore) Delete(uuid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.states[uuid]; !ok {
+		return nil
+	}
+	delete(s.states, uuid)
+	return s.flush()
+}
+
+// Flush writes every state to disk
+func (s *stateStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flush()
+}
+
+// flush writes the states to a temporary file first so that a crash while
+// writing never leaves a corrupt file behind. The caller must hold the lock.
+func (s *stateStore) flush() error {
+	b, err := json.Marshal(s.states)
+	if err != nil {
+		return errors.Wrap(err, "manager: failed to marshal instance states")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return errors.Wrap(err, "manager: failed to create state directory")
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return errors.Wrap(err, "manager: failed to write instance states")
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return errors.Wrap(err, "manager: failed to write instance states")
+	}
+	return nil
+}
+
+// trackState persists every state change of the instance until it is removed
+// from the manager. The caller must hold the lock.
+func (m *Manager) trackState(i runtime.Instance) *events.Subscription {
+	id := i.Id()
+	var sub *events.Subscription
+	sub = i.Events().SubscribeLossless(runtime.StateChangeEvent, func(e events.Event) {
+		state, ok := e.Data.(string)
+		if !ok {
+			return
+		}
+
+		// Events queued before the instance was untracked are still
+		// delivered, so check under the lock that this subscription is the
+		// current one, otherwise the state of a removed instance would be
+		// written again
+		m.RLock()
+		defer m.RUnlock()
+		if m.stateSubs[id] != sub {
+			return
+		}
+		if err := m.states.Set(id, state); err != nil {
+			log.With("instance", id).Warn("failed to persist instance state", "err", err)
+		}
+	})
+	return sub
+}
+
+// untrackState stops persisting the state changes of the instance. The caller
+// must hold the lock.
+func (m *Manager) untrackState(i runtime.Instance) {
+	if sub, ok := m.stateSubs[i.Id()]; ok {
+		i.Events().Unsubscribe(sub)
+		delete(m.stateSubs, i.Id())
+	}
+}
+
+// RestoreStates brings every instance back to the state it was in before the
+// shard restarted. Containers that are still running are attached to again,
+// and instances that were running but whose container has stopped are
+// started. Suspended instances are always left stopped.
+func (m *Manager) RestoreStates(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, i := range m.All() {
+		wg.Add(1)
+		go func(i runtime.Instance) {
+			defer wg.Done()
+			if err := m.restoreState(ctx, i); err != nil {
+				log.With("instance", i.Id()).Error("failed to restore instance state", "err", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func (m *Manager) restoreState(ctx context.Context, i runtime.Instance) error {
+	l := log.With("instance", i.Id())
+	previous := m.states.Get(i.Id())
+
+	running, err := i.IsRunning(ctx)
+	if err != nil {
+		if exists, eerr := i.Exists(); eerr != nil || exists {
+			return err
+		}
+		// The container is created again when the instance is started
+		running = false
+	}
+
+	if i.Config().Snapshot().Suspended {
+		if running {
+			l.Info("stopping suspended instance")
+			return i.WaitForStop(ctx, stopTimeout, true, false, 0)
+		}
+		return nil
+	}
+
+	if running {
+		l.Info("attaching to running instance")
+		if err := i.Attach(ctx); err != nil {
+			return err
+		}
+		i.SetState(runtime.ProcessRunningState)
+		return nil
+	}
+
+	if previous == runtime.ProcessRunningState || previous == runtime.ProcessStartingState {
+		l.Info("starting instance that was running before the shard restarted")
+		return i.Start(ctx, false, 0)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"prismarine/shard/runtime"
+	"testing"
+	"time"
+)
+
+func TestStateStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", stateFile)
+	s := loadStateStore(path)
+	if state := s.Get("a"); state != runtime.ProcessOfflineState {
+		t.Fatalf("expected offline without a state, got %s", state)
+	}
+
+	if err := s.Set("a", runtime.ProcessRunningState); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("b", runtime.ProcessStartingState); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written map[string]string
+	if err := json.Unmarshal(b, &written); err != nil {
+		t.Fatalf("expected valid json, got %s", b)
+	}
+	if len(written) != 1 || written["a"] != runtime.ProcessRunningState {
+		t.Fatalf("expected only the state of a, got %v", written)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("expected the temporary file to be renamed")
+	}
+
+	reloaded := loadStateStore(path)
+	if reloaded.Get("a") != runtime.ProcessRunningState || reloaded.Get("b") != runtime.ProcessOfflineState {
+		t.Fatalf("expected the states to be loaded, got %v", reloaded.states)
+	}
+}
+
+func TestStateStore_Corrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), stateFile)
+	if err := os.WriteFile(path, []byte(`{"a": "running"`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := loadStateStore(path)
+	if state := s.Get("a"); state != runtime.ProcessOfflineState {
+		t.Fatalf("expected a corrupt file to be ignored, got %s", state)
+	}
+
+	// The next write replaces the corrupt file
+	if err := s.Set("b", runtime.ProcessRunningState); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded := loadStateStore(path); reloaded.Get("b") != runtime.ProcessRunningState {
+		t.Fatal("expected the file to be replaced")
+	}
+}
+
+func TestManager_TracksState(t *testing.T) {
+	m := setup(t)
+	i := newTestInstance("a")
+	m.Add(i)
+
+	i.SetState(runtime.ProcessStartingState)
+	i.SetState(runtime.ProcessRunningState)
+
+	deadline := time.Now().Add(time.Second)
+	for m.states.Get("a") != runtime.ProcessRunningState {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the state to be persisted, got %s", m.states.Get("a"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	reloaded := loadStateStore(m.states.path)
+	if state := reloaded.Get("a"); state != runtime.ProcessRunningState {
+		t.Fatalf("expected the state to be written to disk, got %s", state)
+	}
+}
+
+func TestManager_RemoveForgetsState(t *testing.T) {
+	m := setup(t)
+	i := newTestInstance("a")
+	m.Add(i)
+
+	// Changes queued before the removal must not write the state again
+	for n := 0; n < 50; n++ {
+		i.SetState(runtime.ProcessRunningState)
+		i.SetState(runtime.ProcessOfflineState)
+	}
+	m.Remove(func(match runtime.Instance) bool { return match.Id() == "a" })
+	i.bus.Destroy()
+	time.Sleep(50 * time.Millisecond)
+
+	m.states.mu.Lock()
+	_, ok := m.states.states["a"]
+	m.states.mu.Unlock()
+	if ok {
+		t.Fatal("expected the state of a removed instance to stay forgotten")
+	}
+}
+
+func TestManager_RestoreStates(t *testing.T) {
+	tests := []struct {
+		name      string
+		previous  string
+		running   bool
+		suspended bool
+
+		starts   int
+		stops    int
+		attached bool
+	}{
+		{name: "was running", previous: runtime.ProcessRunningState, starts: 1},
+		{name: "was starting", previous: runtime.ProcessStartingState, starts: 1},
+		{name: "was offline", previous: runtime.ProcessOfflineState},
+		{name: "was stopping", previous: runtime.ProcessStoppingState},
+		{name: "no state"},
+		{name: "still running", previous: runtime.ProcessRunningState, running: true, attached: true},
+		{name: "suspended", previous: runtime.ProcessRunningState, suspended: true},
+		{name: "suspended running", previous: runtime.ProcessRunningState, running: true, suspended: true, stops: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := setup(t)
+			if tt.previous != "" {
+				if err := m.states.Set("a", tt.previous); err != nil {
+					t.Fatal(err)
+				}
+			}
+			i := newTestInstance("a")
+			i.running = tt.running
+			i.cfg.Suspended = tt.suspended
+			m.Add(i)
+
+			m.RestoreStates(context.Background())
+
+			if i.starts != tt.starts || i.stops != tt.stops || i.attached != tt.attached {
+				t.Fatalf("expected %d starts, %d stops and attached %t, got %d, %d and %t",
+					tt.starts, tt.stops, tt.attached, i.starts, i.stops, i.attached)
+			}
+			if tt.attached && i.State() != runtime.ProcessRunningState {
+				t.Fatalf("expected an attached instance to be running, got %s", i.State())
+			}
+		})
+	}
+}
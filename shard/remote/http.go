@@ -1,7 +1,236 @@
 package remote
 
-import "net/http"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/charmbracelet/log"
+	"github.com/pkg/errors"
+)
+
+// Client communicates with the Monument panel API
 type Client struct {
-	httpClient *http.Client
+	httpClient  *http.Client
+	baseUrl     string
+	token       string
+	maxAttempts int
+	backoff     time.Duration
+}
+
+type ClientOption func(c *Client)
+
+// New returns a new panel client for the panel at the given base url
+func New(base string, opts ...ClientOption) *Client {
+	c := &Client{
+		httpClient:  &http.Client{Timeout: time.Second * 15},
+		baseUrl:     strings.TrimSuffix(base, "/") + "/api/remote",
+		maxAttempts: 3,
+		backoff:     time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// WithCredentials sets the token used to authenticate with the panel
+func WithCredentials(token string) ClientOption {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithHttpClient sets the underlying http client used for requests
+func WithHttpClient(httpClient *http.Client) ClientOption {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithRetries sets how many times a request is attempted before giving up,
+// and the initial delay between attempts which doubles after every failure
+func WithRetries(attempts int, backoff time.Duration) ClientOption {
+	return func(c *Client) {
+		if attempts < 1 {
+			attempts = 1
+		}
+		c.maxAttempts = attempts
+		c.backoff = backoff
+	}
+}
+
+// GetServers returns every server assigned to this shard, requesting perPage
+// servers at a time until all pages have been loaded
+func (c *Client) GetServers(ctx context.Context, perPage int) ([]RawServerData, error) {
+	var servers []RawServerData
+	for page := 1; ; page++ {
+		var res struct {
+			Data []RawServerData `json:"data"`
+			Meta Pagination      `json:"meta"`
+		}
+
+		q := url.Values{}
+		q.Set("page", strconv.Itoa(page))
+		q.Set("per_page", strconv.Itoa(perPage))
+		if err := c.request(ctx, http.MethodGet, "/servers?"+q.Encode(), nil, &res); err != nil {
+			return nil, err
+		}
+
+		servers = append(servers, res.Data...)
+		if res.Meta.CurrentPage >= res.Meta.LastPage || len(res.Data) == 0 {
+			return servers, nil
+		}
+	}
+}
+
+// GetServerConfiguration returns the configuration for a single server
+func (c *Client) GetServerConfiguration(ctx context.Context, uuid string) (RawServerData, error) {
+	var res RawServerData
+	err := c.request(ctx, http.MethodGet, "/servers/"+url.PathEscape(uuid), nil, &res)
+	return res, err
+}
+
+// SetInstallationStatus reports the result of a server installation
+func (c *Client) SetInstallationStatus(ctx context.Context, uuid string, data InstallStatusRequest) error {
+	return c.request(ctx, http.MethodPost, "/servers/"+url.PathEscape(uuid)+"/install", data, nil)
+}
+
+// SetUninstallationStatus reports the result of removing a server
+func (c *Client) SetUninstallationStatus(ctx context.Context, uuid string, data UninstallStatusRequest) error {
+	return c.request(ctx, http.MethodPost, "/servers/"+url.PathEscape(uuid)+"/uninstall", data, nil)
+}
+
+// SetTransferStatus reports the result of transferring a server away from this
+// shard
+func (c *Client) SetTransferStatus(ctx context.Context, uuid string, data TransferStatusRequest) error {
+	return c.request(ctx, http.MethodPost, "/servers/"+url.PathEscape(uuid)+"/transfer", data, nil)
+}
+
+// ValidateSftpCredentials checks the credentials of an SFTP login, returning
+// the server and permissions the user has access to. Invalid credentials
+// return a RequestError with a 4xx status.
+func (c *Client) ValidateSftpCredentials(ctx context.Context, data SftpAuthRequest) (SftpAuthResponse, error) {
+	var res SftpAuthResponse
+	err := c.request(ctx, http.MethodPost, "/sftp/auth", data, &res)
+	return res, err
+}
+
+// GetBackupUploadUrls returns presigned urls for uploading a backup of the
+// given size to S3. Requesting the urls again for the same backup returns the
+// same upload id as long as the upload has not been completed or aborted.
+func (c *Client) GetBackupUploadUrls(ctx context.Context, backup string, size int64) (BackupUploadUrls, error) {
+	var res BackupUploadUrls
+	q := url.Values{}
+	q.Set("size", strconv.FormatInt(size, 10))
+	err := c.request(ctx, http.MethodGet, "/backups/"+url.PathEscape(backup)+"?"+q.Encode(), nil, &res)
+	return res, err
+}
+
+// SetBackupStatus reports the result of a backup
+func (c *Client) SetBackupStatus(ctx context.Context, backup string, data BackupStatusRequest) error {
+	return c.request(ctx, http.MethodPost, "/backups/"+url.PathEscape(backup), data, nil)
+}
+
+// GetBackupDownloadUrl returns a presigned url for downloading a backup
+func (c *Client) GetBackupDownloadUrl(ctx context.Context, backup string) (string, error) {
+	var res struct {
+		Url string `json:"url"`
+	}
+	err := c.request(ctx, http.MethodGet, "/backups/"+url.PathEscape(backup)+"/download", nil, &res)
+	return res.Url, err
+}
+
+// request performs a request against the panel, retrying on network errors
+// and server errors. The response body is decoded into out if it is not nil.
+func (c *Client) request(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return errors.Wrap(err, "remote: failed to marshal request body")
+		}
+		payload = b
+	}
+
+	backoff := c.backoff
+	var err error
+	for attempt := 1; attempt <= c.maxAttempts; attempt++ {
+		var retry bool
+		retry, err = c.do(ctx, method, path, payload, out)
+		if err == nil || !retry || attempt == c.maxAttempts {
+			break
+		}
+
+		log.
+			With("method", method).
+			With("path", path).
+			With("attempt", attempt).
+			Warn("request to panel failed, retrying", "err", err)
+
+		select {
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	return err
+}
+
+// do performs a single request and reports whether it is worth retrying
+func (c *Client) do(ctx context.Context, method, path string, payload []byte, out interface{}) (bool, error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseUrl+path, body)
+	if err != nil {
+		return false, errors.Wrap(err, "remote: failed to create request")
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, errors.Wrap(err, "remote: failed to perform request")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		return res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests, parseRequestError(res)
+	}
+
+	if out == nil || res.StatusCode == http.StatusNoContent {
+		return false, nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return false, errors.Wrap(err, "remote: failed to decode response body")
+	}
+	return false, nil
+}
+
+// parseRequestError reads the error returned by the panel. If the body is not
+// in the expected format only the status code is reported.
+func parseRequestError(res *http.Response) error {
+	var body struct {
+		Errors []RequestError `json:"errors"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err == nil && len(body.Errors) > 0 {
+		re := body.Errors[0]
+		re.Status = res.StatusCode
+		return &re
+	}
+	return &RequestError{Status: res.StatusCode}
 }
@@ -0,0 +1,128 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return New(srv.URL, WithCredentials("secret"), WithRetries(3, time.Millisecond))
+}
+
+func TestClient_GetServers(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/remote/servers" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("unexpected authorization header %q", got)
+		}
+
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": []RawServerData{{Uuid: "server-" + strconv.Itoa(page)}},
+			"meta": Pagination{CurrentPage: page, LastPage: 3},
+		})
+	})
+
+	servers, err := c.GetServers(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 3 {
+		t.Fatalf("expected 3 servers, got %d", len(servers))
+	}
+	for i, s := range servers {
+		if want := "server-" + strconv.Itoa(i+1); s.Uuid != want {
+			t.Fatalf("expected server %q, got %q", want, s.Uuid)
+		}
+	}
+}
+
+func TestClient_GetServerConfiguration(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/remote/servers/abc" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		_, _ = w.Write([]byte(`{"uuid":"abc","settings":{"name":"Test"}}`))
+	})
+
+	s, err := c.GetServerConfiguration(context.Background(), "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Uuid != "abc" || string(s.Settings) != `{"name":"Test"}` {
+		t.Fatalf("unexpected server data %+v", s)
+	}
+}
+
+func TestClient_SetInstallationStatus(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/remote/servers/abc/install" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		var data InstallStatusRequest
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			t.Error(err)
+		}
+		if !data.Successful || data.Reinstall {
+			t.Errorf("unexpected body %+v", data)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	if err := c.SetInstallationStatus(context.Background(), "abc", InstallStatusRequest{Successful: true}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClient_RetriesServerErrors(t *testing.T) {
+	var calls int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	if err := c.SetUninstallationStatus(context.Background(), "abc", UninstallStatusRequest{Successful: true}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 attempts, got %d", calls)
+	}
+}
+
+func TestClient_DoesNotRetryClientErrors(t *testing.T) {
+	var calls int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"errors":[{"code":"NotFound","detail":"server not found"}]}`))
+	})
+
+	_, err := c.GetServerConfiguration(context.Background(), "abc")
+
+	var re *RequestError
+	if !errors.As(err, &re) {
+		t.Fatalf("expected a RequestError, got %v", err)
+	}
+	if re.Status != http.StatusNotFound || re.Code != "NotFound" {
+		t.Fatalf("unexpected error %+v", re)
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 attempt, got %d", calls)
+	}
+}
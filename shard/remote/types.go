@@ -1,9 +1,106 @@
 package remote
 
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// RawServerData is the data for a single server as returned by the panel. The
+// settings are left raw so that they can be parsed by the runtime into its
+// own configuration.
 type RawServerData struct {
-	Uuid string `json:"uuid"`
+	Uuid     string          `json:"uuid"`
+	Settings json.RawMessage `json:"settings"`
+}
+
+// Pagination is the metadata returned by the panel for paginated endpoints
+type Pagination struct {
+	CurrentPage int `json:"current_page"`
+	LastPage    int `json:"last_page"`
+	PerPage     int `json:"per_page"`
+	Total       int `json:"total"`
+}
+
+// InstallStatusRequest reports the result of an installation to the panel
+type InstallStatusRequest struct {
+	Successful bool `json:"successful"`
+	Reinstall  bool `json:"reinstall"`
+}
+
+// UninstallStatusRequest reports the result of removing a server from this
+// shard to the panel
+type UninstallStatusRequest struct {
+	Successful bool `json:"successful"`
+}
+
+// TransferStatusRequest reports the result of transferring a server to another
+// shard to the panel
+type TransferStatusRequest struct {
+	Successful bool `json:"successful"`
+}
+
+const (
+	SftpAuthPassword  = "password"
+	SftpAuthPublicKey = "public_key"
+)
+
+// SftpAuthRequest asks the panel to validate the credentials of an SFTP login.
+// For public key logins the password is the key in authorized_keys format.
+type SftpAuthRequest struct {
+	Type          string `json:"type"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	Ip            string `json:"ip"`
+	ClientVersion string `json:"client_version"`
+}
+
+// SftpAuthResponse is returned by the panel for valid SFTP credentials
+type SftpAuthResponse struct {
+	Server      string   `json:"server"`
+	User        string   `json:"user"`
+	Permissions []string `json:"permissions"`
+}
+
+// BackupUploadUrls are the presigned urls for uploading a backup to S3 in
+// parts. Every part except the last is exactly PartSize bytes.
+type BackupUploadUrls struct {
+	UploadId string   `json:"upload_id"`
+	PartSize int64    `json:"part_size"`
+	Parts    []string `json:"parts"`
+}
+
+// BackupPart is a part of a multipart upload that completed successfully
+type BackupPart struct {
+	ETag       string `json:"etag"`
+	PartNumber int    `json:"part_number"`
+}
+
+// BackupStatusRequest reports the result of a backup to the panel. For S3
+// backups the parts are used by the panel to complete the multipart upload.
+type BackupStatusRequest struct {
+	Successful   bool         `json:"successful"`
+	Checksum     string       `json:"checksum"`
+	ChecksumType string       `json:"checksum_type"`
+	Size         int64        `json:"size"`
+	Parts        []BackupPart `json:"parts"`
+}
+
+// RequestError is returned when the panel responds with an error status
+type RequestError struct {
+	Status int    `json:"status"`
+	Code   string `json:"code"`
+	Detail string `json:"detail"`
 }
 
-type ServerData struct {
-	Uuid string
+func (re *RequestError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "remote: request failed with status %d", re.Status)
+	if re.Code != "" {
+		fmt.Fprintf(&b, " (%s)", re.Code)
+	}
+	if re.Detail != "" {
+		fmt.Fprintf(&b, ": %s", re.Detail)
+	}
+	return b.String()
 }
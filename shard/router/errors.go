@@ -0,0 +1,72 @@
+package router
+
+import (
+	"io/fs"
+	"prismarine/shard/backup"
+	"prismarine/shard/manager"
+	"prismarine/shard/runtime"
+	"prismarine/shard/runtime/filesystem"
+	"prismarine/shard/transfer"
+
+	"github.com/charmbracelet/log"
+	"github.com/gofiber/fiber/v2"
+	"github.com/pkg/errors"
+)
+
+// handleError converts an error returned from a route into a JSON response
+// with a status code matching the type of error that occurred
+func handleError(c *fiber.Ctx, err error) error {
+	code := fiber.StatusInternalServerError
+	msg := err.Error()
+
+	var ferr *fiber.Error
+	switch {
+	case errors.As(err, &ferr):
+		code = ferr.Code
+		msg = ferr.Message
+	case errors.Is(err, runtime.ErrLockerLocked):
+		code = fiber.StatusConflict
+		msg = "another power action is currently being processed for this instance"
+	case errors.Is(err, runtime.ErrInstanceInstalling),
+		errors.Is(err, runtime.ErrInstanceRestoring),
+		errors.Is(err, runtime.ErrInstanceTransferring),
+		errors.Is(err, runtime.ErrInstanceRunning):
+		code = fiber.StatusConflict
+	case errors.Is(err, runtime.ErrNoInstallScript):
+		code = fiber.StatusUnprocessableEntity
+	case errors.Is(err, transfer.ErrInvalidToken):
+		code = fiber.StatusUnauthorized
+	case errors.Is(err, transfer.ErrInstanceExists), errors.Is(err, manager.ErrInstanceExists):
+		code = fiber.StatusConflict
+	case errors.Is(err, transfer.ErrChecksumMismatch):
+		code = fiber.StatusBadRequest
+	case errors.Is(err, backup.ErrBackupNotFound):
+		code = fiber.StatusNotFound
+	case errors.Is(err, backup.ErrInvalidIdentifier), errors.Is(err, backup.ErrUnknownAdapter):
+		code = fiber.StatusUnprocessableEntity
+	case errors.Is(err, filesystem.ErrNotEnoughDiskSpace):
+		code = fiber.StatusConflict
+		msg = "the instance does not have enough disk space available"
+	case errors.Is(err, filesystem.ErrBadPathResolution),
+		errors.Is(err, filesystem.ErrIsDirectory),
+		errors.Is(err, filesystem.ErrNotDirectory),
+		errors.Is(err, filesystem.ErrUnknownArchiveFormat),
+		errors.Is(err, filesystem.ErrArchiveTooLarge):
+		code = fiber.StatusBadRequest
+	case errors.Is(err, fs.ErrNotExist):
+		code = fiber.StatusNotFound
+		msg = "the requested file or directory does not exist"
+	case errors.Is(err, fs.ErrExist):
+		code = fiber.StatusConflict
+		msg = "a file or directory already exists at that location"
+	}
+
+	if code >= fiber.StatusInternalServerError {
+		log.
+			With("method", c.Method()).
+			With("path", c.Path()).
+			Error("error while handling request", "err", err)
+	}
+
+	return c.Status(code).JSON(fiber.Map{"error": msg})
+}
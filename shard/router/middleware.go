@@ -0,0 +1,57 @@
+package router
+
+import (
+	"crypto/subtle"
+	"prismarine/shard/config"
+	"prismarine/shard/manager"
+	"prismarine/shard/runtime"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ExtractManager returns the instance manager stored on the request context
+func ExtractManager(c *fiber.Ctx) *manager.Manager {
+	if m, ok := c.Locals("manager").(*manager.Manager); ok {
+		return m
+	}
+	panic("router: cannot extract manager: not present in request context")
+}
+
+// ExtractInstance returns the instance resolved by the instanceExists
+// middleware for the current request
+func ExtractInstance(c *fiber.Ctx) runtime.Instance {
+	if i, ok := c.Locals("instance").(runtime.Instance); ok {
+		return i
+	}
+	panic("router: cannot extract instance: not present in request context")
+}
+
+// instanceExists ensures that the instance requested by the uuid parameter
+// exists on this shard, and stores it on the request context. Instances that
+// failed to initialize cannot be acted on.
+func instanceExists(c *fiber.Ctx) error {
+	uuid := c.Params("uuid")
+	i, ok := ExtractManager(c).Get(uuid)
+	if !ok {
+		if e, ok := ExtractManager(c).FindErrored(uuid); ok {
+			return fiber.NewError(fiber.StatusConflict, "the requested instance failed to initialize: "+e.Error)
+		}
+		return fiber.NewError(fiber.StatusNotFound, "the requested instance does not exist")
+	}
+
+	c.Locals("instance", i)
+	return c.Next()
+}
+
+// authorized ensures that the request carries the panel token as a bearer
+// token. The token is compared in constant time so that it cannot be guessed
+// from how long the comparison takes.
+func authorized(c *fiber.Ctx) error {
+	token, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	expected := config.Get().Remote.Token
+	if !ok || expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		return fiber.NewError(fiber.StatusUnauthorized, "the request is missing a valid token")
+	}
+	return c.Next()
+}
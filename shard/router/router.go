@@ -7,15 +7,51 @@ import (
 )
 
 func Create(m *manager.Manager) *fiber.App {
-	router := fiber.New()
+	router := fiber.New(fiber.Config{
+		ErrorHandler: handleError,
+		// Allows file uploads to be streamed to disk rather than buffered
+		StreamRequestBody: true,
+	})
 
 	router.Use(func(c *fiber.Ctx) error {
 		c.Locals("manager", m)
 		return c.Next()
 	})
 
-	instance := router.Group("/instance")
-	_ = instance
+	// Transfers are authenticated with their own signed token instead
+	instance := router.Group("/instance", authorized)
+	instance.Get("/", getInstances)
+	instance.Post("/", postInstance)
+	instance.Get("/:uuid", instanceExists, getInstance)
+	instance.Delete("/:uuid", deleteInstance)
+	instance.Put("/:uuid/configuration", instanceExists, putInstanceConfiguration)
+	instance.Get("/:uuid/resources", instanceExists, getInstanceResources)
+	instance.Post("/:uuid/power", instanceExists, postInstancePower)
+	instance.Get("/:uuid/ws", instanceExists, getInstanceWebsocket)
+	instance.Post("/:uuid/transfer", instanceExists, postInstanceTransfer)
+	instance.Post("/:uuid/install", instanceExists, postInstanceInstall)
+	instance.Post("/:uuid/reinstall", instanceExists, postInstanceReinstall)
+	instance.Delete("/:uuid/install", instanceExists, deleteInstanceInstall)
+
+	files := instance.Group("/:uuid/files", instanceExists)
+	files.Get("/list", getInstanceListDirectory)
+	files.Get("/contents", getInstanceFileContents)
+	files.Post("/write", postInstanceWriteFile)
+	files.Put("/rename", putInstanceRenameFile)
+	files.Post("/copy", postInstanceCopyFile)
+	files.Post("/delete", postInstanceDeleteFiles)
+	files.Post("/create-directory", postInstanceCreateDirectory)
+	files.Post("/chmod", postInstanceChmodFiles)
+	files.Post("/compress", postInstanceCompressFiles)
+	files.Post("/decompress", postInstanceDecompressFile)
+
+	backups := instance.Group("/:uuid/backup", instanceExists)
+	backups.Get("/", getInstanceBackups)
+	backups.Post("/", postInstanceBackup)
+	backups.Post("/:backup/restore", postInstanceBackupRestore)
+	backups.Delete("/:backup", deleteInstanceBackup)
+
+	router.Post("/transfers", postTransfer)
 
 	return router
 }
@@ -0,0 +1,209 @@
+package router
+
+import (
+	"os"
+	"prismarine/shard/manager"
+	"prismarine/shard/runtime"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gofiber/fiber/v2"
+)
+
+type instanceResponse struct {
+	Uuid          string                 `json:"uuid"`
+	Type          string                 `json:"type"`
+	State         string                 `json:"state"`
+	Configuration *runtime.Configuration `json:"configuration"`
+	// PendingRestart is true if the configuration has changes that only apply
+	// once the instance restarts
+	PendingRestart bool `json:"pending_restart"`
+	// Error is why the instance failed to initialize, if it is errored
+	Error string `json:"error,omitempty"`
+}
+
+func newInstanceResponse(i runtime.Instance) instanceResponse {
+	cfg := i.Config().Snapshot()
+	return instanceResponse{
+		Uuid:           i.Id(),
+		Type:           i.Type(),
+		State:          i.State(),
+		Configuration:  &cfg,
+		PendingRestart: i.IsPendingRestart(),
+	}
+}
+
+// getInstances returns all the instances managed by this shard, including
+// those that failed to initialize
+func getInstances(c *fiber.Ctx) error {
+	m := ExtractManager(c)
+	all := m.All()
+	errored := m.Errored()
+
+	out := make([]instanceResponse, 0, len(all)+len(errored))
+	for _, i := range all {
+		out = append(out, newInstanceResponse(i))
+	}
+	for _, e := range errored {
+		out = append(out, instanceResponse{
+			Uuid:  e.Uuid,
+			State: manager.ErroredState,
+			Error: e.Error,
+		})
+	}
+
+	return c.JSON(out)
+}
+
+// getInstance returns a single instance
+func getInstance(c *fiber.Ctx) error {
+	return c.JSON(newInstanceResponse(ExtractInstance(c)))
+}
+
+type createInstanceRequest struct {
+	Configuration *runtime.Configuration `json:"configuration"`
+	// Install runs the install script in the background once the instance has
+	// been created
+	Install bool `json:"install"`
+}
+
+// postInstance creates a new instance on this shard
+func postInstance(c *fiber.Ctx) error {
+	data := createInstanceRequest{
+		Configuration: &runtime.Configuration{RWMutex: &sync.RWMutex{}},
+	}
+	if err := c.BodyParser(&data); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	// An explicit null replaces the configuration allocated above
+	if data.Configuration == nil {
+		return fiber.NewError(fiber.StatusUnprocessableEntity, "a configuration must be provided")
+	}
+	if err := data.Configuration.Validate(); err != nil {
+		return fiber.NewError(fiber.StatusUnprocessableEntity, err.Error())
+	}
+	if data.Install && data.Configuration.Install == nil {
+		return runtime.ErrNoInstallScript
+	}
+
+	m := ExtractManager(c)
+	i, err := m.Create(data.Configuration)
+	if err != nil {
+		return err
+	}
+
+	if data.Install {
+		go func() {
+			if err := m.Install(i.Context(), i, false); err != nil {
+				log.With("instance", i.Id()).Error("failed to install instance", "err", err)
+			}
+		}()
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(newInstanceResponse(i))
+}
+
+// deleteInstance stops an instance and removes it from this shard along with
+// its files and backups. Instances that failed to initialize can also be
+// deleted.
+func deleteInstance(c *fiber.Ctx) error {
+	uuid := c.Params("uuid")
+	m := ExtractManager(c)
+
+	if i, ok := m.Get(uuid); ok {
+		if err := m.Delete(c.UserContext(), i); err != nil {
+			return err
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+
+	if _, ok := m.FindErrored(uuid); !ok {
+		return fiber.NewError(fiber.StatusNotFound, "the requested instance does not exist")
+	}
+	if err := m.DeleteErrored(uuid); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// putInstanceConfiguration replaces the configuration of an instance without
+// recreating it. The response lists what changed, including any changes that
+// only apply once the instance restarts.
+func putInstanceConfiguration(c *fiber.Ctx) error {
+	i := ExtractInstance(c)
+
+	cfg := &runtime.Configuration{RWMutex: &sync.RWMutex{}}
+	if err := c.BodyParser(cfg); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	// The uuid in the path is the source of truth for which instance this is
+	cfg.Uuid = i.Id()
+	if err := cfg.Validate(); err != nil {
+		return fiber.NewError(fiber.StatusUnprocessableEntity, err.Error())
+	}
+
+	diff, err := i.Update(c.UserContext(), cfg)
+	if err != nil {
+		return err
+	}
+	return c.JSON(diff)
+}
+
+// getInstanceResources returns the latest resource usage of an instance
+func getInstanceResources(c *fiber.Ctx) error {
+	i := ExtractInstance(c)
+	return c.JSON(fiber.Map{
+		"state":     i.State(),
+		"resources": i.Stats(),
+	})
+}
+
+const (
+	PowerActionStart   = "start"
+	PowerActionStop    = "stop"
+	PowerActionRestart = "restart"
+	PowerActionKill    = "kill"
+)
+
+type powerRequest struct {
+	Action string `json:"action"`
+	// WaitSeconds is how long to wait to acquire the power lock before giving
+	// up. A zero value fails immediately if another action is running
+	WaitSeconds int `json:"wait_seconds"`
+}
+
+// postInstancePower performs a power action on an instance, blocking until
+// the action has completed
+func postInstancePower(c *fiber.Ctx) error {
+	var data powerRequest
+	if err := c.BodyParser(&data); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+
+	if data.WaitSeconds < 0 {
+		return fiber.NewError(fiber.StatusUnprocessableEntity, "wait_seconds cannot be negative")
+	}
+
+	i := ExtractInstance(c)
+	ctx := i.Context()
+
+	var err error
+	switch data.Action {
+	case PowerActionStart:
+		err = i.Start(ctx, false, data.WaitSeconds)
+	case PowerActionStop:
+		err = i.WaitForStop(ctx, time.Minute*10, false, false, data.WaitSeconds)
+	case PowerActionRestart:
+		err = i.Restart(ctx, data.WaitSeconds)
+	case PowerActionKill:
+		err = i.Terminate(ctx, os.Kill, false, data.WaitSeconds)
+	default:
+		return fiber.NewError(fiber.StatusUnprocessableEntity, "invalid power action: "+data.Action)
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
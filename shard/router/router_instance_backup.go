@@ -0,0 +1,93 @@
+package router
+
+import (
+	"prismarine/shard/backup"
+
+	"github.com/charmbracelet/log"
+	"github.com/gofiber/fiber/v2"
+)
+
+// newBackup returns the backup for the current instance using the requested
+// adapter
+func newBackup(c *fiber.Ctx, adapter, uuid string) (backup.Backup, error) {
+	i := ExtractInstance(c)
+	switch adapter {
+	case "", backup.AdapterLocal:
+		return backup.NewLocal(i.Id(), uuid)
+	case backup.AdapterS3:
+		return backup.NewS3(ExtractManager(c).Client(), i.Id(), uuid)
+	}
+	return nil, backup.ErrUnknownAdapter
+}
+
+// getInstanceBackups lists the local backups of an instance
+func getInstanceBackups(c *fiber.Ctx) error {
+	backups, err := backup.List(ExtractInstance(c).Id())
+	if err != nil {
+		return err
+	}
+	return c.JSON(backups)
+}
+
+// postInstanceBackup starts creating a backup in the background. The result
+// is published as a backup completed event.
+func postInstanceBackup(c *fiber.Ctx) error {
+	var data struct {
+		Uuid    string `json:"uuid"`
+		Adapter string `json:"adapter"`
+		Ignore  string `json:"ignore"`
+	}
+	if err := c.BodyParser(&data); err != nil || data.Uuid == "" {
+		return fiber.NewError(fiber.StatusUnprocessableEntity, "a backup uuid must be provided")
+	}
+
+	b, err := newBackup(c, data.Adapter, data.Uuid)
+	if err != nil {
+		return err
+	}
+
+	i := ExtractInstance(c)
+	go func() {
+		// Create publishes and logs the result itself
+		_, _ = backup.Create(i.Context(), i, b, data.Ignore)
+	}()
+	return c.SendStatus(fiber.StatusAccepted)
+}
+
+// postInstanceBackupRestore starts restoring a backup in the background. The
+// result is published as a backup restore completed event.
+func postInstanceBackupRestore(c *fiber.Ctx) error {
+	var data struct {
+		Adapter  string `json:"adapter"`
+		Truncate bool   `json:"truncate"`
+	}
+	if err := c.BodyParser(&data); err != nil {
+		return fiber.NewError(fiber.StatusUnprocessableEntity, "invalid request body")
+	}
+
+	b, err := newBackup(c, data.Adapter, c.Params("backup"))
+	if err != nil {
+		return err
+	}
+
+	i := ExtractInstance(c)
+	go func() {
+		if err := backup.Restore(i.Context(), i, b, data.Truncate); err != nil {
+			log.With("instance", i.Id()).With("backup", b.Identifier()).Error("failed to restore backup", "err", err)
+		}
+	}()
+	return c.SendStatus(fiber.StatusAccepted)
+}
+
+// deleteInstanceBackup removes a backup. For S3 backups this only removes any
+// partial upload left on disk.
+func deleteInstanceBackup(c *fiber.Ctx) error {
+	b, err := newBackup(c, c.Query("adapter"), c.Params("backup"))
+	if err != nil {
+		return err
+	}
+	if err := b.Remove(); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
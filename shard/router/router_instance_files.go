@@ -0,0 +1,200 @@
+package router
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"prismarine/shard/runtime"
+	"prismarine/shard/runtime/filesystem"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// getInstanceListDirectory returns the contents of a directory
+func getInstanceListDirectory(c *fiber.Ctx) error {
+	stats, err := ExtractInstance(c).Filesystem().ListDirectory(c.Query("directory", "/"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(stats)
+}
+
+// getInstanceFileContents streams the contents of a file to the client
+func getInstanceFileContents(c *fiber.Ctx) error {
+	f, st, err := ExtractInstance(c).Filesystem().File(c.Query("file"))
+	if err != nil {
+		return err
+	}
+
+	c.Set(fiber.HeaderContentType, fiber.MIMEOctetStream)
+	c.Set("X-Mime-Type", fiber.MIMEOctetStream)
+	if c.QueryBool("download") {
+		c.Attachment(filepath.Base(st.Name()))
+	}
+
+	// The file is closed once it has been fully sent
+	return c.SendStream(f, int(st.Size()))
+}
+
+// postInstanceWriteFile writes the request body to a file, streaming it to
+// disk rather than buffering the whole file in memory
+func postInstanceWriteFile(c *fiber.Ctx) error {
+	file := c.Query("file")
+	if file == "" {
+		return fiber.NewError(fiber.StatusUnprocessableEntity, "a file must be provided")
+	}
+
+	var body io.Reader = c.Context().RequestBodyStream()
+	if body == nil {
+		body = bytes.NewReader(c.Body())
+	}
+
+	if err := ExtractInstance(c).Filesystem().Write(file, body); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+type renameRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// putInstanceRenameFile moves a file or directory
+func putInstanceRenameFile(c *fiber.Ctx) error {
+	var data renameRequest
+	if err := c.BodyParser(&data); err != nil || data.From == "" || data.To == "" {
+		return fiber.NewError(fiber.StatusUnprocessableEntity, "from and to must be provided")
+	}
+
+	if err := ExtractInstance(c).Filesystem().Rename(data.From, data.To); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// postInstanceCopyFile copies a file
+func postInstanceCopyFile(c *fiber.Ctx) error {
+	var data renameRequest
+	if err := c.BodyParser(&data); err != nil || data.From == "" || data.To == "" {
+		return fiber.NewError(fiber.StatusUnprocessableEntity, "from and to must be provided")
+	}
+
+	if err := ExtractInstance(c).Filesystem().Copy(data.From, data.To); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// postInstanceDeleteFiles deletes files and directories within a root
+// directory
+func postInstanceDeleteFiles(c *fiber.Ctx) error {
+	var data struct {
+		Root  string   `json:"root"`
+		Files []string `json:"files"`
+	}
+	if err := c.BodyParser(&data); err != nil || len(data.Files) == 0 {
+		return fiber.NewError(fiber.StatusUnprocessableEntity, "no files were provided to delete")
+	}
+
+	fs := ExtractInstance(c).Filesystem()
+	for _, f := range data.Files {
+		if err := fs.Delete(filepath.Join(data.Root, f)); err != nil {
+			return err
+		}
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// postInstanceCreateDirectory creates a directory and any missing parents
+func postInstanceCreateDirectory(c *fiber.Ctx) error {
+	var data struct {
+		Path string `json:"path"`
+	}
+	if err := c.BodyParser(&data); err != nil || data.Path == "" {
+		return fiber.NewError(fiber.StatusUnprocessableEntity, "a path must be provided")
+	}
+
+	if err := ExtractInstance(c).Filesystem().CreateDirectory(data.Path); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// postInstanceChmodFiles changes the permissions of files within a root
+// directory. Modes are given in octal, such as "755".
+func postInstanceChmodFiles(c *fiber.Ctx) error {
+	var data struct {
+		Root  string `json:"root"`
+		Files []struct {
+			File string `json:"file"`
+			Mode string `json:"mode"`
+		} `json:"files"`
+	}
+	if err := c.BodyParser(&data); err != nil || len(data.Files) == 0 {
+		return fiber.NewError(fiber.StatusUnprocessableEntity, "no files were provided to chmod")
+	}
+
+	fs := ExtractInstance(c).Filesystem()
+	for _, f := range data.Files {
+		mode, err := strconv.ParseUint(f.Mode, 8, 32)
+		if err != nil || mode > 0o777 {
+			return fiber.NewError(fiber.StatusUnprocessableEntity, "invalid file mode: "+f.Mode)
+		}
+		if err := fs.Chmod(filepath.Join(data.Root, f.File), os.FileMode(mode)); err != nil {
+			return err
+		}
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// archiveProgress publishes the progress of an archive operation on the event
+// bus of the instance
+func archiveProgress(i runtime.Instance, topic string) filesystem.ProgressFunc {
+	return func(p filesystem.ArchiveProgress) {
+		i.Events().Publish(topic, p)
+	}
+}
+
+// postInstanceCompressFiles creates an archive of files within a root
+// directory, returning the details of the new archive
+func postInstanceCompressFiles(c *fiber.Ctx) error {
+	var data struct {
+		Root   string   `json:"root"`
+		Files  []string `json:"files"`
+		Format string   `json:"format"`
+	}
+	if err := c.BodyParser(&data); err != nil {
+		return fiber.NewError(fiber.StatusUnprocessableEntity, "invalid request body")
+	}
+	if data.Format == "" {
+		data.Format = filesystem.ArchiveTarGz
+	}
+
+	i := ExtractInstance(c)
+	st, err := i.Filesystem().Compress(data.Root, data.Files, data.Format, archiveProgress(i, runtime.CompressProgressEvent))
+	if err != nil {
+		return err
+	}
+	return c.JSON(st)
+}
+
+// postInstanceDecompressFile extracts an archive into a root directory
+func postInstanceDecompressFile(c *fiber.Ctx) error {
+	var data struct {
+		Root string `json:"root"`
+		File string `json:"file"`
+	}
+	if err := c.BodyParser(&data); err != nil || data.File == "" {
+		return fiber.NewError(fiber.StatusUnprocessableEntity, "a file must be provided")
+	}
+
+	i := ExtractInstance(c)
+	file := filepath.Join(data.Root, data.File)
+	if err := i.Filesystem().Decompress(data.Root, file, archiveProgress(i, runtime.DecompressProgressEvent)); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
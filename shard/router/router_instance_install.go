@@ -0,0 +1,50 @@
+package router
+
+import (
+	"prismarine/shard/runtime"
+
+	"github.com/charmbracelet/log"
+	"github.com/gofiber/fiber/v2"
+)
+
+// postInstanceInstall runs the install script of an instance in the
+// background. The result is reported to the panel and published as an
+// install completed event.
+func postInstanceInstall(c *fiber.Ctx) error {
+	return startInstall(c, false)
+}
+
+// postInstanceReinstall stops an instance and runs its install script again
+// in the background
+func postInstanceReinstall(c *fiber.Ctx) error {
+	return startInstall(c, true)
+}
+
+func startInstall(c *fiber.Ctx, reinstall bool) error {
+	i := ExtractInstance(c)
+	if i.Config().Snapshot().Install == nil {
+		return runtime.ErrNoInstallScript
+	}
+	if i.IsInstalling() {
+		return runtime.ErrInstanceInstalling
+	}
+
+	m := ExtractManager(c)
+	go func() {
+		if err := m.Install(i.Context(), i, reinstall); err != nil {
+			log.With("instance", i.Id()).Error("failed to install instance", "reinstall", reinstall, "err", err)
+		}
+	}()
+	return c.SendStatus(fiber.StatusAccepted)
+}
+
+// deleteInstanceInstall cancels a running installation, killing the install
+// container
+func deleteInstanceInstall(c *fiber.Ctx) error {
+	i := ExtractInstance(c)
+	if !i.IsInstalling() {
+		return fiber.NewError(fiber.StatusConflict, "the instance is not installing")
+	}
+	i.CancelInstall()
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,98 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"prismarine/shard/config"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const testToken = "token"
+
+// useToken configures the panel token that requests must carry
+func useToken(t *testing.T) {
+	t.Helper()
+
+	cfg := config.Default()
+	cfg.Remote.Token = testToken
+	config.Set(cfg)
+	t.Cleanup(func() { config.Set(nil) })
+}
+
+func TestInstance_Unauthorized(t *testing.T) {
+	useToken(t)
+	// None of these reach the manager, so there is no need for one
+	app := Create(nil)
+
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{"missing", ""},
+		{"wrong token", "Bearer wrong"},
+		{"not bearer", testToken},
+		{"empty bearer", "Bearer "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(fiber.MethodGet, "/instance", nil)
+			if tt.header != "" {
+				req.Header.Set(fiber.HeaderAuthorization, tt.header)
+			}
+
+			res, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			if res.StatusCode != fiber.StatusUnauthorized {
+				t.Fatalf("expected status %d, got %d", fiber.StatusUnauthorized, res.StatusCode)
+			}
+		})
+	}
+}
+
+func TestPostInstance_InvalidBody(t *testing.T) {
+	useToken(t)
+	// None of these reach the manager, so there is no need for one
+	app := Create(nil)
+
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"null configuration", `{"configuration": null}`, fiber.StatusUnprocessableEntity},
+		{"missing configuration", `{}`, fiber.StatusUnprocessableEntity},
+		{"missing container", `{"configuration": {"uuid": "abc"}}`, fiber.StatusUnprocessableEntity},
+		{"invalid uuid", `{"configuration": {"uuid": "../abc", "container": {"image": "busybox"}}}`, fiber.StatusUnprocessableEntity},
+		{"install without script", `{"configuration": {"uuid": "abc", "container": {"image": "busybox"}}, "install": true}`, fiber.StatusUnprocessableEntity},
+		{"malformed", `{"configuration":`, fiber.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(fiber.MethodPost, "/instance", strings.NewReader(tt.body))
+			req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+			req.Header.Set(fiber.HeaderAuthorization, "Bearer "+testToken)
+
+			res, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != tt.code {
+				t.Fatalf("expected status %d, got %d", tt.code, res.StatusCode)
+			}
+			var body struct {
+				Error string `json:"error"`
+			}
+			if err := json.NewDecoder(res.Body).Decode(&body); err != nil || body.Error == "" {
+				t.Fatalf("expected an error message, got %v", err)
+			}
+		})
+	}
+}
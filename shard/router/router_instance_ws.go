@@ -0,0 +1,21 @@
+package router
+
+import (
+	"prismarine/shard/router/websocket"
+
+	ws "github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+)
+
+// getInstanceWebsocket upgrades the connection to a websocket which streams
+// the console output and events of an instance, and accepts console commands
+func getInstanceWebsocket(c *fiber.Ctx) error {
+	if !ws.IsWebSocketUpgrade(c) {
+		return fiber.ErrUpgradeRequired
+	}
+
+	i := ExtractInstance(c)
+	return ws.New(func(conn *ws.Conn) {
+		websocket.GetHandler(i, conn).Serve()
+	})(c)
+}
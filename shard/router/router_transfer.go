@@ -0,0 +1,63 @@
+package router
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"prismarine/shard/config"
+	"prismarine/shard/transfer"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/gofiber/fiber/v2"
+)
+
+// postInstanceTransfer starts transferring an instance to another shard in
+// the background. The result is reported to the panel and published as
+// transfer status events.
+func postInstanceTransfer(c *fiber.Ctx) error {
+	var data transfer.Target
+	if err := c.BodyParser(&data); err != nil || data.Url == "" || data.Token == "" {
+		return fiber.NewError(fiber.StatusUnprocessableEntity, "a target url and token must be provided")
+	}
+
+	i := ExtractInstance(c)
+	m := ExtractManager(c)
+	go func() {
+		if err := transfer.Send(i.Context(), m, i, data); err != nil {
+			log.With("instance", i.Id()).Error("failed to transfer instance", "err", err)
+		}
+	}()
+	return c.SendStatus(fiber.StatusAccepted)
+}
+
+// postTransfer receives an instance transferred from another shard. The
+// request is authorized by a token signed with the panel token of this shard,
+// and the response is only sent once the instance has been recreated.
+func postTransfer(c *fiber.Ctx) error {
+	token, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if !ok {
+		return transfer.ErrInvalidToken
+	}
+	claims, err := transfer.ParseToken([]byte(config.Get().Remote.Token), token)
+	if err != nil {
+		return err
+	}
+
+	_, params, err := mime.ParseMediaType(c.Get(fiber.HeaderContentType))
+	if err != nil || params["boundary"] == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "the request body must be multipart form data")
+	}
+
+	var body io.Reader = c.Context().RequestBodyStream()
+	if body == nil {
+		body = bytes.NewReader(c.Body())
+	}
+
+	r := multipart.NewReader(body, params["boundary"])
+	if err := transfer.Receive(c.UserContext(), ExtractManager(c), claims.Subject, r); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,166 @@
+package websocket
+
+import (
+	"context"
+	"prismarine/shard/runtime"
+	"prismarine/shard/runtime/events"
+	"sync"
+
+	"github.com/charmbracelet/log"
+	"github.com/gofiber/contrib/websocket"
+	"github.com/pkg/errors"
+)
+
+const (
+	// SendCommandEvent is received from the client to write a command to the
+	// console of the instance
+	SendCommandEvent = "send command"
+	// ConsoleOutputEvent is sent to the client for every line of output from
+	// the instance
+	ConsoleOutputEvent = "console output"
+	// InstallOutputEvent is sent to the client for every line of output from
+	// the install script of the instance
+	InstallOutputEvent = "install output"
+	// ErrorEvent is sent to the client when an inbound message could not be
+	// processed
+	ErrorEvent = "error"
+)
+
+// forwardedEvents are the instance event bus topics that are passed through
+// to the client as-is
+var forwardedEvents = []string{
+	runtime.StateChangeEvent,
+	runtime.ResourceEvent,
+	runtime.DockerImagePullStarted,
+	runtime.DockerImagePullStatus,
+	runtime.DockerImagePullCompleted,
+	runtime.CrashEvent,
+	runtime.CompressProgressEvent,
+	runtime.DecompressProgressEvent,
+	runtime.BackupCompletedEvent,
+	runtime.BackupRestoreEvent,
+	runtime.TransferStatusEvent,
+	runtime.InstallStartedEvent,
+	runtime.InstallCompletedEvent,
+	runtime.StartupTimeoutEvent,
+}
+
+// Message is the structure of every message sent over the socket in either
+// direction
+type Message struct {
+	Event string        `json:"event"`
+	Args  []interface{} `json:"args,omitempty"`
+}
+
+// Handler manages a single websocket connection for an instance console
+type Handler struct {
+	// Guards writes to the connection, which cannot happen concurrently
+	sync.Mutex
+	Connection *websocket.Conn
+
+	instance runtime.Instance
+}
+
+// GetHandler returns a new Handler for the connection to the given instance
+func GetHandler(i runtime.Instance, conn *websocket.Conn) *Handler {
+	return &Handler{
+		Connection: conn,
+		instance:   i,
+	}
+}
+
+// Serve streams console output and events to the client while processing
+// inbound messages. It blocks until the connection is closed or the instance
+// context is canceled.
+func (h *Handler) Serve() {
+	ctx, cancel := context.WithCancel(h.instance.Context())
+	defer cancel()
+
+	go h.listenForOutput(ctx, events.LogSink, ConsoleOutputEvent)
+	go h.listenForOutput(ctx, events.InstallSink, InstallOutputEvent)
+
+	subs := make([]*events.Subscription, len(forwardedEvents))
+	for idx, topic := range forwardedEvents {
+		subs[idx] = h.instance.Events().Subscribe(topic, h.forwardEvent)
+	}
+	defer func() {
+		for _, s := range subs {
+			h.instance.Events().Unsubscribe(s)
+		}
+	}()
+
+	// Give the client the current state right away so it doesn't have to wait
+	// for the next state change to render anything
+	_ = h.SendJson(Message{Event: runtime.StateChangeEvent, Args: []interface{}{h.instance.State()}})
+
+	go func() {
+		<-ctx.Done()
+		_ = h.Connection.Close()
+	}()
+
+	for {
+		var m Message
+		if err := h.Connection.ReadJSON(&m); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) && ctx.Err() == nil {
+				log.With("instance", h.instance.Id()).Warn("error while reading from websocket", "err", err)
+			}
+			return
+		}
+
+		if err := h.handleInbound(m); err != nil {
+			_ = h.SendJson(Message{Event: ErrorEvent, Args: []interface{}{err.Error()}})
+		}
+	}
+}
+
+// SendJson writes a message to the connection
+func (h *Handler) SendJson(m Message) error {
+	h.Lock()
+	defer h.Unlock()
+	return h.Connection.WriteJSON(m)
+}
+
+func (h *Handler) handleInbound(m Message) error {
+	switch m.Event {
+	case SendCommandEvent:
+		if len(m.Args) != 1 {
+			return errors.New("websocket: send command expects a single argument")
+		}
+		cmd, ok := m.Args[0].(string)
+		if !ok {
+			return errors.New("websocket: command must be a string")
+		}
+		return h.instance.SendCommand(cmd)
+	default:
+		return errors.Errorf("websocket: unknown event: %s", m.Event)
+	}
+}
+
+func (h *Handler) forwardEvent(e events.Event) {
+	if err := h.SendJson(Message{Event: e.Topic, Args: []interface{}{e.Data}}); err != nil {
+		log.With("instance", h.instance.Id()).Debug("failed to forward event to websocket", "err", err)
+	}
+}
+
+// listenForOutput sends every line pushed to the sink to the client as the
+// given event
+func (h *Handler) listenForOutput(ctx context.Context, name events.SinkName, event string) {
+	c := make(chan []byte, 10)
+	sink := h.instance.Sink(name)
+	sink.On(c)
+	defer sink.Off(c)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case line, ok := <-c:
+			if !ok {
+				return
+			}
+			if err := h.SendJson(Message{Event: event, Args: []interface{}{string(line)}}); err != nil {
+				return
+			}
+		}
+	}
+}
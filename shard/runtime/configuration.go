@@ -1,14 +1,234 @@
 package runtime
 
-import "sync"
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+)
 
 type Settings struct {
 	Labels map[string]string
 }
 
+const (
+	ProtocolTcp = "tcp"
+	ProtocolUdp = "udp"
+)
+
+// PortAllocation is a port on the host that is forwarded to the same port in
+// the container
+type PortAllocation struct {
+	// Ip is the host IP to bind to. If empty the configured default interface
+	// of the shard is used
+	Ip   string `json:"ip"`
+	Port int    `json:"port"`
+	// Protocol is either "tcp" or "udp". If empty both are bound
+	Protocol string `json:"protocol"`
+}
+
+// Limits are the resource limits applied to the container
+type Limits struct {
+	// MemoryLimit is the amount of memory in MiB. Zero is unlimited
+	MemoryLimit int64 `json:"memory_limit"`
+	// Swap is the amount of swap in MiB on top of the memory limit. Negative
+	// values allow unlimited swap
+	Swap int64 `json:"swap"`
+	// CpuLimit is the percentage of a single core that can be used, so 200
+	// allows two full cores. Zero is unlimited
+	CpuLimit int64 `json:"cpu_limit"`
+	// Threads pins the container to specific cpus, such as "0-1,3"
+	Threads string `json:"threads"`
+	// IoWeight is the relative block IO weight, between 10 and 1000
+	IoWeight uint16 `json:"io_weight"`
+	// PidsLimit is the maximum number of processes. Zero uses the shard default
+	PidsLimit int64 `json:"pids_limit"`
+	// DiskSpace is the amount of disk space in MiB the data directory may use.
+	// Zero is unlimited
+	DiskSpace int64 `json:"disk_space"`
+	// OomDisabled stops the kernel from killing the process when it runs out
+	// of memory
+	OomDisabled bool `json:"oom_disabled"`
+}
+
+// DiskBytes returns the disk space limit in bytes
+func (l Limits) DiskBytes() int64 {
+	return l.DiskSpace * 1024 * 1024
+}
+
+// MemoryBytes returns the memory limit in bytes
+func (l Limits) MemoryBytes() int64 {
+	return l.MemoryLimit * 1024 * 1024
+}
+
+// SwapBytes returns the combined memory and swap limit in bytes, as Docker
+// expects it
+func (l Limits) SwapBytes() int64 {
+	if l.MemoryLimit <= 0 || l.Swap < 0 {
+		return -1
+	}
+	return (l.MemoryLimit + l.Swap) * 1024 * 1024
+}
+
+// Mount is an additional host directory mounted into the container
+type Mount struct {
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+	ReadOnly bool   `json:"read_only"`
+}
+
 type Container struct {
 	Labels map[string]string `json:"labels"`
 	Image  string            `json:"image"`
+
+	Environment map[string]string `json:"environment"`
+	Ports       []PortAllocation  `json:"ports"`
+	Limits      Limits            `json:"limits"`
+
+	// Tmpfs maps container paths to the tmpfs mount options, such as "size=100m"
+	Tmpfs  map[string]string `json:"tmpfs"`
+	Mounts []Mount           `json:"mounts"`
+
+	// Dns overrides the DNS servers configured for the shard
+	Dns []string `json:"dns"`
+	// User is the user the process runs as, in "uid" or "uid:gid" form
+	User string `json:"user"`
+}
+
+// Validate checks that the container settings are well formed. It does not
+// check whether the host allows the settings, which is up to the runtime.
+func (c *Container) Validate() error {
+	if c.Image == "" {
+		return fmt.Errorf("runtime: container image is required")
+	}
+
+	for _, p := range c.Ports {
+		if p.Port < 1 || p.Port > 65535 {
+			return fmt.Errorf("runtime: invalid port: %d", p.Port)
+		}
+		if p.Protocol != "" && p.Protocol != ProtocolTcp && p.Protocol != ProtocolUdp {
+			return fmt.Errorf("runtime: invalid protocol for port %d: %s", p.Port, p.Protocol)
+		}
+	}
+
+	l := c.Limits
+	if l.MemoryLimit < 0 || l.CpuLimit < 0 || l.PidsLimit < 0 || l.DiskSpace < 0 {
+		return fmt.Errorf("runtime: limits cannot be negative")
+	}
+	if l.IoWeight != 0 && (l.IoWeight < 10 || l.IoWeight > 1000) {
+		return fmt.Errorf("runtime: io weight must be between 10 and 1000")
+	}
+
+	for target := range c.Tmpfs {
+		if !path.IsAbs(target) {
+			return fmt.Errorf("runtime: tmpfs target must be an absolute path: %s", target)
+		}
+	}
+	for _, m := range c.Mounts {
+		if !path.IsAbs(m.Source) || !path.IsAbs(m.Target) {
+			return fmt.Errorf("runtime: mount paths must be absolute: %s:%s", m.Source, m.Target)
+		}
+	}
+
+	return nil
+}
+
+const (
+	// StopTypeCommand types the value into the console of the instance
+	StopTypeCommand = "command"
+	// StopTypeSignal sends the signal named by the value to the process
+	StopTypeSignal = "signal"
+	// StopTypeNative stops the container the way the runtime does by default
+	StopTypeNative = "native"
+)
+
+// stopSignals are the signals that can be used to stop an instance
+var stopSignals = map[string]bool{
+	"SIGTERM": true,
+	"SIGINT":  true,
+	"SIGQUIT": true,
+	"SIGHUP":  true,
+	"SIGUSR1": true,
+	"SIGUSR2": true,
+	"SIGKILL": true,
+}
+
+// StopConfiguration is how an instance is asked to stop gracefully
+type StopConfiguration struct {
+	// Type is one of "command", "signal" or "native". Empty is native
+	Type string `json:"type"`
+	// Value is the console command or the signal name, such as "SIGTERM"
+	Value string `json:"value"`
+}
+
+// UnmarshalJSON also accepts a plain string, which is treated as a console
+// command so that older settings keep working
+func (s *StopConfiguration) UnmarshalJSON(b []byte) error {
+	var cmd string
+	if err := json.Unmarshal(b, &cmd); err == nil {
+		*s = StopConfiguration{}
+		if cmd != "" {
+			s.Type = StopTypeCommand
+			s.Value = cmd
+		}
+		return nil
+	}
+
+	type stop StopConfiguration
+	return json.Unmarshal(b, (*stop)(s))
+}
+
+// Signal returns the signal name in the form Docker expects
+func (s StopConfiguration) Signal() string {
+	name := strings.ToUpper(s.Value)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	return name
+}
+
+// Validate checks that the stop configuration is usable
+func (s StopConfiguration) Validate() error {
+	switch s.Type {
+	case "", StopTypeNative:
+	case StopTypeCommand:
+		if s.Value == "" {
+			return fmt.Errorf("runtime: stop command cannot be empty")
+		}
+	case StopTypeSignal:
+		if !stopSignals[s.Signal()] {
+			return fmt.Errorf("runtime: invalid stop signal: %s", s.Value)
+		}
+	default:
+		return fmt.Errorf("runtime: invalid stop type: %s", s.Type)
+	}
+	return nil
+}
+
+// InstallScript is run in a one-shot container to install the instance. The
+// data directory is mounted at /mnt/server and the script at /mnt/install.
+type InstallScript struct {
+	// Image is the image the install container runs
+	Image string `json:"image"`
+	// Entrypoint is the program the script is passed to, such as "bash".
+	// Defaults to "sh"
+	Entrypoint string `json:"entrypoint"`
+	// Script is the contents of the install script
+	Script string `json:"script"`
+}
+
+// Validate checks that the install script can be run
+func (s *InstallScript) Validate() error {
+	if s.Image == "" {
+		return fmt.Errorf("runtime: install image is required")
+	}
+	if s.Script == "" {
+		return fmt.Errorf("runtime: install script is required")
+	}
+	return nil
 }
 
 type Configuration struct {
@@ -19,10 +239,145 @@ type Configuration struct {
 	Name        string `json:"name"`
 	Description string `json:"description"`
 
-	Invocation string `json:"invocation"`
-	Stop       string `json:"stop"`
+	Invocation string            `json:"invocation"`
+	Stop       StopConfiguration `json:"stop"`
 
 	Container *Container `json:"container,omitempty"`
 
+	Install *InstallScript `json:"install,omitempty"`
+
+	Crash CrashPolicy `json:"crash"`
+
+	Startup StartupConfiguration `json:"startup"`
+
 	Suspended bool `json:"suspended"`
 }
+
+// uuidRegex matches identifiers that are safe to use in paths and container
+// names
+var uuidRegex = regexp.MustCompile(`^[a-zA-Z0-9-]{1,64}$`)
+
+// ValidUuid reports whether a uuid is safe to use in paths and container names
+func ValidUuid(uuid string) bool {
+	return uuidRegex.MatchString(uuid)
+}
+
+// Validate checks that an instance can be created from the configuration
+func (c *Configuration) Validate() error {
+	if !ValidUuid(c.Uuid) {
+		return fmt.Errorf("runtime: invalid uuid: %q", c.Uuid)
+	}
+	if c.Container == nil {
+		return fmt.Errorf("runtime: container settings are required")
+	}
+	if err := c.Container.Validate(); err != nil {
+		return err
+	}
+	if err := c.Stop.Validate(); err != nil {
+		return err
+	}
+	if err := c.Startup.Validate(); err != nil {
+		return err
+	}
+	if c.Install != nil {
+		if err := c.Install.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConfigurationDiff describes what changed when a configuration was updated
+type ConfigurationDiff struct {
+	// Limits is true if any resource limit that can be applied to a running
+	// container changed
+	Limits bool `json:"limits"`
+	// PendingRestart lists the settings the container has to be recreated for,
+	// which happens the next time the instance starts
+	PendingRestart []string `json:"pending_restart"`
+}
+
+// RequiresRestart returns true if some of the changes only apply once the
+// instance restarts
+func (d ConfigurationDiff) RequiresRestart() bool {
+	return len(d.PendingRestart) > 0
+}
+
+// Snapshot returns a copy of the configuration taken while holding the read
+// lock, which can be read from without holding the lock. Nested settings are
+// shared rather than copied, which is safe since Update replaces them instead
+// of changing them in place. The copy has no lock of its own.
+func (c *Configuration) Snapshot() Configuration {
+	c.RLock()
+	defer c.RUnlock()
+	s := *c
+	s.RWMutex = nil
+	return s
+}
+
+// Update validates the new settings and replaces the current ones with them
+// while holding the lock, returning what changed. Readers must go through
+// Snapshot. The uuid cannot be changed.
+func (c *Configuration) Update(n *Configuration) (ConfigurationDiff, error) {
+	if err := n.Validate(); err != nil {
+		return ConfigurationDiff{}, err
+	}
+	// The uuid never changes, so it is the one field that is read without
+	// the lock
+	if n.Uuid != c.Uuid {
+		return ConfigurationDiff{}, fmt.Errorf("runtime: the uuid of an instance cannot be changed")
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	diff := c.diff(n)
+
+	c.Name = n.Name
+	c.Description = n.Description
+	c.Invocation = n.Invocation
+	c.Stop = n.Stop
+	c.Container = n.Container
+	c.Install = n.Install
+	c.Crash = n.Crash
+	c.Startup = n.Startup
+	c.Suspended = n.Suspended
+
+	return diff, nil
+}
+
+// diff compares the settings with the new ones. Settings the container is not
+// created with, such as the stop configuration, apply immediately and are not
+// included. The caller must hold the lock.
+func (c *Configuration) diff(n *Configuration) ConfigurationDiff {
+	d := ConfigurationDiff{PendingRestart: []string{}}
+	restart := func(name string, changed bool) {
+		if changed {
+			d.PendingRestart = append(d.PendingRestart, name)
+		}
+	}
+
+	o, nc := c.Container, n.Container
+	if o == nil {
+		o = &Container{}
+	}
+
+	// The invocation is passed to the container as an environment variable
+	restart("invocation", c.Invocation != n.Invocation)
+	restart("image", o.Image != nc.Image)
+	restart("environment", !reflect.DeepEqual(o.Environment, nc.Environment))
+	restart("ports", !reflect.DeepEqual(o.Ports, nc.Ports))
+	restart("mounts", !reflect.DeepEqual(o.Mounts, nc.Mounts))
+	restart("tmpfs", !reflect.DeepEqual(o.Tmpfs, nc.Tmpfs))
+	restart("labels", !reflect.DeepEqual(o.Labels, nc.Labels))
+	restart("dns", !reflect.DeepEqual(o.Dns, nc.Dns))
+	restart("user", o.User != nc.User)
+	// Docker cannot change this on an existing container
+	restart("oom_disabled", o.Limits.OomDisabled != nc.Limits.OomDisabled)
+
+	ol, nl := o.Limits, nc.Limits
+	ol.OomDisabled, nl.OomDisabled = false, false
+	d.Limits = ol != nl
+
+	return d
+}
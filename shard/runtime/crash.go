@@ -0,0 +1,204 @@
+package runtime
+
+import (
+	"prismarine/shard/runtime/events"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/pkg/errors"
+)
+
+// CrashPolicy controls how an instance is treated when its process exits
+// without being asked to
+type CrashPolicy struct {
+	// Restart enables restarting the instance automatically after a crash
+	Restart bool `json:"restart"`
+
+	// DetectCleanExit treats the process exiting with code 0 as a crash. When
+	// disabled a clean exit is treated as the process stopping itself
+	DetectCleanExit bool `json:"detect_clean_exit"`
+
+	// Timeout is the number of seconds after a crash within which another
+	// crash will not be restarted. Zero disables the check
+	Timeout int `json:"timeout"`
+
+	// Backoff is the number of seconds waited before restarting, doubled for
+	// every crash within the window up to MaxBackoff seconds
+	Backoff    int `json:"backoff"`
+	MaxBackoff int `json:"max_backoff"`
+
+	// MaxCrashes is the number of crashes within Window seconds after which
+	// the instance is considered to be crash looping and is no longer
+	// restarted. Zero disables the cutoff
+	MaxCrashes int `json:"max_crashes"`
+	Window     int `json:"window"`
+}
+
+// CrashReport is published with the CrashEvent
+type CrashReport struct {
+	ExitCode  uint32 `json:"exit_code"`
+	OomKilled bool   `json:"oom_killed"`
+	// Restart is true if the instance will be restarted automatically
+	Restart bool `json:"restart"`
+	// Reason explains why the instance will not be restarted
+	Reason string `json:"reason,omitempty"`
+}
+
+// CrashHandler watches the state of an instance and reacts when it goes
+// offline without a stop being requested
+type CrashHandler struct {
+	mu sync.Mutex
+
+	instance Instance
+	previous string
+	crashes  []time.Time
+}
+
+// NewCrashHandler starts watching the instance for crashes. The handler lives
+// for as long as the instance event bus.
+func NewCrashHandler(i Instance) *CrashHandler {
+	h := &CrashHandler{
+		instance: i,
+		previous: i.State(),
+	}
+	i.Events().SubscribeLossless(StateChangeEvent, h.onStateChange)
+	return h
+}
+
+// LastCrash returns the time of the most recent crash, or the zero time if the
+// instance has not crashed
+func (h *CrashHandler) LastCrash() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.crashes) == 0 {
+		return time.Time{}
+	}
+	return h.crashes[len(h.crashes)-1]
+}
+
+func (h *CrashHandler) onStateChange(e events.Event) {
+	state, ok := e.Data.(string)
+	if !ok {
+		return
+	}
+
+	h.mu.Lock()
+	previous := h.previous
+	h.previous = state
+	h.mu.Unlock()
+
+	// Stops always pass through the stopping state first, so going straight
+	// to offline from a live state means the process exited by itself
+	if state != ProcessOfflineState || (previous != ProcessRunningState && previous != ProcessStartingState) {
+		return
+	}
+
+	if err := h.handleCrash(); err != nil {
+		log.With("instance", h.instance.Id()).Error("failed to handle instance crash", "err", err)
+	}
+}
+
+func (h *CrashHandler) handleCrash() error {
+	exitCode, oomKilled, err := h.instance.ExitState()
+	if err != nil {
+		return errors.Wrap(err, "runtime: failed to read exit state")
+	}
+
+	policy := h.instance.Config().Snapshot().Crash
+	if exitCode == 0 && !oomKilled && !policy.DetectCleanExit {
+		log.With("instance", h.instance.Id()).Debug("process exited cleanly, not treating as a crash")
+		return nil
+	}
+
+	now := time.Now()
+	report := CrashReport{ExitCode: exitCode, OomKilled: oomKilled}
+
+	h.mu.Lock()
+	var last time.Time
+	if len(h.crashes) > 0 {
+		last = h.crashes[len(h.crashes)-1]
+	}
+	h.crashes = append(h.crashes, now)
+	recent := h.recentCrashes(now, policy)
+	h.mu.Unlock()
+
+	switch {
+	case !policy.Restart:
+		report.Reason = "automatic restarts are disabled"
+	case policy.Timeout > 0 && !last.IsZero() && now.Sub(last) < time.Duration(policy.Timeout)*time.Second:
+		report.Reason = "crashed again within the crash timeout"
+	case policy.MaxCrashes > 0 && recent > policy.MaxCrashes:
+		report.Reason = "crash loop detected"
+	default:
+		report.Restart = true
+	}
+
+	log.
+		With("instance", h.instance.Id()).
+		With("exit_code", exitCode).
+		With("oom_killed", oomKilled).
+		With("restart", report.Restart).
+		Warn("instance process crashed", "reason", report.Reason)
+
+	h.instance.Events().Publish(CrashEvent, report)
+
+	if report.Restart {
+		go h.restart(backoff(policy, recent))
+	}
+	return nil
+}
+
+// recentCrashes drops crashes that are outside the policy window and returns
+// how many are left. The caller must hold the lock.
+func (h *CrashHandler) recentCrashes(now time.Time, policy CrashPolicy) int {
+	if policy.Window <= 0 {
+		// Without a window only the last crash is needed for the timeout
+		h.crashes = h.crashes[len(h.crashes)-1:]
+		return 1
+	}
+
+	cutoff := now.Add(-time.Duration(policy.Window) * time.Second)
+	idx := 0
+	for idx < len(h.crashes) && h.crashes[idx].Before(cutoff) {
+		idx++
+	}
+	h.crashes = h.crashes[idx:]
+	return len(h.crashes)
+}
+
+// backoff returns how long to wait before restarting after the given number
+// of recent crashes
+func backoff(policy CrashPolicy, crashes int) time.Duration {
+	d := time.Duration(policy.Backoff) * time.Second
+	max := time.Duration(policy.MaxBackoff) * time.Second
+	for n := 1; n < crashes && d > 0; n++ {
+		d *= 2
+		if max > 0 && d >= max {
+			return max
+		}
+	}
+	if max > 0 && d > max {
+		return max
+	}
+	return d
+}
+
+func (h *CrashHandler) restart(delay time.Duration) {
+	ctx := h.instance.Context()
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(delay):
+	}
+
+	// Something else may have started the instance while waiting
+	if h.instance.State() != ProcessOfflineState {
+		return
+	}
+
+	if err := h.instance.Start(ctx, false, 0); err != nil {
+		log.With("instance", h.instance.Id()).Error("failed to restart instance after crash", "err", err)
+	}
+}
@@ -0,0 +1,146 @@
+package runtime
+
+import (
+	"prismarine/shard/runtime/events"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		backoff, max, crashes int
+		want                  time.Duration
+	}{
+		{0, 0, 3, 0},
+		{1, 0, 1, time.Second},
+		{1, 0, 2, 2 * time.Second},
+		{1, 0, 4, 8 * time.Second},
+		{1, 3, 2, 2 * time.Second},
+		{1, 3, 3, 3 * time.Second},
+		{1, 3, 40, 3 * time.Second},
+		{5, 2, 1, 2 * time.Second},
+	}
+	for _, tt := range tests {
+		got := backoff(CrashPolicy{Backoff: tt.backoff, MaxBackoff: tt.max}, tt.crashes)
+		if got != tt.want {
+			t.Errorf("backoff %ds max %ds after %d crashes: expected %s, got %s", tt.backoff, tt.max, tt.crashes, tt.want, got)
+		}
+	}
+}
+
+func TestCrashHandler_RecentCrashes(t *testing.T) {
+	now := time.Now()
+	crashes := []time.Time{now.Add(-2 * time.Minute), now.Add(-30 * time.Second), now}
+
+	h := &CrashHandler{crashes: append([]time.Time(nil), crashes...)}
+	if n := h.recentCrashes(now, CrashPolicy{Window: 60}); n != 2 || len(h.crashes) != 2 || !h.crashes[0].Equal(crashes[1]) {
+		t.Fatalf("expected the crashes outside the window to be dropped, got %d %v", n, h.crashes)
+	}
+
+	h = &CrashHandler{crashes: append([]time.Time(nil), crashes...)}
+	if n := h.recentCrashes(now, CrashPolicy{}); n != 1 || len(h.crashes) != 1 || !h.crashes[0].Equal(now) {
+		t.Fatalf("expected only the last crash to be kept without a window, got %d %v", n, h.crashes)
+	}
+}
+
+// crash moves the instance to running and then has it exit, returning the
+// report published for the crash
+func crash(t *testing.T, i *fakeInstance, crashes chan events.Event, code uint32) CrashReport {
+	t.Helper()
+	if i.State() != ProcessRunningState {
+		i.SetState(ProcessRunningState)
+	}
+	i.exit(code, false)
+	return expectEvent(t, crashes).Data.(CrashReport)
+}
+
+func TestCrashHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous string
+		code     uint32
+		oom      bool
+		policy   CrashPolicy
+		crash    bool
+	}{
+		{"running", ProcessRunningState, 1, false, CrashPolicy{}, true},
+		{"starting", ProcessStartingState, 1, false, CrashPolicy{}, true},
+		{"stopping", ProcessStoppingState, 1, false, CrashPolicy{}, false},
+		{"clean exit", ProcessRunningState, 0, false, CrashPolicy{}, false},
+		{"clean exit detected", ProcessRunningState, 0, false, CrashPolicy{DetectCleanExit: true}, true},
+		{"out of memory", ProcessRunningState, 0, true, CrashPolicy{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := newFakeInstance(t, Configuration{Crash: tt.policy})
+			h := NewCrashHandler(i)
+			crashes := i.subscribe(CrashEvent)
+
+			i.SetState(tt.previous)
+			i.exit(tt.code, tt.oom)
+
+			if !tt.crash {
+				expectNoEvent(t, crashes)
+				if !h.LastCrash().IsZero() {
+					t.Fatal("expected no crash to be recorded")
+				}
+				return
+			}
+			r := expectEvent(t, crashes).Data.(CrashReport)
+			if r.ExitCode != tt.code || r.OomKilled != tt.oom || r.Restart || r.Reason == "" {
+				t.Fatalf("expected a crash without a restart, got %+v", r)
+			}
+			if h.LastCrash().IsZero() {
+				t.Fatal("expected the crash to be recorded")
+			}
+		})
+	}
+}
+
+func TestCrashHandler_Restart(t *testing.T) {
+	i := newFakeInstance(t, Configuration{Crash: CrashPolicy{Restart: true}})
+	NewCrashHandler(i)
+	crashes := i.subscribe(CrashEvent)
+	states := i.subscribe(StateChangeEvent)
+
+	if r := crash(t, i, crashes, 1); !r.Restart {
+		t.Fatalf("expected a restart, got %+v", r)
+	}
+	// Running, offline from the crash, then running again from the restart
+	for _, want := range []string{ProcessRunningState, ProcessOfflineState, ProcessRunningState} {
+		if state := expectEvent(t, states).Data.(string); state != want {
+			t.Fatalf("expected %s, got %s", want, state)
+		}
+	}
+	if starts, _ := i.counts(); starts != 1 {
+		t.Fatalf("expected one restart, got %d", starts)
+	}
+}
+
+func TestCrashHandler_NotRestarted(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy CrashPolicy
+		// The number of crashes that are restarted before the last one
+		restarts int
+	}{
+		{"crash timeout", CrashPolicy{Restart: true, Timeout: 60}, 1},
+		{"crash loop", CrashPolicy{Restart: true, MaxCrashes: 2, Window: 60}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := newFakeInstance(t, Configuration{Crash: tt.policy})
+			NewCrashHandler(i)
+			crashes := i.subscribe(CrashEvent)
+
+			for n := 0; n < tt.restarts; n++ {
+				if r := crash(t, i, crashes, 1); !r.Restart {
+					t.Fatalf("expected crash %d to be restarted, got %+v", n+1, r)
+				}
+			}
+			if r := crash(t, i, crashes, 1); r.Restart || r.Reason == "" {
+				t.Fatalf("expected the last crash not to be restarted, got %+v", r)
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"prismarine/shard/config"
 	"reflect"
 	"strings"
 	"sync"
@@ -74,8 +75,7 @@ func (h *HijackedResponse) CloseWrite() error {
 
 func configure(c *client.Client) {
 	o.Do(func() {
-		// fastEnabled = config.Get().Docker.UsePerformantInspect
-		fastEnabled = true
+		fastEnabled = config.Get().Docker.UsePerformantInspect
 
 		r := reflect.ValueOf(c).Elem()
 		cli.proto = r.FieldByName("proto").String()
@@ -2,10 +2,14 @@ package docker
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"prismarine/shard/config"
 	"prismarine/shard/runtime"
+	"prismarine/shard/runtime/events"
 	"strings"
 	"time"
 
@@ -29,33 +33,110 @@ func (i *Instance) Attach(ctx context.Context) error {
 	}
 
 	// Set the stream again with the container.
-	if st, err := i.client.ContainerAttach(ctx, i.Cfg.Uuid, opts); err != nil {
+	st, err := i.client.ContainerAttach(ctx, i.Cfg.Uuid, opts)
+	if err != nil {
 		return errors.Wrap(err, "runtime/docker: error while attaching to container")
-	} else {
-		i.SetStream(&st)
 	}
+	i.SetStream(&st)
 
 	go func() {
-		// pollCtx, cancel := context.WithCancel(context.Background())
-		// defer cancel()
-		defer i.stream.Close()
+		pollCtx, cancel := context.WithCancel(i.Context())
+		defer cancel()
+		defer st.Close()
+
+		// Close the stream when the instance context is canceled, such as when
+		// the shard shuts down, rather than leaving the read below hanging
+		go func() {
+			<-pollCtx.Done()
+			st.Close()
+		}()
 		defer func() {
 			i.SetState(runtime.ProcessOfflineState)
 			i.SetStream(nil)
 		}()
 
-		//go func() {
-		//	if err := i.
-		//}()
+		go func() {
+			if err := i.pollResources(pollCtx); err != nil {
+				log.
+					With("runtime", "docker").
+					With("instance", i.Id()).
+					Warn("error while polling container resources", "err", err)
+			}
+		}()
+
+		// Block on reading the output stream until the container exits or the
+		// connection is closed, pushing every line out to the log sink, the
+		// startup detector and the log callback
+		if err := scanReader(st.Reader, func(line []byte) {
+			i.Sink(events.LogSink).Push(line)
+			i.Startup.Line(line)
+
+			i.logCallbackMx.RLock()
+			defer i.logCallbackMx.RUnlock()
+			if i.logCallback != nil {
+				i.logCallback(line)
+			}
+		}); err != nil {
+			log.
+				With("runtime", "docker").
+				With("instance", i.Id()).
+				Warn("error while reading from container output stream", "err", err)
+		}
 	}()
 
 	return nil
 }
 
+// scanReader reads lines from the reader and passes each one to the callback
+// until the reader is exhausted. Lines longer than the internal buffer are
+// joined back together, and carriage returns are treated as line breaks since
+// some games emit them to redraw the terminal. The callback receives a copy of
+// each line, so it is safe to retain.
+func scanReader(r io.Reader, callback func(line []byte)) error {
+	br := bufio.NewReader(r)
+
+	var buf bytes.Buffer
+	for {
+		buf.Reset()
+
+		var err error
+		for {
+			var line []byte
+			var isPrefix bool
+			line, isPrefix, err = br.ReadLine()
+			buf.Write(line)
+
+			if !isPrefix || err != nil {
+				break
+			}
+		}
+
+		// Nothing was read before the stream ended, so there is no line to send
+		if err != nil && buf.Len() == 0 {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		for _, l := range bytes.Split(buf.Bytes(), []byte{'\r'}) {
+			out := make([]byte, len(l))
+			copy(out, l)
+			callback(out)
+		}
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
 func (i *Instance) Create() error {
 	log.
 		With("runtime", "docker").
-		With("Instance", i.Id).
+		With("Instance", i.Id()).
 		Debug("Creating Instance")
 
 	ctx := context.Background()
@@ -66,47 +147,71 @@ func (i *Instance) Create() error {
 		return errors.Wrap(err, "runtime/docker: failed to inspect")
 	}
 
-	if err := i.ensureImageExists(i.Cfg.Container.Image); err != nil {
+	cfg := config.Get()
+	snap := i.Cfg.Snapshot()
+	c := snap.Container
+
+	if err := c.Validate(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := checkPolicy(c, cfg.Docker.Policy); err != nil {
+		return err
+	}
+
+	// Files created by the shard must be writable by the container process
+	if uid, gid, ok := numericUser(c.User); ok {
+		i.Filesystem().SetOwner(uid, gid)
+	}
+	if err := i.Filesystem().EnsureRoot(); err != nil {
+		return err
+	}
+
+	if err := i.ensureImageExists(c.Image); err != nil {
 		return errors.WithStack(err)
 	}
 
+	exposed, bindings := portBindings(c, cfg.Docker.Network.Interface)
+
 	conf := &container.Config{
-		Hostname:        "",
+		Hostname:        i.Id(),
 		Domainname:      "",
-		User:            "",
+		User:            c.User,
 		AttachStdin:     true,
 		AttachStdout:    true,
 		AttachStderr:    true,
-		ExposedPorts:    nil,
+		ExposedPorts:    exposed,
 		Tty:             true,
 		OpenStdin:       true,
 		StdinOnce:       false,
-		Env:             nil,
+		Env:             environment(&snap),
 		Cmd:             nil,
 		Healthcheck:     nil,
 		ArgsEscaped:     false,
-		Image:           strings.TrimPrefix(i.Cfg.Container.Image, "~"),
+		Image:           strings.TrimPrefix(c.Image, "~"),
 		Volumes:         nil,
-		WorkingDir:      "",
+		WorkingDir:      dataMountTarget,
 		Entrypoint:      nil,
 		NetworkDisabled: false,
 		OnBuild:         nil,
-		Labels:          nil,
+		Labels:          labels(c),
 		StopSignal:      "",
 		StopTimeout:     nil,
 		Shell:           nil,
 	}
 
-	// Set the user running the container properly depending on what mode we are operating in.
-
 	// Network config
+	network := cfg.Docker.Network
+	dns := network.Dns
+	if len(c.Dns) > 0 {
+		dns = c.Dns
+	}
 
 	hostConf := &container.HostConfig{
 		Binds:           nil,
 		ContainerIDFile: "",
 		LogConfig:       container.LogConfig{},
-		NetworkMode:     "",
-		PortBindings:    nil,
+		NetworkMode:     container.NetworkMode(network.Mode),
+		PortBindings:    bindings,
 		RestartPolicy:   container.RestartPolicy{},
 		AutoRemove:      false,
 		VolumeDriver:    "",
@@ -114,9 +219,9 @@ func (i *Instance) Create() error {
 		ConsoleSize:     [2]uint{},
 		Annotations:     nil,
 		CapAdd:          nil,
-		CapDrop:         nil,
+		CapDrop:         droppedCapabilities,
 		CgroupnsMode:    "",
-		DNS:             nil,
+		DNS:             dns,
 		DNSOptions:      nil,
 		DNSSearch:       nil,
 		ExtraHosts:      nil,
@@ -129,17 +234,17 @@ func (i *Instance) Create() error {
 		Privileged:      false,
 		PublishAllPorts: false,
 		ReadonlyRootfs:  false,
-		SecurityOpt:     nil,
+		SecurityOpt:     []string{"no-new-privileges"},
 		StorageOpt:      nil,
-		Tmpfs:           nil,
+		Tmpfs:           tmpfs(c, cfg.Docker.Policy.TmpfsSize),
 		UTSMode:         "",
 		UsernsMode:      "",
 		ShmSize:         0,
 		Sysctls:         nil,
 		Runtime:         "",
 		Isolation:       "",
-		Resources:       container.Resources{},
-		Mounts:          nil,
+		Resources:       resources(c, cfg.Docker.Policy.PidsLimit),
+		Mounts:          i.mounts(c),
 		MaskedPaths:     nil,
 		ReadonlyPaths:   nil,
 		Init:            nil,
@@ -188,7 +293,7 @@ func (i *Instance) ensureImageExists(image string) error {
 
 				log.
 					With("image", image).
-					With("container_id", i.Id).
+					With("container_id", i.Id()).
 					Warn("unable to pull requested image from remote server, however image exists locally")
 
 				return nil
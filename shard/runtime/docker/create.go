@@ -1,9 +1,11 @@
 package docker
 
 import (
+	"prismarine/shard/config"
+	"sync"
+
 	"github.com/docker/docker/client"
 	"github.com/pkg/errors"
-	"sync"
 )
 
 var (
@@ -14,7 +16,10 @@ var (
 func Create() (*client.Client, error) {
 	var err error
 	_once.Do(func() {
-		_client, err = client.NewClientWithOpts(client.WithAPIVersionNegotiation())
+		_client, err = client.NewClientWithOpts(
+			client.WithHost(config.Get().Docker.Socket),
+			client.WithAPIVersionNegotiation(),
+		)
 	})
 	return _client, errors.Wrap(err, "could not create Docker client")
 }
@@ -0,0 +1,272 @@
+package docker
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// fakeContainer is the state of a container in the fake Docker API
+type fakeContainer struct {
+	running   bool
+	exitCode  int
+	oomKilled bool
+	startedAt string
+	logs      []string
+	// The resources last applied through an update
+	resources *container.Resources
+	// Streams resource usage to clients, which otherwise get an error so
+	// that polling from attached instances ends straight away
+	stats bool
+
+	// Set once a client attaches to the container
+	conn  net.Conn
+	stdin *bufio.Reader
+}
+
+// fakeApi is a minimal stand-in for the Docker Engine API, implementing just
+// the endpoints used by the instance
+type fakeApi struct {
+	mu         sync.Mutex
+	containers map[string]*fakeContainer
+	removed    map[string]removal
+	attached   chan string
+}
+
+// removal records the options a container was removed with
+type removal struct {
+	volumes bool
+	force   bool
+}
+
+var (
+	fakeDocker *fakeApi
+	testClient *client.Client
+
+	containerPath = regexp.MustCompile(`^(?:/v[\d.]+)?/containers/([^/]+)/(json|logs|attach|update|stats)$`)
+	removePath    = regexp.MustCompile(`^(?:/v[\d.]+)?/containers/([^/]+)$`)
+)
+
+// The inspect function caches the address of the first Docker client it sees,
+// so every test shares the same fake API
+func TestMain(m *testing.M) {
+	fakeDocker = &fakeApi{
+		containers: make(map[string]*fakeContainer),
+		removed:    make(map[string]removal),
+		attached:   make(chan string, 10),
+	}
+	srv := httptest.NewServer(fakeDocker)
+
+	var err error
+	testClient, err = client.NewClientWithOpts(
+		client.WithHost("tcp://"+srv.Listener.Addr().String()),
+		client.WithVersion("1.44"),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	srv.Close()
+	os.Exit(code)
+}
+
+func (f *fakeApi) add(id string, c *fakeContainer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.containers[id] = c
+}
+
+func (f *fakeApi) get(id string) (*fakeContainer, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.containers[id]
+	return c, ok
+}
+
+func (f *fakeApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m := removePath.FindStringSubmatch(r.URL.Path); m != nil && r.Method == http.MethodDelete {
+		f.remove(w, r, m[1])
+		return
+	}
+
+	m := containerPath.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	c, ok := f.get(m[1])
+	if !ok {
+		notFound(w, m[1])
+		return
+	}
+
+	switch m[2] {
+	case "json":
+		f.inspect(w, m[1], c)
+	case "logs":
+		f.logs(w, r, c)
+	case "attach":
+		f.attach(w, m[1], c)
+	case "update":
+		f.update(w, r, c)
+	case "stats":
+		f.stats(w, r, c)
+	}
+}
+
+func notFound(w http.ResponseWriter, id string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	_ = json.NewEncoder(w).Encode(types.ErrorResponse{Message: "No such container: " + id})
+}
+
+func (f *fakeApi) inspect(w http.ResponseWriter, id string, c *fakeContainer) {
+	f.mu.Lock()
+	st := types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID: id,
+			State: &types.ContainerState{
+				Running:   c.running,
+				ExitCode:  c.exitCode,
+				OOMKilled: c.oomKilled,
+				StartedAt: c.startedAt,
+			},
+		},
+	}
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(st)
+}
+
+func (f *fakeApi) logs(w http.ResponseWriter, r *http.Request, c *fakeContainer) {
+	f.mu.Lock()
+	lines := c.logs
+	f.mu.Unlock()
+
+	if tail := r.URL.Query().Get("tail"); tail != "" && tail != "all" {
+		if n, err := strconv.Atoi(tail); err == nil && n < len(lines) {
+			lines = lines[len(lines)-n:]
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+	for _, l := range lines {
+		_, _ = w.Write([]byte(l + "\r\n"))
+	}
+}
+
+func (f *fakeApi) remove(w http.ResponseWriter, r *http.Request, id string) {
+	if _, ok := f.get(id); !ok {
+		notFound(w, id)
+		return
+	}
+
+	f.mu.Lock()
+	delete(f.containers, id)
+	f.removed[id] = removal{
+		volumes: r.URL.Query().Get("v") == "1",
+		force:   r.URL.Query().Get("force") == "1",
+	}
+	f.mu.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// stats streams a sample of resource usage every millisecond until the client
+// disconnects
+func (f *fakeApi) stats(w http.ResponseWriter, r *http.Request, c *fakeContainer) {
+	f.mu.Lock()
+	enabled := c.stats
+	f.mu.Unlock()
+	if !enabled {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+
+	var total uint64
+	for {
+		prev := types.CPUStats{CPUUsage: types.CPUUsage{TotalUsage: total}, SystemUsage: total * 10}
+		total += 1000
+		v := types.StatsJSON{Stats: types.Stats{
+			PreCPUStats: prev,
+			CPUStats: types.CPUStats{
+				CPUUsage:    types.CPUUsage{TotalUsage: total},
+				SystemUsage: total * 10,
+				OnlineCPUs:  2,
+			},
+			MemoryStats: types.MemoryStats{Usage: 1024, Limit: 4096},
+		}}
+		if err := enc.Encode(v); err != nil {
+			return
+		}
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// update records the resources a container was updated with
+func (f *fakeApi) update(w http.ResponseWriter, r *http.Request, c *fakeContainer) {
+	var body container.UpdateConfig
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	c.resources = &body.Resources
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(container.ContainerUpdateOKBody{})
+}
+
+// attach hijacks the connection the same way the Docker daemon does, and
+// keeps it around so the tests can write output and read stdin
+func (f *fakeApi) attach(w http.ResponseWriter, id string, c *fakeContainer) {
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		panic(err)
+	}
+
+	_, _ = conn.Write([]byte("HTTP/1.1 101 UPGRADED\r\n" +
+		"Content-Type: application/vnd.docker.raw-stream\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Upgrade: tcp\r\n\r\n"))
+
+	f.mu.Lock()
+	c.conn = conn
+	c.stdin = rw.Reader
+	f.mu.Unlock()
+
+	f.attached <- id
+}
+
+// readStdin reads a single line written to the attached container
+func (c *fakeContainer) readStdin() (string, error) {
+	line, err := c.stdin.ReadString('\n')
+	return strings.TrimSuffix(line, "\n"), err
+}
@@ -0,0 +1,293 @@
+package docker
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"prismarine/shard/config"
+	"prismarine/shard/runtime"
+	"prismarine/shard/runtime/events"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+const (
+	// installDataTarget is where the data directory is mounted within the
+	// install container
+	installDataTarget = "/mnt/server"
+	// installScriptTarget is where the directory holding the install script
+	// is mounted within the install container
+	installScriptTarget = "/mnt/install"
+	installScriptName   = "install.sh"
+)
+
+// installContainerName returns the name of the one-shot install container
+func (i *Instance) installContainerName() string {
+	return i.Id() + "_installer"
+}
+
+// Install runs the install script in a one-shot container, blocking until it
+// exits. The output is pushed to the install sink and written to a log file.
+// Canceling the context or calling CancelInstall kills the container.
+func (i *Instance) Install(ctx context.Context) (err error) {
+	snap := i.Cfg.Snapshot()
+	script := snap.Install
+	if script == nil {
+		return runtime.ErrNoInstallScript
+	}
+
+	// The install is claimed before anything else is checked, so that nothing
+	// can start the instance in between. The powerlock is held for the whole
+	// install so that a power action already under way is refused rather than
+	// overlapping with it.
+	if !i.Installing.SwapIf(true) {
+		return runtime.ErrInstanceInstalling
+	}
+	defer i.Installing.Store(false)
+	if err := i.Powerlock.Acquire(); err != nil {
+		return err
+	}
+	defer i.Powerlock.Release()
+
+	if i.Restoring.Load() {
+		return runtime.ErrInstanceRestoring
+	} else if i.Transferring.Load() {
+		return runtime.ErrInstanceTransferring
+	}
+	if i.State() != runtime.ProcessOfflineState {
+		return runtime.ErrInstanceRunning
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	i.installMu.Lock()
+	i.installCancel = cancel
+	i.installMu.Unlock()
+	defer func() {
+		i.installMu.Lock()
+		i.installCancel = nil
+		i.installMu.Unlock()
+		cancel()
+	}()
+
+	i.Events().Publish(runtime.InstallStartedEvent, "")
+	defer func() {
+		i.Events().Publish(runtime.InstallCompletedEvent, err == nil)
+	}()
+
+	l := log.With("runtime", "docker").With("instance", i.Id())
+	l.Info("running install script", "image", script.Image)
+
+	if err := i.runInstall(ctx, &snap); err != nil {
+		l.Warn("install script failed", "err", err)
+		return err
+	}
+
+	l.Info("install script completed")
+	return nil
+}
+
+// Reinstall stops the instance if it is running and then runs the install
+// script again. Files in the data directory are left in place.
+func (i *Instance) Reinstall(ctx context.Context) error {
+	if i.State() != runtime.ProcessOfflineState {
+		if err := i.WaitForStop(ctx, time.Minute*10, true, false, 0); err != nil {
+			return err
+		}
+	}
+	return i.Install(ctx)
+}
+
+// CancelInstall kills the install container if an installation is running
+func (i *Instance) CancelInstall() {
+	i.installMu.Lock()
+	defer i.installMu.Unlock()
+	if i.installCancel != nil {
+		i.installCancel()
+	}
+}
+
+// runInstall runs the install script of the configuration, which must be a
+// snapshot
+func (i *Instance) runInstall(ctx context.Context, snap *runtime.Configuration) error {
+	cfg := config.Get()
+	script := snap.Install
+	c := snap.Container
+
+	dir := filepath.Join(cfg.System.RootDirectory, "install", i.Id())
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return errors.Wrap(err, "runtime/docker: failed to create install directory")
+	}
+	defer os.RemoveAll(dir)
+
+	// Scripts edited on Windows would fail on the carriage returns
+	body := strings.ReplaceAll(script.Script, "\r\n", "\n")
+	if err := os.WriteFile(filepath.Join(dir, installScriptName), []byte(body), 0o644); err != nil {
+		return errors.Wrap(err, "runtime/docker: failed to write install script")
+	}
+
+	logFile, err := i.openInstallLog(cfg.System.LogDirectory)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	// The install script runs as root, so hand everything it creates to the
+	// user the instance runs as once it is done
+	if uid, gid, ok := numericUser(c.User); ok {
+		i.Filesystem().SetOwner(uid, gid)
+	}
+	if err := i.Filesystem().EnsureRoot(); err != nil {
+		return err
+	}
+
+	if err := i.ensureImageExists(script.Image); err != nil {
+		return errors.WithStack(err)
+	}
+
+	name := i.installContainerName()
+	if err := i.removeInstallContainer(); err != nil {
+		return err
+	}
+
+	entrypoint := script.Entrypoint
+	if entrypoint == "" {
+		entrypoint = "sh"
+	}
+
+	conf := &container.Config{
+		Hostname:     "installer",
+		AttachStdout: true,
+		AttachStderr: true,
+		Tty:          true,
+		OpenStdin:    false,
+		Env:          environment(snap),
+		Image:        strings.TrimPrefix(script.Image, "~"),
+		WorkingDir:   installDataTarget,
+		Entrypoint:   []string{entrypoint, installScriptTarget + "/" + installScriptName},
+		Labels: map[string]string{
+			"Service":       "Prismarine",
+			"ContainerType": "server_installer",
+		},
+	}
+
+	dns := cfg.Docker.Network.Dns
+	if len(c.Dns) > 0 {
+		dns = c.Dns
+	}
+	pidsLimit := c.Limits.PidsLimit
+	if pidsLimit == 0 {
+		pidsLimit = cfg.Docker.Policy.PidsLimit
+	}
+
+	hostConf := &container.HostConfig{
+		NetworkMode: container.NetworkMode(cfg.Docker.Network.Mode),
+		DNS:         dns,
+		Mounts: []mount.Mount{
+			{
+				Type:   mount.TypeBind,
+				Source: i.Filesystem().Path(),
+				Target: installDataTarget,
+			},
+			{
+				Type:     mount.TypeBind,
+				Source:   dir,
+				Target:   installScriptTarget,
+				ReadOnly: true,
+			},
+		},
+		Tmpfs: map[string]string{
+			"/tmp": "rw,exec,nosuid,size=" + strconv.FormatInt(cfg.Docker.Policy.TmpfsSize, 10) + "M",
+		},
+		SecurityOpt: []string{"no-new-privileges"},
+		Resources: container.Resources{
+			Memory:     c.Limits.MemoryBytes(),
+			MemorySwap: c.Limits.SwapBytes(),
+			CPUQuota:   c.Limits.CpuLimit * 1000,
+			CPUPeriod:  100_000,
+			PidsLimit:  &pidsLimit,
+		},
+	}
+
+	if _, err := i.client.ContainerCreate(ctx, conf, hostConf, nil, nil, name); err != nil {
+		return errors.Wrap(err, "runtime/docker: failed to create install container")
+	}
+	// Removing the container also kills it if the install was canceled
+	defer func() {
+		if err := i.removeInstallContainer(); err != nil {
+			log.With("runtime", "docker").With("instance", i.Id()).Warn("failed to remove install container", "err", err)
+		}
+	}()
+
+	if err := i.client.ContainerStart(ctx, name, container.StartOptions{}); err != nil {
+		return errors.Wrap(err, "runtime/docker: failed to start install container")
+	}
+
+	logs, err := i.client.ContainerLogs(ctx, name, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+	})
+	if err != nil {
+		return errors.Wrap(err, "runtime/docker: failed to read install container output")
+	}
+	defer logs.Close()
+
+	// Following the logs ends when the container exits or the context is
+	// canceled, either of which is handled by waiting below
+	_ = scanReader(logs, func(line []byte) {
+		i.Sink(events.InstallSink).Push(line)
+		_, _ = logFile.Write(append(line, '\n'))
+	})
+
+	waitCh, errCh := i.client.ContainerWait(ctx, name, container.WaitConditionNotRunning)
+	select {
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "runtime/docker: install was canceled")
+	case err := <-errCh:
+		if ctx.Err() != nil {
+			return errors.Wrap(ctx.Err(), "runtime/docker: install was canceled")
+		}
+		return errors.Wrap(err, "runtime/docker: failed to wait for install container")
+	case res := <-waitCh:
+		if res.StatusCode != 0 {
+			return errors.Errorf("runtime/docker: install script exited with code %d", res.StatusCode)
+		}
+	}
+
+	return i.Filesystem().ChownAll()
+}
+
+// openInstallLog truncates the install log file of the instance and opens it
+// for writing
+func (i *Instance) openInstallLog(logDirectory string) (*os.File, error) {
+	dir := filepath.Join(logDirectory, "install")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, errors.Wrap(err, "runtime/docker: failed to create install log directory")
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, i.Id()+".log"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, errors.Wrap(err, "runtime/docker: failed to open install log")
+	}
+	return f, nil
+}
+
+// removeInstallContainer forcefully removes the install container, killing it
+// if it is still running
+func (i *Instance) removeInstallContainer() error {
+	err := i.client.ContainerRemove(context.Background(), i.installContainerName(), container.RemoveOptions{
+		RemoveVolumes: true,
+		Force:         true,
+	})
+	if err != nil && !client.IsErrNotFound(err) {
+		return errors.Wrap(err, "runtime/docker: failed to remove install container")
+	}
+	return nil
+}
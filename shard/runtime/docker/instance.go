@@ -4,12 +4,20 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
+	"prismarine/shard/config"
 	"prismarine/shard/runtime"
 	"prismarine/shard/runtime/events"
+	"prismarine/shard/runtime/filesystem"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/charmbracelet/log"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
 )
 
 // Ensure that the Docker runtime is implementing all methods from
@@ -28,15 +36,26 @@ type Instance struct {
 
 	state *runtime.AtomicString
 
-	emitter *events.Bus
+	// Called with every line of output read from the attached stream
+	logCallbackMx sync.RWMutex
+	logCallback   func([]byte)
+
+	// Cancels the running installation, if there is one
+	installMu     sync.Mutex
+	installCancel context.CancelFunc
 }
 
-func New(config *runtime.Configuration) (*Instance, error) {
+func New(cfg *runtime.Configuration) (*Instance, error) {
 	cli, err := Create()
 	if err != nil {
 		return nil, err
 	}
 
+	return newInstance(cfg, cli), nil
+}
+
+// newInstance creates an instance using the given Docker client
+func newInstance(cfg *runtime.Configuration, cli *client.Client) *Instance {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	i := &Instance{
@@ -44,16 +63,22 @@ func New(config *runtime.Configuration) (*Instance, error) {
 			Ctx:       ctx,
 			CtxCancel: &cancel,
 
-			Cfg: config,
+			Cfg: cfg,
 
 			Transferring: runtime.NewAtomicBool(false),
 			Restoring:    runtime.NewAtomicBool(false),
 			Installing:   runtime.NewAtomicBool(false),
 
+			PendingRestart: runtime.NewAtomicBool(false),
+
 			Powerlock: runtime.NewLocker(),
 
-			Events: &events.Bus{
-				SinkPool: events.NewSinkPool(),
+			Fs: filesystem.New(filepath.Join(config.Get().System.DataDirectory, cfg.Uuid)),
+
+			Events: events.NewBus(),
+			Sinks: map[events.SinkName]*events.SinkPool{
+				events.LogSink:     events.NewSinkPool(),
+				events.InstallSink: events.NewSinkPool(),
 			},
 
 			Log: log.New(os.Stderr),
@@ -62,8 +87,15 @@ func New(config *runtime.Configuration) (*Instance, error) {
 
 		state: runtime.NewAtomicString(runtime.ProcessOfflineState),
 	}
+	i.Crash = runtime.NewCrashHandler(i)
+	i.Startup = runtime.NewStartupDetector(i)
+
+	i.Fs.SetDiskCheckInterval(time.Duration(config.Get().System.DiskCheckInterval) * time.Second)
+	if cfg.Container != nil {
+		i.Fs.SetDiskLimit(cfg.Container.Limits.DiskBytes())
+	}
 
-	return i, nil
+	return i
 }
 
 // Type returns the type of Environment that that Instance is in
@@ -106,7 +138,7 @@ func (i *Instance) State() string {
 
 // Events returns an event bus for the instance
 func (i *Instance) Events() *events.Bus {
-	return i.emitter
+	return i.RuntimeInstance.Events
 }
 
 // IsAttached determines if this process is currently attached to
@@ -155,26 +187,108 @@ func (i *Instance) Context() context.Context {
 	return i.Ctx
 }
 
+// Destroy removes the container and any anonymous volumes attached to it. If
+// the container is running it is killed first.
 func (i *Instance) Destroy() error {
-	panic("Not implimented")
+	// Set to stopping first to prevent crash detection
+	i.SetState(runtime.ProcessStoppingState)
+
+	err := i.client.ContainerRemove(context.Background(), i.Cfg.Uuid, container.RemoveOptions{
+		RemoveVolumes: true,
+		RemoveLinks:   false,
+		Force:         true,
+	})
+
+	i.SetState(runtime.ProcessOfflineState)
+
+	// Don't trigger an error if the container has already been removed
+	if err != nil && !client.IsErrNotFound(err) {
+		return errors.Wrap(err, "runtime/docker: failed to remove container")
+	}
+	return nil
 }
 
+// ExitState returns the exit code of the container process and whether it was
+// killed by the kernel for running out of memory. If the container no longer
+// exists it is treated as having exited with an error.
 func (i *Instance) ExitState() (uint32, bool, error) {
-	panic("not implimented")
+	c, err := i.ContainerInspect(context.Background())
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return 1, false, nil
+		}
+		return 0, false, errors.Wrap(err, "runtime/docker: failed to inspect container")
+	}
+
+	return uint32(c.State.ExitCode), c.State.OOMKilled, nil
 }
 
+// ReadLog returns up to the given number of lines from the end of the
+// container logs
 func (i *Instance) ReadLog(depth int) ([]string, error) {
-	panic("Not implimented")
+	r, err := i.client.ContainerLogs(context.Background(), i.Cfg.Uuid, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       strconv.Itoa(depth),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "runtime/docker: failed to read container logs")
+	}
+	defer r.Close()
+
+	var out []string
+	if err := scanReader(r, func(line []byte) {
+		out = append(out, string(line))
+	}); err != nil {
+		return nil, errors.Wrap(err, "runtime/docker: failed to read container logs")
+	}
+
+	return out, nil
 }
 
+// SendCommand writes a command to the stdin of the attached container. The
+// instance must be attached for the command to be sent
 func (i *Instance) SendCommand(cmd string) error {
-	panic("not implimented")
+	// The write can block for as long as the process is not reading its
+	// input, so it happens without the lock held to avoid blocking anything
+	// replacing the stream. Writes to the connection are safe to make from
+	// several goroutines at once.
+	i.RLock()
+	stream := i.stream
+	i.RUnlock()
+
+	if stream == nil {
+		return runtime.ErrNotAttached
+	}
+
+	if _, err := stream.Conn.Write([]byte(cmd + "\n")); err != nil {
+		return errors.Wrap(err, "runtime/docker: could not write to container stream")
+	}
+	return nil
 }
 
-func (i *Instance) SetLogCallback(func([]byte)) {
-	panic("Not implimented")
+// SetLogCallback sets the function that every line of output read from the
+// attached container is passed to
+func (i *Instance) SetLogCallback(f func([]byte)) {
+	i.logCallbackMx.Lock()
+	defer i.logCallbackMx.Unlock()
+	i.logCallback = f
 }
 
+// Uptime returns how long the container has been running in milliseconds, or
+// zero if it is not running
 func (i *Instance) Uptime(ctx context.Context) (int64, error) {
-	panic("not implimented")
+	c, err := i.ContainerInspect(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "runtime/docker: failed to inspect container")
+	}
+	if !c.State.Running {
+		return 0, nil
+	}
+
+	started, ok := startedAt(c)
+	if !ok {
+		return 0, nil
+	}
+	return time.Since(started).Milliseconds(), nil
 }
@@ -0,0 +1,452 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"prismarine/shard/runtime"
+	"prismarine/shard/runtime/filesystem"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+func newTestInstance(t *testing.T, id string, c *fakeContainer) *Instance {
+	t.Helper()
+	if c != nil {
+		fakeDocker.add(id, c)
+	}
+	return newInstance(&runtime.Configuration{
+		RWMutex:   &sync.RWMutex{},
+		Uuid:      id,
+		Container: &runtime.Container{Image: "busybox"},
+	}, testClient)
+}
+
+// attach attaches the instance to the fake container and waits for the fake
+// API to have hijacked the connection
+func attach(t *testing.T, i *Instance) *fakeContainer {
+	t.Helper()
+	if err := i.Attach(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-fakeDocker.attached:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for attach")
+	}
+	c, _ := fakeDocker.get(i.Id())
+	return c
+}
+
+func TestInstance_SendCommand(t *testing.T) {
+	i := newTestInstance(t, "send-command", &fakeContainer{running: true})
+
+	if err := i.SendCommand("say hello"); err != runtime.ErrNotAttached {
+		t.Fatalf("expected ErrNotAttached before attaching, got %v", err)
+	}
+
+	c := attach(t, i)
+	if err := i.SendCommand("say hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	line, err := c.readStdin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "say hello" {
+		t.Fatalf("expected command %q on stdin, got %q", "say hello", line)
+	}
+}
+
+func TestInstance_SendCommandBlocked(t *testing.T) {
+	i := newTestInstance(t, "send-command-blocked", &fakeContainer{})
+
+	// Nothing reads from the other end of the pipe, so the write blocks
+	conn, other := net.Pipe()
+	defer other.Close()
+	i.SetStream(&types.HijackedResponse{Conn: conn})
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- i.SendCommand("say hello")
+	}()
+
+	detached := make(chan struct{})
+	go func() {
+		defer close(detached)
+		i.SetStream(nil)
+	}()
+	select {
+	case <-detached:
+	case <-time.After(time.Second):
+		t.Fatal("expected a blocked command not to hold the lock")
+	}
+
+	_ = conn.Close()
+	if err := <-sent; err == nil {
+		t.Fatal("expected the write to fail once the stream is closed")
+	}
+}
+
+func TestInstance_SetLogCallback(t *testing.T) {
+	i := newTestInstance(t, "log-callback", &fakeContainer{running: true})
+
+	lines := make(chan string, 10)
+	i.SetLogCallback(func(b []byte) {
+		lines <- string(b)
+	})
+
+	c := attach(t, i)
+	if _, err := c.conn.Write([]byte("first line\r\nsecond\rline\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"first line", "second", "line"} {
+		select {
+		case got := <-lines:
+			if got != want {
+				t.Fatalf("expected line %q, got %q", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for line %q", want)
+		}
+	}
+
+	// Closing the stream should detach the instance
+	_ = c.conn.Close()
+	deadline := time.Now().Add(time.Second)
+	for i.IsAttached() {
+		if time.Now().After(deadline) {
+			t.Fatal("instance still attached after the stream closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInstance_ReadLog(t *testing.T) {
+	i := newTestInstance(t, "read-log", &fakeContainer{
+		logs: []string{"one", "two", "three", "four"},
+	})
+
+	lines, err := i.ReadLog(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 || lines[0] != "three" || lines[1] != "four" {
+		t.Fatalf("unexpected log lines %q", lines)
+	}
+}
+
+func TestInstance_ExitState(t *testing.T) {
+	i := newTestInstance(t, "exit-state", &fakeContainer{exitCode: 137, oomKilled: true})
+
+	code, oom, err := i.ExitState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 137 || !oom {
+		t.Fatalf("expected exit code 137 and oom killed, got %d and %t", code, oom)
+	}
+}
+
+func TestInstance_ExitStateMissingContainer(t *testing.T) {
+	i := newTestInstance(t, "exit-state-missing", nil)
+
+	code, oom, err := i.ExitState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 1 || oom {
+		t.Fatalf("expected exit code 1 for a missing container, got %d and %t", code, oom)
+	}
+}
+
+func TestInstance_Uptime(t *testing.T) {
+	started := time.Now().Add(-time.Minute)
+	i := newTestInstance(t, "uptime", &fakeContainer{
+		running:   true,
+		startedAt: started.UTC().Format(time.RFC3339Nano),
+	})
+
+	up, err := i.Uptime(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up < time.Minute.Milliseconds() || up > (time.Minute+10*time.Second).Milliseconds() {
+		t.Fatalf("unexpected uptime %dms", up)
+	}
+
+	stopped := newTestInstance(t, "uptime-stopped", &fakeContainer{
+		startedAt: started.UTC().Format(time.RFC3339Nano),
+	})
+	if up, err := stopped.Uptime(context.Background()); err != nil || up != 0 {
+		t.Fatalf("expected no uptime for a stopped container, got %d (%v)", up, err)
+	}
+}
+
+func TestInstance_Destroy(t *testing.T) {
+	i := newTestInstance(t, "destroy", &fakeContainer{running: true})
+
+	if err := i.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+
+	fakeDocker.mu.Lock()
+	r, ok := fakeDocker.removed["destroy"]
+	fakeDocker.mu.Unlock()
+	if !ok {
+		t.Fatal("expected container to be removed")
+	}
+	if !r.volumes || !r.force {
+		t.Fatalf("expected container to be force removed with volumes, got %+v", r)
+	}
+	if i.State() != runtime.ProcessOfflineState {
+		t.Fatalf("expected offline state, got %s", i.State())
+	}
+
+	// Destroying a container that no longer exists is not an error
+	if err := i.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInstance_Update(t *testing.T) {
+	i := newTestInstance(t, "update", &fakeContainer{running: true})
+
+	cfg := &runtime.Configuration{
+		RWMutex: &sync.RWMutex{},
+		Uuid:    "update",
+		Container: &runtime.Container{
+			Image:  "busybox",
+			Limits: runtime.Limits{MemoryLimit: 512, CpuLimit: 150},
+		},
+	}
+	diff, err := i.Update(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.Limits || diff.RequiresRestart() || i.IsPendingRestart() {
+		t.Fatalf("expected only a live limit change, got %+v", diff)
+	}
+
+	c, _ := fakeDocker.get("update")
+	fakeDocker.mu.Lock()
+	res := c.resources
+	fakeDocker.mu.Unlock()
+	if res == nil {
+		t.Fatal("expected the container resources to be updated")
+	}
+	if res.Memory != 512*1024*1024 || res.CPUQuota != 150_000 {
+		t.Fatalf("unexpected resources %+v", res)
+	}
+
+	cfg = &runtime.Configuration{
+		RWMutex: &sync.RWMutex{},
+		Uuid:    "update",
+		Container: &runtime.Container{
+			Image:  "alpine",
+			Ports:  []runtime.PortAllocation{{Port: 25565}},
+			Limits: runtime.Limits{MemoryLimit: 512, CpuLimit: 150},
+		},
+	}
+	diff, err = i.Update(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.Limits || len(diff.PendingRestart) != 2 || !i.IsPendingRestart() {
+		t.Fatalf("expected the image and ports to be pending, got %+v", diff)
+	}
+	if i.Config().Snapshot().Container.Image != "alpine" {
+		t.Fatalf("expected the configuration to be replaced, got image %s", i.Config().Snapshot().Container.Image)
+	}
+}
+
+func TestInstance_PreflightFailureKeepsPending(t *testing.T) {
+	// The container cannot be created again once it has been removed
+	i := newTestInstance(t, "preflight-failure", &fakeContainer{})
+	i.PendingRestart.Store(true)
+
+	if err := i.Preflight(context.Background()); err == nil {
+		t.Fatal("expected the container not to be recreated")
+	}
+	if !i.IsPendingRestart() {
+		t.Fatal("expected the changes to still be pending")
+	}
+}
+
+func TestInstance_UpdateMissingContainer(t *testing.T) {
+	i := newTestInstance(t, "update-missing", nil)
+
+	cfg := &runtime.Configuration{
+		RWMutex: &sync.RWMutex{},
+		Uuid:    "update-missing",
+		Container: &runtime.Container{
+			Image:  "busybox",
+			Limits: runtime.Limits{MemoryLimit: 256},
+		},
+	}
+	if _, err := i.Update(context.Background(), cfg); err != nil {
+		t.Fatalf("expected the limits to be left for the next create, got %v", err)
+	}
+	if i.Config().Snapshot().Container.Limits.MemoryLimit != 256 {
+		t.Fatal("expected the configuration to be replaced")
+	}
+}
+
+func TestInstance_UpdateWhileStatsPolling(t *testing.T) {
+	i := newTestInstance(t, "update-stats", &fakeContainer{
+		running:   true,
+		startedAt: time.Now().Format(time.RFC3339),
+		stats:     true,
+	})
+	i.Fs = filesystem.New(t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- i.pollResources(ctx) }()
+
+	for n := 0; n < 50; n++ {
+		cfg := &runtime.Configuration{
+			RWMutex: &sync.RWMutex{},
+			Uuid:    "update-stats",
+			Container: &runtime.Container{
+				Image:  "busybox",
+				Limits: runtime.Limits{CpuLimit: int64(100 + n)},
+			},
+		}
+		if _, err := i.Update(context.Background(), cfg); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if limit := i.Config().Snapshot().Container.Limits.CpuLimit; limit != 149 {
+		t.Fatalf("expected the last update to win, got a cpu limit of %d", limit)
+	}
+}
+
+func TestInstance_StatsUnknownStart(t *testing.T) {
+	i := newTestInstance(t, "stats-unknown-start", &fakeContainer{
+		running: true,
+		// What Docker reports before the container has been started
+		startedAt: "0001-01-01T00:00:00Z",
+		stats:     true,
+	})
+	i.Fs = filesystem.New(t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- i.pollResources(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for i.Stats().Memory == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for stats")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if uptime := i.Stats().Uptime; uptime != 0 {
+		t.Fatalf("expected no uptime before the start time is known, got %d", uptime)
+	}
+	if uptime, err := i.Uptime(context.Background()); err != nil || uptime != 0 {
+		t.Fatalf("expected no uptime before the start time is known, got %d (%v)", uptime, err)
+	}
+
+	// The start time is looked up again once Docker has recorded it
+	fakeDocker.mu.Lock()
+	fakeDocker.containers["stats-unknown-start"].startedAt = time.Now().Add(-time.Hour).Format(time.RFC3339)
+	fakeDocker.mu.Unlock()
+
+	deadline = time.Now().Add(time.Second)
+	for i.Stats().Uptime < time.Hour.Milliseconds() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected an uptime of an hour, got %d", i.Stats().Uptime)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestInstance_StartWhileClaimed(t *testing.T) {
+	i := newTestInstance(t, "start-claimed", &fakeContainer{})
+
+	i.SetRestoring(true)
+	if err := i.Start(context.Background(), false, 0); err != runtime.ErrInstanceRestoring {
+		t.Fatalf("expected ErrInstanceRestoring, got %v", err)
+	}
+	if err := i.Terminate(context.Background(), os.Kill, false, 0); err != runtime.ErrInstanceRestoring {
+		t.Fatalf("expected other power actions to be refused, got %v", err)
+	}
+	// The restore itself gets past its claim to stop the instance
+	if err := i.Terminate(context.Background(), os.Kill, true, 0); err != nil {
+		t.Fatalf("expected the claim to be bypassed, got %v", err)
+	}
+	if i.SetRestoring(true) {
+		t.Fatal("expected the restore to only be claimed once")
+	}
+	i.SetRestoring(false)
+
+	i.SetTransferring(true)
+	if err := i.Start(context.Background(), false, 0); err != runtime.ErrInstanceTransferring {
+		t.Fatalf("expected ErrInstanceTransferring, got %v", err)
+	}
+}
+
+func TestInstance_InstallClaimsFirst(t *testing.T) {
+	i := newTestInstance(t, "install-claim", &fakeContainer{})
+	i.Cfg.Install = &runtime.InstallScript{Image: "alpine", Script: "true"}
+
+	// A power action that is already under way keeps the install from running
+	if err := i.Powerlock.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Install(context.Background()); !errors.Is(err, runtime.ErrLockerLocked) {
+		t.Fatalf("expected ErrLockerLocked, got %v", err)
+	}
+	i.Powerlock.Release()
+	if i.IsInstalling() {
+		t.Fatal("expected the install to be released when refused")
+	}
+
+	i.SetState(runtime.ProcessStartingState)
+	if err := i.Install(context.Background()); err != runtime.ErrInstanceRunning {
+		t.Fatalf("expected ErrInstanceRunning, got %v", err)
+	}
+	if i.IsInstalling() || i.Powerlock.IsLocked() {
+		t.Fatal("expected the install and powerlock to be released when refused")
+	}
+}
+
+func TestInstance_RestartWaitsForLock(t *testing.T) {
+	i := newTestInstance(t, "restart-locked", &fakeContainer{})
+	if err := i.Powerlock.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	defer i.Powerlock.Release()
+
+	if err := i.Restart(context.Background(), 0); !errors.Is(err, runtime.ErrLockerLocked) {
+		t.Fatalf("expected ErrLockerLocked without waiting, got %v", err)
+	}
+
+	began := time.Now()
+	if err := i.Restart(context.Background(), 1); err == nil {
+		t.Fatal("expected the restart to fail while the lock is held")
+	}
+	if waited := time.Since(began); waited < time.Second {
+		t.Fatalf("expected the restart to wait for the lock, gave up after %s", waited)
+	}
+}
@@ -0,0 +1,114 @@
+package docker
+
+import (
+	"path/filepath"
+	"prismarine/shard/config"
+	"prismarine/shard/runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// blockedMountTargets are container paths that can never be mounted over
+var blockedMountTargets = []string{"/", "/proc", "/sys", "/dev", dataMountTarget}
+
+// blockedMountSources are host paths that can never be mounted into a
+// container, even if they are within an allowed mount
+var blockedMountSources = []string{"/var/run/docker.sock", "/run/docker.sock"}
+
+// checkPolicy ensures that the container settings are allowed by the host
+// before anything is passed to Docker
+func checkPolicy(c *runtime.Container, p config.ContainerPolicy) error {
+	if !p.AllowRootUser && c.User != "" {
+		uid := strings.SplitN(c.User, ":", 2)[0]
+		if uid == "0" || uid == "root" {
+			return errors.New("runtime/docker: policy does not allow running as root")
+		}
+	}
+
+	if !p.AllowPrivilegedPorts {
+		for _, port := range c.Ports {
+			if port.Port < 1024 {
+				return errors.Errorf("runtime/docker: policy does not allow binding privileged port %d", port.Port)
+			}
+		}
+	}
+
+	if p.PidsLimit > 0 && c.Limits.PidsLimit > p.PidsLimit {
+		return errors.Errorf("runtime/docker: pids limit %d exceeds the maximum of %d", c.Limits.PidsLimit, p.PidsLimit)
+	}
+
+	for target, opts := range c.Tmpfs {
+		if err := checkTarget(target); err != nil {
+			return err
+		}
+		for _, opt := range strings.Split(opts, ",") {
+			if o := strings.TrimSpace(opt); o == "suid" || o == "dev" {
+				return errors.Errorf("runtime/docker: policy does not allow tmpfs option %s on %s", o, target)
+			}
+		}
+	}
+
+	for _, m := range c.Mounts {
+		if err := checkMount(m, p.AllowedMounts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkTarget ensures that nothing is mounted over a path the container
+// relies on
+func checkTarget(target string) error {
+	t := filepath.Clean(target)
+	for _, b := range blockedMountTargets {
+		if t == b || (b != "/" && isWithin(t, b)) {
+			return errors.Errorf("runtime/docker: policy does not allow mounting to %s", target)
+		}
+	}
+	return nil
+}
+
+// checkMount ensures that the mount target is not blocked and that the source
+// is within an allowed directory. Symbolic links in the source are resolved
+// first, as Docker follows them when creating the bind mount.
+func checkMount(m runtime.Mount, allowed []string) error {
+	if err := checkTarget(m.Target); err != nil {
+		return err
+	}
+
+	source, err := filepath.EvalSymlinks(m.Source)
+	if err != nil {
+		return errors.Wrapf(err, "runtime/docker: failed to resolve mount source %s", m.Source)
+	}
+	for _, b := range blockedMountSources {
+		if source == b || source == resolve(b) {
+			return errors.Errorf("runtime/docker: policy does not allow mounting %s", m.Source)
+		}
+	}
+
+	for _, a := range allowed {
+		if isWithin(source, resolve(a)) {
+			return nil
+		}
+	}
+	return errors.Errorf("runtime/docker: policy does not allow mounting %s", m.Source)
+}
+
+// resolve returns the path with any symbolic links resolved, or the cleaned
+// path if it cannot be resolved
+func resolve(path string) string {
+	if r, err := filepath.EvalSymlinks(path); err == nil {
+		return r
+	}
+	return filepath.Clean(path)
+}
+
+// isWithin determines if the path is the directory or inside of it
+func isWithin(path, dir string) bool {
+	if path == dir {
+		return true
+	}
+	return strings.HasPrefix(path, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
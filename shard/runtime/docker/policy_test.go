@@ -0,0 +1,103 @@
+package docker
+
+import (
+	"os"
+	"path/filepath"
+	"prismarine/shard/config"
+	"prismarine/shard/runtime"
+	"testing"
+)
+
+func TestCheckPolicy(t *testing.T) {
+	allowed := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Mkdir(filepath.Join(allowed, "data"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// A link inside the allowed directory that leads out of it
+	if err := os.Symlink(outside, filepath.Join(allowed, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	// A link outside of the allowed directory that leads into it
+	if err := os.Symlink(filepath.Join(allowed, "data"), filepath.Join(outside, "inside")); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := config.ContainerPolicy{
+		AllowedMounts: []string{allowed},
+		PidsLimit:     512,
+	}
+	tests := []struct {
+		name   string
+		c      runtime.Container
+		policy *config.ContainerPolicy
+		ok     bool
+	}{
+		{"empty", runtime.Container{}, nil, true},
+
+		{"root user", runtime.Container{User: "root"}, nil, false},
+		{"root uid", runtime.Container{User: "0:1000"}, nil, false},
+		{"non-root user", runtime.Container{User: "1000:1000"}, nil, true},
+		{"root user allowed", runtime.Container{User: "0"}, &config.ContainerPolicy{AllowRootUser: true}, true},
+
+		{"privileged port", runtime.Container{Ports: []runtime.PortAllocation{{Port: 80}}}, nil, false},
+		{"unprivileged port", runtime.Container{Ports: []runtime.PortAllocation{{Port: 25565}}}, nil, true},
+		{"privileged port allowed", runtime.Container{Ports: []runtime.PortAllocation{{Port: 80}}}, &config.ContainerPolicy{AllowPrivilegedPorts: true}, true},
+
+		{"pids at limit", runtime.Container{Limits: runtime.Limits{PidsLimit: 512}}, nil, true},
+		{"pids over limit", runtime.Container{Limits: runtime.Limits{PidsLimit: 513}}, nil, false},
+
+		{"tmpfs", runtime.Container{Tmpfs: map[string]string{"/cache": "size=100m,noexec"}}, nil, true},
+		{"tmpfs suid", runtime.Container{Tmpfs: map[string]string{"/cache": "size=100m, suid"}}, nil, false},
+		{"tmpfs dev", runtime.Container{Tmpfs: map[string]string{"/cache": "dev"}}, nil, false},
+		{"tmpfs over data", runtime.Container{Tmpfs: map[string]string{dataMountTarget: ""}}, nil, false},
+		{"tmpfs in proc", runtime.Container{Tmpfs: map[string]string{"/proc/sys/": ""}}, nil, false},
+
+		{"mount", runtime.Container{Mounts: []runtime.Mount{{Source: filepath.Join(allowed, "data"), Target: "/mnt"}}}, nil, true},
+		{"mount outside", runtime.Container{Mounts: []runtime.Mount{{Source: outside, Target: "/mnt"}}}, nil, false},
+		{"mount traversal", runtime.Container{Mounts: []runtime.Mount{{Source: filepath.Join(allowed, "..", filepath.Base(outside)), Target: "/mnt"}}}, nil, false},
+		{"mount missing", runtime.Container{Mounts: []runtime.Mount{{Source: filepath.Join(allowed, "missing"), Target: "/mnt"}}}, nil, false},
+		{"mount root", runtime.Container{Mounts: []runtime.Mount{{Source: filepath.Join(allowed, "data"), Target: "/"}}}, nil, false},
+		{"mount over data", runtime.Container{Mounts: []runtime.Mount{{Source: filepath.Join(allowed, "data"), Target: dataMountTarget + "/"}}}, nil, false},
+		{"mount in dev", runtime.Container{Mounts: []runtime.Mount{{Source: filepath.Join(allowed, "data"), Target: "/dev/shm"}}}, nil, false},
+		{"symlink out", runtime.Container{Mounts: []runtime.Mount{{Source: filepath.Join(allowed, "escape"), Target: "/mnt"}}}, nil, false},
+		{"symlink in", runtime.Container{Mounts: []runtime.Mount{{Source: filepath.Join(outside, "inside"), Target: "/mnt"}}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := policy
+			if tt.policy != nil {
+				p = *tt.policy
+			}
+			err := checkPolicy(&tt.c, p)
+			if tt.ok && err != nil {
+				t.Fatalf("expected the container to be allowed, got %v", err)
+			} else if !tt.ok && err == nil {
+				t.Fatal("expected the container to be rejected")
+			}
+		})
+	}
+}
+
+func TestCheckPolicy_BlockedSource(t *testing.T) {
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "docker.sock")
+	if err := os.WriteFile(sock, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(sock, link); err != nil {
+		t.Fatal(err)
+	}
+
+	blocked := blockedMountSources
+	blockedMountSources = []string{sock}
+	t.Cleanup(func() { blockedMountSources = blocked })
+
+	for _, source := range []string{sock, link} {
+		c := runtime.Container{Mounts: []runtime.Mount{{Source: source, Target: "/var/run/docker.sock"}}}
+		if err := checkPolicy(&c, config.ContainerPolicy{AllowedMounts: []string{"/"}}); err == nil {
+			t.Fatalf("expected mounting %s to be rejected", source)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package docker
+
+import (
+	"fmt"
+	"prismarine/shard/runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/go-connections/nat"
+)
+
+// dataMountTarget is where the data directory of the instance is mounted
+// within the container
+const dataMountTarget = "/home/container"
+
+// droppedCapabilities are removed from every container since game servers
+// have no need for them, and they widen what a compromised process can do
+var droppedCapabilities = []string{
+	"setpcap", "mknod", "audit_write", "net_raw", "dac_override",
+	"fowner", "fsetid", "net_bind_service", "sys_chroot", "setfcap",
+}
+
+// environment returns the container environment variables in the KEY=value
+// form Docker expects. The startup invocation is always made available as
+// STARTUP so that images can use it as their entrypoint command. The
+// configuration must be a snapshot.
+func environment(cfg *runtime.Configuration) []string {
+	c := cfg.Container
+
+	env := make([]string, 0, len(c.Environment)+1)
+	env = append(env, "STARTUP="+cfg.Invocation)
+	for k, v := range c.Environment {
+		if k == "STARTUP" {
+			continue
+		}
+		env = append(env, k+"="+v)
+	}
+	// Keep the order stable so the container config does not change between
+	// creations with the same settings
+	sort.Strings(env[1:])
+
+	return env
+}
+
+// labels returns the container labels, including the labels the shard uses to
+// identify its own containers which cannot be overridden
+func labels(c *runtime.Container) map[string]string {
+	labels := make(map[string]string, len(c.Labels)+2)
+	for k, v := range c.Labels {
+		labels[k] = v
+	}
+	labels["Service"] = "Prismarine"
+	labels["ContainerType"] = "server_process"
+	return labels
+}
+
+// portBindings returns the exposed ports and host bindings for the port
+// allocations. Allocations without a protocol are bound on both tcp and udp,
+// and allocations without an ip are bound on the default interface.
+func portBindings(c *runtime.Container, defaultIp string) (nat.PortSet, nat.PortMap) {
+	exposed := nat.PortSet{}
+	bindings := nat.PortMap{}
+
+	for _, p := range c.Ports {
+		protocols := []string{p.Protocol}
+		if p.Protocol == "" {
+			protocols = []string{runtime.ProtocolTcp, runtime.ProtocolUdp}
+		}
+
+		ip := p.Ip
+		if ip == "" {
+			ip = defaultIp
+		}
+
+		for _, proto := range protocols {
+			port := nat.Port(fmt.Sprintf("%d/%s", p.Port, proto))
+			exposed[port] = struct{}{}
+			bindings[port] = append(bindings[port], nat.PortBinding{
+				HostIP:   ip,
+				HostPort: strconv.Itoa(p.Port),
+			})
+		}
+	}
+
+	return exposed, bindings
+}
+
+// tmpfs returns the tmpfs mounts for the container. Every container gets a
+// /tmp directory of the given size in MiB unless it configures its own.
+func tmpfs(c *runtime.Container, size int64) map[string]string {
+	tmpfs := map[string]string{
+		"/tmp": "rw,exec,nosuid,size=" + strconv.FormatInt(size, 10) + "M",
+	}
+	for target, opts := range c.Tmpfs {
+		tmpfs[target] = opts
+	}
+	return tmpfs
+}
+
+// mounts returns the bind mounts for the container, starting with the data
+// directory of the instance
+func (i *Instance) mounts(c *runtime.Container) []mount.Mount {
+	mounts := []mount.Mount{{
+		Type:   mount.TypeBind,
+		Source: i.Filesystem().Path(),
+		Target: dataMountTarget,
+	}}
+	for _, m := range c.Mounts {
+		mounts = append(mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   m.Source,
+			Target:   m.Target,
+			ReadOnly: m.ReadOnly,
+		})
+	}
+	return mounts
+}
+
+// numericUser parses a user in "uid" or "uid:gid" form. Named users cannot be
+// resolved on the host, so ok is false for them.
+func numericUser(user string) (uid int, gid int, ok bool) {
+	if user == "" {
+		return 0, 0, false
+	}
+
+	parts := strings.SplitN(user, ":", 2)
+	uid, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	gid = uid
+	if len(parts) == 2 {
+		if gid, err = strconv.Atoi(parts[1]); err != nil {
+			return 0, 0, false
+		}
+	}
+	return uid, gid, true
+}
+
+// resources returns the resource limits of the container. A pids limit of
+// zero falls back to the given default.
+func resources(c *runtime.Container, defaultPidsLimit int64) container.Resources {
+	l := c.Limits
+
+	pidsLimit := l.PidsLimit
+	if pidsLimit == 0 {
+		pidsLimit = defaultPidsLimit
+	}
+
+	return container.Resources{
+		Memory:            l.MemoryBytes(),
+		MemoryReservation: l.MemoryBytes(),
+		MemorySwap:        l.SwapBytes(),
+		CPUQuota:          l.CpuLimit * 1000,
+		CPUPeriod:         100_000,
+		CpusetCpus:        l.Threads,
+		BlkioWeight:       l.IoWeight,
+		PidsLimit:         &pidsLimit,
+		OomKillDisable:    &l.OomDisabled,
+	}
+}
@@ -14,7 +14,18 @@ import (
 	"github.com/pkg/errors"
 )
 
-func (i *Instance) Preflight(ctx context.Context) error {
+func (i *Instance) Preflight(ctx context.Context) (err error) {
+	// Recreating the container applies every pending change. Anything updated
+	// from here on marks the instance as pending again, and the flag is put
+	// back if the container could not be recreated.
+	if i.PendingRestart.SwapIf(false) {
+		defer func() {
+			if err != nil {
+				i.PendingRestart.Store(true)
+			}
+		}()
+	}
+
 	// Always destroy and re-create the server container
 	if err := i.client.ContainerRemove(ctx, i.Cfg.Uuid, container.RemoveOptions{}); err != nil {
 		if !client.IsErrNotFound(err) {
@@ -46,7 +57,13 @@ func (i *Instance) Start(ctx context.Context, skipLock bool, waitSeconds int) er
 	defer cleanup()
 
 	if i.State() != runtime.ProcessOfflineState {
-		return errors.New("Container already running")
+		return runtime.ErrInstanceRunning
+	}
+
+	// Booting an instance that is over its quota would only let it write
+	// even more, so refuse until space has been freed up
+	if err := i.Filesystem().HasSpaceAvailable(false); err != nil {
+		return err
 	}
 
 	sawError := false
@@ -56,6 +73,7 @@ func (i *Instance) Start(ctx context.Context, skipLock bool, waitSeconds int) er
 			// If we don't set it to stopping first, you'll trigger crash detection which
 			// we don't want to do at this point since it'll just immediately try to do the
 			// exact same action that lead to it crashing in the first place...
+			i.Startup.Cancel()
 			i.SetState(runtime.ProcessStoppingState)
 			i.SetState(runtime.ProcessOfflineState)
 		}
@@ -71,10 +89,14 @@ func (i *Instance) Start(ctx context.Context, skipLock bool, waitSeconds int) er
 			return errors.Wrap(err, "runtime/docker: failed to inspect container")
 		}
 	} else {
+		// The container is already running, such as after the shard restarted,
+		// so attach to it again rather than starting it
 		if c.State.Running {
-			i.SetState(runtime.ProcessOfflineState)
-
-			return i.Attach(ctx)
+			if err := i.Attach(ctx); err != nil {
+				return err
+			}
+			i.SetState(runtime.ProcessRunningState)
+			return nil
 		}
 
 		// TODO Log crap
@@ -92,6 +114,9 @@ func (i *Instance) Start(ctx context.Context, skipLock bool, waitSeconds int) er
 		return errors.Wrap(err, "runtime/docker: failed to run prelude")
 	}
 
+	// Detection has to begin before attaching so that no output is missed
+	detecting := i.Startup.Begin()
+
 	// If we cannot start & attach to the container in 30 seconds something has gone
 	// quite sideways, and we should stop trying to avoid a hanging situation.
 	actx, cancel := context.WithTimeout(ctx, time.Second*30)
@@ -112,17 +137,25 @@ func (i *Instance) Start(ctx context.Context, skipLock bool, waitSeconds int) er
 		return errors.Wrap(err, "runtime/docker: failed to start container")
 	}
 
+	// Without any startup rules there is no way to tell when the process is
+	// ready, so treat it as running straight away
+	if !detecting {
+		i.SetState(runtime.ProcessRunningState)
+	}
+
 	sawError = false
 	return nil
 }
 
-// Stop stops the container that the server is running in. This will allow up to
-// 30 seconds to pass before the container is forcefully terminated if we are
-// trying to stop it without using a command sent into the instance.
+// Stop asks the instance to stop using its stop configuration. A console
+// command is typed into the attached stdin, a signal is delivered to the
+// process, and a native stop lets Docker stop the container however long it
+// takes. A command falls back to a native stop if the instance is not
+// attached.
 //
 // You most likely want to be using WaitForStop() rather than this function,
-// since this will return as soon as the command is sent, rather than waiting
-// for the process to be completed stopped.
+// since this will return as soon as the stop has been requested, rather than
+// waiting for the process to be completely stopped.
 func (i *Instance) Stop(ctx context.Context, skipLock bool, waitSeconds int) error {
 	cleanup, err := i.AttemptPowerlock(ctx, skipLock, waitSeconds)
 	if err != nil {
@@ -130,23 +163,7 @@ func (i *Instance) Stop(ctx context.Context, skipLock bool, waitSeconds int) err
 	}
 	defer cleanup()
 
-	i.Lock()
-	s := i.Cfg.Stop
-	i.Unlock()
-
-	// A native "stop" as the Type field value will just skip over all of this
-	// logic and end up only executing the container stop command (which may or
-	// may not work as expected).
-	if s == "" {
-		if s == "" {
-			log.Debug("no stop configuration set, using terminate command")
-		}
-
-		signal := os.Kill
-
-		// Skipping some stuff
-		return i.Terminate(ctx, signal, true, 0)
-	}
+	s := i.Cfg.Snapshot().Stop
 
 	// If the process is already offline don't switch it back to stopping. Just leave it how
 	// it is and continue through to the stop handling for the process
@@ -154,10 +171,26 @@ func (i *Instance) Stop(ctx context.Context, skipLock bool, waitSeconds int) err
 		i.SetState(runtime.ProcessStoppingState)
 	}
 
-	// // Only attempt to send the stop command if we are attached
-	// if i.IsAttached() && false {
-	//   return i.SendCommand(s.)
-	// }
+	switch s.Type {
+	case runtime.StopTypeCommand:
+		if i.IsAttached() {
+			return i.SendCommand(s.Value)
+		}
+		log.
+			With("runtime", "docker").
+			With("instance", i.Id()).
+			Debug("not attached to instance, using a native stop instead of the stop command")
+	case runtime.StopTypeSignal:
+		if err := i.client.ContainerKill(ctx, i.Cfg.Uuid, s.Signal()); err != nil {
+			if client.IsErrNotFound(err) {
+				i.SetStream(nil)
+				i.SetState(runtime.ProcessOfflineState)
+				return nil
+			}
+			return errors.Wrap(err, "runtime/docker: cannot send stop signal to container")
+		}
+		return nil
+	}
 
 	// Allow the stop action to run for however long it takes, similar to executing a command
 	// and using a different logic pathway to wait for the container to stop successfully.
@@ -255,7 +288,7 @@ func (i *Instance) WaitForStop(ctx context.Context, duration time.Duration, term
 
 // Terminate forcefully terminates the container using the signal provided
 func (i *Instance) Terminate(ctx context.Context, signal os.Signal, skipLock bool, waitSeconds int) error {
-	log.Warnf("Terminating instance %s", i.Id)
+	log.Warnf("Terminating instance %s", i.Id())
 
 	cleanup, err := i.AttemptPowerlock(ctx, skipLock, waitSeconds)
 	if err != nil {
@@ -292,21 +325,24 @@ func (i *Instance) Terminate(ctx context.Context, signal os.Signal, skipLock boo
 	return nil
 }
 
-func (i *Instance) Restart(ctx context.Context) error {
-	if err := i.WaitForStop(ctx, time.Second*10, true, false, 0); err != nil {
+func (i *Instance) Restart(ctx context.Context, waitSeconds int) error {
+	if err := i.WaitForStop(ctx, time.Second*10, true, false, waitSeconds); err != nil {
 		return err
 	}
 
-	return i.Start(i.Ctx, false, 0)
+	return i.Start(i.Ctx, false, waitSeconds)
 }
 
+// AttemptPowerlock acquires the powerlock for a power action. Restores and
+// transfers stop the instance themselves once they have claimed it, and pass
+// skipLock to get past their own claim.
 func (i *Instance) AttemptPowerlock(ctx context.Context, skipLock bool, waitSeconds int) (func(), error) {
 	if i.Installing.Load() {
-		return nil, errors.New("server is installing")
-	} else if i.Restoring.Load() {
-		return nil, errors.New("server is restoring")
-	} else if i.Transferring.Load() {
-		return nil, errors.New("server is transferring")
+		return nil, runtime.ErrInstanceInstalling
+	} else if !skipLock && i.Restoring.Load() {
+		return nil, runtime.ErrInstanceRestoring
+	} else if !skipLock && i.Transferring.Load() {
+		return nil, runtime.ErrInstanceTransferring
 	}
 
 	cleanup := func() {
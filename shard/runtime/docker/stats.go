@@ -0,0 +1,172 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"prismarine/shard/config"
+	"prismarine/shard/runtime"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+)
+
+// pollResources streams the resource usage of the container from Docker until
+// the context is canceled, storing the latest snapshot on the instance and
+// publishing it at the configured interval
+func (i *Instance) pollResources(ctx context.Context) error {
+	interval := time.Duration(config.Get().Docker.StatsInterval) * time.Second
+
+	c, err := i.ContainerInspect(ctx)
+	if err != nil {
+		return errors.Wrap(err, "runtime/docker: failed to inspect container")
+	}
+	started, known := startedAt(c)
+
+	stats, err := i.client.ContainerStats(ctx, i.Cfg.Uuid, true)
+	if err != nil {
+		return errors.Wrap(err, "runtime/docker: failed to stream container stats")
+	}
+	defer stats.Body.Close()
+
+	// Clear out the usage once the container is no longer being polled so
+	// that stale numbers are not reported for a stopped instance
+	defer func() {
+		st := i.diskStats(runtime.Stats{})
+		i.SetStats(st)
+		i.Events().Publish(runtime.ResourceEvent, st)
+	}()
+
+	var published time.Time
+	dec := json.NewDecoder(stats.Body)
+	for {
+		var v types.StatsJSON
+		if err := dec.Decode(&v); err != nil {
+			if err == io.EOF || errors.Is(err, context.Canceled) || ctx.Err() != nil {
+				return nil
+			}
+			return errors.Wrap(err, "runtime/docker: failed to decode container stats")
+		}
+
+		// Docker may not have recorded the start time when polling begins, so
+		// keep asking until it has rather than reporting a made up uptime
+		if !known {
+			if c, err := i.ContainerInspect(ctx); err == nil {
+				started, known = startedAt(c)
+			}
+		}
+
+		st := runtime.Stats{
+			Memory:      calculateMemory(v.MemoryStats),
+			MemoryLimit: v.MemoryStats.Limit,
+			CpuAbsolute: calculateAbsoluteCpu(v.PreCPUStats, v.CPUStats),
+			BlockIo:     calculateBlockIo(v.BlkioStats),
+		}
+		if known {
+			st.Uptime = time.Since(started).Milliseconds()
+		}
+		st.CpuPercent = i.normaliseCpu(st.CpuAbsolute, v.CPUStats)
+		st = i.diskStats(st)
+		for _, nw := range v.Networks {
+			st.Network.RxBytes += nw.RxBytes
+			st.Network.TxBytes += nw.TxBytes
+		}
+
+		i.SetStats(st)
+
+		if time.Since(published) >= interval {
+			published = time.Now()
+			i.Events().Publish(runtime.ResourceEvent, st)
+		}
+	}
+}
+
+// startedAt returns when the container was last started. Docker reports a zero
+// time until the container has started, which is treated as unknown.
+func startedAt(c types.ContainerJSON) (time.Time, bool) {
+	if c.ContainerJSONBase == nil || c.State == nil {
+		return time.Time{}, false
+	}
+	started, err := time.Parse(time.RFC3339Nano, c.State.StartedAt)
+	if err != nil || started.IsZero() {
+		return time.Time{}, false
+	}
+	return started, true
+}
+
+// diskStats fills in the disk usage of the instance. The usage is cached by the
+// filesystem and refreshed in the background, so only the very first lookup
+// blocks on a walk of the data directory.
+func (i *Instance) diskStats(st runtime.Stats) runtime.Stats {
+	fs := i.Filesystem()
+	if used, err := fs.DiskUsage(true); err == nil {
+		st.Disk = used
+	}
+	st.DiskLimit = fs.MaxDisk()
+	return st
+}
+
+// calculateMemory returns the memory used by the container without the page
+// cache, which matches what "docker stats" reports
+//
+// @see https://github.com/docker/cli/blob/96e1d1d6/cli/command/container/stats_helpers.go#L227-L249
+func calculateMemory(v types.MemoryStats) uint64 {
+	// cgroup v1 reports total_inactive_file, cgroup v2 reports inactive_file
+	if inactive, ok := v.Stats["total_inactive_file"]; ok && inactive < v.Usage {
+		return v.Usage - inactive
+	}
+	if inactive, ok := v.Stats["inactive_file"]; ok && inactive < v.Usage {
+		return v.Usage - inactive
+	}
+	return v.Usage
+}
+
+// calculateAbsoluteCpu returns the cpu usage between the two samples, where
+// 100 is one full core
+func calculateAbsoluteCpu(prev types.CPUStats, cur types.CPUStats) float64 {
+	cpuDelta := float64(cur.CPUUsage.TotalUsage) - float64(prev.CPUUsage.TotalUsage)
+	systemDelta := float64(cur.SystemUsage) - float64(prev.SystemUsage)
+
+	percent := 0.0
+	if systemDelta > 0.0 && cpuDelta > 0.0 {
+		percent = (cpuDelta / systemDelta) * 100.0 * float64(onlineCpus(cur))
+	}
+	return math.Round(percent*1000) / 1000
+}
+
+// normaliseCpu converts the absolute cpu usage into a percentage of the cpu
+// limit of the instance. Without a limit the usage is relative to every core
+// on the host.
+func (i *Instance) normaliseCpu(absolute float64, cur types.CPUStats) float64 {
+	limit := float64(i.Cfg.Snapshot().Container.Limits.CpuLimit)
+	if limit <= 0 {
+		limit = float64(onlineCpus(cur)) * 100
+	}
+	if limit <= 0 {
+		return 0
+	}
+	return math.Round(math.Min(absolute/limit*100, 100)*1000) / 1000
+}
+
+func onlineCpus(v types.CPUStats) uint32 {
+	if v.OnlineCPUs > 0 {
+		return v.OnlineCPUs
+	}
+	return uint32(len(v.CPUUsage.PercpuUsage))
+}
+
+func calculateBlockIo(v types.BlkioStats) runtime.BlockIoStats {
+	var st runtime.BlockIoStats
+	for _, e := range v.IoServiceBytesRecursive {
+		switch strings.ToLower(e.Op) {
+		case "read":
+			st.ReadBytes += e.Value
+		case "write":
+			st.WriteBytes += e.Value
+		}
+	}
+	return st
+}
@@ -0,0 +1,57 @@
+package docker
+
+import (
+	"context"
+	"prismarine/shard/config"
+	"prismarine/shard/runtime"
+
+	"github.com/charmbracelet/log"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+// Update replaces the configuration of the instance. Resource limits are
+// applied to the container through Docker straight away, while changes that
+// need the container to be recreated, such as the image or ports, are marked
+// as pending and applied by the next Preflight.
+func (i *Instance) Update(ctx context.Context, cfg *runtime.Configuration) (runtime.ConfigurationDiff, error) {
+	if err := cfg.Validate(); err != nil {
+		return runtime.ConfigurationDiff{}, errors.WithStack(err)
+	}
+	policy := config.Get().Docker.Policy
+	if err := checkPolicy(cfg.Container, policy); err != nil {
+		return runtime.ConfigurationDiff{}, err
+	}
+
+	diff, err := i.Cfg.Update(cfg)
+	if err != nil {
+		return diff, errors.WithStack(err)
+	}
+
+	l := log.With("runtime", "docker").With("instance", i.Id())
+	if diff.RequiresRestart() {
+		i.PendingRestart.Store(true)
+		l.Info("configuration updated, some changes apply once the instance restarts", "pending", diff.PendingRestart)
+	}
+
+	if !diff.Limits {
+		return diff, nil
+	}
+
+	snap := i.Cfg.Snapshot()
+	i.Fs.SetDiskLimit(snap.Container.Limits.DiskBytes())
+
+	res := resources(snap.Container, policy.PidsLimit)
+	res.OomKillDisable = nil
+	if _, err := i.client.ContainerUpdate(ctx, i.Cfg.Uuid, container.UpdateConfig{Resources: res}); err != nil {
+		// The limits are used when the container is next created
+		if client.IsErrNotFound(err) {
+			return diff, nil
+		}
+		return diff, errors.Wrap(err, "runtime/docker: failed to update container resources")
+	}
+
+	l.Info("applied updated resource limits")
+	return diff, nil
+}
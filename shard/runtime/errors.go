@@ -0,0 +1,12 @@
+package runtime
+
+import "errors"
+
+var (
+	ErrInstanceInstalling   = errors.New("server is installing")
+	ErrInstanceRestoring    = errors.New("server is restoring")
+	ErrInstanceTransferring = errors.New("server is transferring")
+	ErrInstanceRunning      = errors.New("server is already running")
+	ErrNotAttached          = errors.New("not attached to instance")
+	ErrNoInstallScript      = errors.New("server has no install script")
+)
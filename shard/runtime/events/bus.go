@@ -1,32 +1,220 @@
 package events
 
-import "strings"
+import (
+	"strings"
+	"sync"
+)
+
+const (
+	// Wildcard can be subscribed to in order to receive every event published
+	// to the bus. It can also be used as the namespace of a topic, such as
+	// "backup completed:*", to receive every namespaced event of that topic.
+	Wildcard = "*"
+
+	// subscriptionBufferSize is the number of events that can be queued for a
+	// single subscription before the oldest events start being dropped
+	subscriptionBufferSize = 64
+)
 
 type Event struct {
-	topic string
+	Topic string
 	Data  interface{}
 }
 
+// Handler is a function that is called with every event published to the
+// topic it is subscribed to
+type Handler func(Event)
+
+// Subscription is returned when subscribing a handler to the bus, and is used
+// to remove the handler again. Every subscription delivers events to its
+// handler on its own goroutine so that a slow handler never blocks the
+// publisher or any other subscription.
+type Subscription struct {
+	topic   string
+	handler Handler
+	// limit is the number of events that can be queued before the oldest
+	// start being dropped, or zero to queue every event
+	limit int
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []Event
+	closed bool
+}
+
+func newSubscription(topic string, handler Handler, limit int) *Subscription {
+	s := &Subscription{
+		topic:   topic,
+		handler: handler,
+		limit:   limit,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// Topic returns the topic the subscription was registered with
+func (s *Subscription) Topic() string {
+	return s.topic
+}
+
+// run delivers queued events to the handler until the subscription is closed
+// and everything queued before then has been delivered
+func (s *Subscription) run() {
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		e := s.queue[0]
+		s.queue[0] = Event{}
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		s.handler(e)
+	}
+}
+
+// push queues an event for the handler without blocking. If the subscription
+// has a limit and its queue is full the oldest queued event is dropped to make
+// room, the same way the SinkPool treats slow channels.
+func (s *Subscription) push(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	if s.limit > 0 && len(s.queue) >= s.limit {
+		s.queue[0] = Event{}
+		s.queue = s.queue[1:]
+	}
+	s.queue = append(s.queue, e)
+	s.cond.Signal()
+}
+
+// close stops the subscription once the events already queued are delivered
+func (s *Subscription) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+}
+
 type Bus struct {
 	*SinkPool
+
+	mu            sync.RWMutex
+	subscriptions map[string][]*Subscription
 }
 
 func NewBus() *Bus {
 	return &Bus{
-		NewSinkPool(),
+		SinkPool:      NewSinkPool(),
+		subscriptions: make(map[string][]*Subscription),
 	}
 }
 
+// Subscribe registers a handler that is called for every event published to
+// the given topic. Subscribing to a plain topic such as "backup completed"
+// also receives namespaced events such as "backup completed:1234", while
+// subscribing to "backup completed:1234" only receives that namespace. The
+// Wildcard topic receives everything.
+//
+// If the handler falls behind the oldest of its queued events are dropped, so
+// anything that has to see every event should use SubscribeLossless instead.
+func (b *Bus) Subscribe(topic string, handler Handler) *Subscription {
+	return b.subscribe(newSubscription(topic, handler, subscriptionBufferSize))
+}
+
+// SubscribeLossless registers a handler the same way as Subscribe, except
+// that no event is ever dropped. This is meant for internal subscribers that
+// track the state of an instance, such as the crash handler, and the handler
+// must keep up with the publisher since the queue is not bounded.
+func (b *Bus) SubscribeLossless(topic string, handler Handler) *Subscription {
+	return b.subscribe(newSubscription(topic, handler, 0))
+}
+
+func (b *Bus) subscribe(s *Subscription) *Subscription {
+	b.mu.Lock()
+	if b.subscriptions == nil {
+		b.subscriptions = make(map[string][]*Subscription)
+	}
+	b.subscriptions[s.topic] = append(b.subscriptions[s.topic], s)
+	b.mu.Unlock()
+
+	go s.run()
+	return s
+}
+
+// Unsubscribe removes a subscription from the bus. Events that were already
+// queued for the subscription are still delivered to its handler. If the
+// subscription is not registered this function is a no-op.
+func (b *Bus) Unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subs := b.subscriptions[s.topic]
+	for i, sub := range subs {
+		if sub != s {
+			continue
+		}
+
+		b.subscriptions[s.topic] = append(subs[:i:i], subs[i+1:]...)
+		if len(b.subscriptions[s.topic]) == 0 {
+			delete(b.subscriptions, s.topic)
+		}
+		s.close()
+		return
+	}
+}
+
+// Publish sends an event to every subscription matching the topic. This never
+// blocks on the subscribed handlers.
 func (b *Bus) Publish(topic string, data interface{}) {
+	e := Event{Topic: topic, Data: data}
+
 	// Some of our actions for the socket support passing a more specific namespace,
 	// such as "backup completed:1234" to indicate which specific backup was completed.
 	//
 	// In these cases, we still need to send the event using the standard listener
 	// name of "backup completed".
+	topics := []string{topic, Wildcard}
 	if strings.Contains(topic, ":") {
 		parts := strings.SplitN(topic, ":", 2)
 		if len(parts) == 2 {
-			topic = parts[0]
+			topics = append(topics, parts[0], parts[0]+":"+Wildcard)
+		}
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for i, t := range topics {
+		// A namespace of "*" is not treated as a wildcard when publishing, so
+		// avoid delivering the event twice to the same subscriptions
+		if i > 0 && t == topic {
+			continue
+		}
+		for _, s := range b.subscriptions[t] {
+			s.push(e)
+		}
+	}
+}
+
+// Destroy removes every subscription from the bus and closes all the sinks
+// in the pool. The bus can still be used afterwards, but nothing will be
+// listening to it.
+func (b *Bus) Destroy() {
+	b.mu.Lock()
+	for _, subs := range b.subscriptions {
+		for _, s := range subs {
+			s.close()
 		}
 	}
+	b.subscriptions = make(map[string][]*Subscription)
+	b.mu.Unlock()
+
+	b.SinkPool.Destroy()
 }
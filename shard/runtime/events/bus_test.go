@@ -0,0 +1,247 @@
+package events
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// collect subscribes to a topic and returns a channel receiving every event
+// delivered to the subscription
+func collect(b *Bus, topic string) (*Subscription, chan Event) {
+	c := make(chan Event, 128)
+	s := b.Subscribe(topic, func(e Event) {
+		c <- e
+	})
+	return s, c
+}
+
+func expectEvent(t *testing.T, c chan Event, topic string) Event {
+	t.Helper()
+	select {
+	case e := <-c:
+		if e.Topic != topic {
+			t.Fatalf("expected event with topic %q, got %q", topic, e.Topic)
+		}
+		return e
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for event %q", topic)
+	}
+	return Event{}
+}
+
+func expectNoEvent(t *testing.T, c chan Event) {
+	t.Helper()
+	select {
+	case e := <-c:
+		t.Fatalf("expected no event, got %q", e.Topic)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBus_Publish(t *testing.T) {
+	b := NewBus()
+	defer b.Destroy()
+
+	_, c := collect(b, "state change")
+	_, other := collect(b, "resources")
+
+	b.Publish("state change", "running")
+
+	e := expectEvent(t, c, "state change")
+	if e.Data != "running" {
+		t.Fatalf("expected data %q, got %v", "running", e.Data)
+	}
+	expectNoEvent(t, other)
+}
+
+func TestBus_PublishNamespaced(t *testing.T) {
+	b := NewBus()
+	defer b.Destroy()
+
+	_, plain := collect(b, "backup completed")
+	_, exact := collect(b, "backup completed:1234")
+	_, otherNs := collect(b, "backup completed:5678")
+	_, wildcardNs := collect(b, "backup completed:*")
+
+	b.Publish("backup completed:1234", nil)
+
+	expectEvent(t, plain, "backup completed:1234")
+	expectEvent(t, exact, "backup completed:1234")
+	expectEvent(t, wildcardNs, "backup completed:1234")
+	expectNoEvent(t, otherNs)
+}
+
+func TestBus_PublishPlainDoesNotReachNamespaces(t *testing.T) {
+	b := NewBus()
+	defer b.Destroy()
+
+	_, exact := collect(b, "backup completed:1234")
+	_, wildcardNs := collect(b, "backup completed:*")
+
+	b.Publish("backup completed", nil)
+
+	expectNoEvent(t, exact)
+	expectNoEvent(t, wildcardNs)
+}
+
+func TestBus_Wildcard(t *testing.T) {
+	b := NewBus()
+	defer b.Destroy()
+
+	_, c := collect(b, Wildcard)
+
+	b.Publish("state change", nil)
+	b.Publish("backup completed:1234", nil)
+
+	expectEvent(t, c, "state change")
+	expectEvent(t, c, "backup completed:1234")
+	expectNoEvent(t, c)
+}
+
+func TestBus_Unsubscribe(t *testing.T) {
+	b := NewBus()
+	defer b.Destroy()
+
+	s, c := collect(b, "state change")
+	b.Publish("state change", nil)
+	expectEvent(t, c, "state change")
+
+	b.Unsubscribe(s)
+	// Unsubscribing twice must not panic
+	b.Unsubscribe(s)
+
+	b.Publish("state change", nil)
+	expectNoEvent(t, c)
+}
+
+func TestBus_SlowSubscriber(t *testing.T) {
+	b := NewBus()
+	defer b.Destroy()
+
+	block := make(chan struct{})
+	defer close(block)
+	b.Subscribe("resources", func(e Event) {
+		<-block
+	})
+	_, fast := collect(b, "resources")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < subscriptionBufferSize*4; i++ {
+			b.Publish("resources", i)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publish blocked on a slow subscriber")
+	}
+
+	for i := 0; i < subscriptionBufferSize; i++ {
+		expectEvent(t, fast, "resources")
+	}
+}
+
+func TestBus_SubscribeLossless(t *testing.T) {
+	b := NewBus()
+	defer b.Destroy()
+
+	block := make(chan struct{})
+	c := make(chan Event, subscriptionBufferSize*4)
+	b.SubscribeLossless("state change", func(e Event) {
+		<-block
+		c <- e
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < subscriptionBufferSize*4; i++ {
+			b.Publish("state change", i)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publish blocked on a slow subscriber")
+	}
+
+	close(block)
+	for i := 0; i < subscriptionBufferSize*4; i++ {
+		if e := expectEvent(t, c, "state change"); e.Data != i {
+			t.Fatalf("expected event %d, got %v", i, e.Data)
+		}
+	}
+}
+
+func TestBus_UnsubscribeDeliversQueued(t *testing.T) {
+	b := NewBus()
+	defer b.Destroy()
+
+	block := make(chan struct{})
+	c := make(chan Event, 8)
+	s := b.Subscribe("state change", func(e Event) {
+		<-block
+		c <- e
+	})
+
+	b.Publish("state change", 1)
+	b.Publish("state change", 2)
+	b.Unsubscribe(s)
+	b.Publish("state change", 3)
+	close(block)
+
+	for _, want := range []int{1, 2} {
+		if e := expectEvent(t, c, "state change"); e.Data != want {
+			t.Fatalf("expected event %d, got %v", want, e.Data)
+		}
+	}
+	expectNoEvent(t, c)
+}
+
+func TestBus_Destroy(t *testing.T) {
+	b := NewBus()
+
+	s, c := collect(b, "state change")
+	sink := make(chan []byte, 1)
+	b.On(sink)
+
+	b.Destroy()
+	// Unsubscribing after the bus is destroyed must not panic
+	b.Unsubscribe(s)
+
+	b.Publish("state change", nil)
+	expectNoEvent(t, c)
+
+	if _, ok := <-sink; ok {
+		t.Fatal("expected sink to be closed on destroy")
+	}
+}
+
+func TestBus_Concurrent(t *testing.T) {
+	b := NewBus()
+	defer b.Destroy()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				s := b.Subscribe("state change", func(Event) {})
+				b.Unsubscribe(s)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				b.Publish("state change:namespace", j)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,126 @@
+package runtime
+
+import (
+	"context"
+	"os"
+	"prismarine/shard/runtime/events"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeInstance implements just enough of an instance for the crash handler and
+// startup detector, any other method panics
+type fakeInstance struct {
+	Instance
+
+	mu         sync.Mutex
+	state      string
+	exitCode   uint32
+	oomKilled  bool
+	starts     int
+	terminated int
+
+	cfg *Configuration
+	bus *events.Bus
+	ctx context.Context
+}
+
+func newFakeInstance(t *testing.T, cfg Configuration) *fakeInstance {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg.RWMutex = &sync.RWMutex{}
+	i := &fakeInstance{
+		state: ProcessOfflineState,
+		cfg:   &cfg,
+		bus:   events.NewBus(),
+		ctx:   ctx,
+	}
+	t.Cleanup(func() {
+		cancel()
+		i.bus.Destroy()
+	})
+	return i
+}
+
+func (i *fakeInstance) Id() string               { return "instance" }
+func (i *fakeInstance) Config() *Configuration   { return i.cfg }
+func (i *fakeInstance) Events() *events.Bus      { return i.bus }
+func (i *fakeInstance) Context() context.Context { return i.ctx }
+
+func (i *fakeInstance) State() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.state
+}
+
+func (i *fakeInstance) SetState(state string) {
+	i.mu.Lock()
+	i.state = state
+	i.mu.Unlock()
+	i.bus.Publish(StateChangeEvent, state)
+}
+
+// exit moves the instance to offline as if the process exited by itself
+func (i *fakeInstance) exit(code uint32, oomKilled bool) {
+	i.mu.Lock()
+	i.exitCode, i.oomKilled = code, oomKilled
+	i.mu.Unlock()
+	i.SetState(ProcessOfflineState)
+}
+
+func (i *fakeInstance) ExitState() (uint32, bool, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.exitCode, i.oomKilled, nil
+}
+
+func (i *fakeInstance) Start(context.Context, bool, int) error {
+	i.mu.Lock()
+	i.starts++
+	i.mu.Unlock()
+	i.SetState(ProcessRunningState)
+	return nil
+}
+
+func (i *fakeInstance) Terminate(context.Context, os.Signal, bool, int) error {
+	i.mu.Lock()
+	i.terminated++
+	i.mu.Unlock()
+	i.SetState(ProcessOfflineState)
+	return nil
+}
+
+func (i *fakeInstance) counts() (starts, terminated int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.starts, i.terminated
+}
+
+// subscribe returns a channel receiving every event published to the topic
+func (i *fakeInstance) subscribe(topic string) chan events.Event {
+	c := make(chan events.Event, 16)
+	i.bus.Subscribe(topic, func(e events.Event) { c <- e })
+	return c
+}
+
+func expectEvent(t *testing.T, c chan events.Event) events.Event {
+	t.Helper()
+	select {
+	case e := <-c:
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	return events.Event{}
+}
+
+func expectNoEvent(t *testing.T, c chan events.Event) {
+	t.Helper()
+	select {
+	case e := <-c:
+		t.Fatalf("expected no event, got %q with %+v", e.Topic, e.Data)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,705 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ArchiveZip    = "zip"
+	ArchiveTarGz  = "tar.gz"
+	ArchiveTarZst = "tar.zst"
+)
+
+var (
+	ErrUnknownArchiveFormat = errors.New("filesystem: unknown archive format")
+	ErrArchiveTooLarge      = errors.New("filesystem: archive expands to more than the allowed size")
+)
+
+// minExpandedSize is the size small archives may always decompress to, so
+// that highly compressible archives of a few KiB are not refused
+var minExpandedSize int64 = 64 * 1024 * 1024
+
+const (
+	// maxCompressionRatio is how many times larger than the archive itself
+	// its contents may be once decompressed. Real world data rarely gets
+	// close, whereas zip bombs are many orders of magnitude above it.
+	maxCompressionRatio = 200
+
+	// maxSymlinkTarget is the longest symlink target read from a zip archive
+	maxSymlinkTarget = 4096
+
+	progressInterval = 500 * time.Millisecond
+)
+
+// ArchiveProgress reports how far along a compress or decompress operation is.
+// For compression the bytes are those read from the files being archived, for
+// decompression those read from the archive.
+type ArchiveProgress struct {
+	Archive   string `json:"archive"`
+	Processed int64  `json:"processed"`
+	Total     int64  `json:"total"`
+	Done      bool   `json:"done"`
+}
+
+// ProgressFunc is called periodically while an archive operation runs, and
+// once more when it completes
+type ProgressFunc func(ArchiveProgress)
+
+// archiveFormat returns the format of an archive based on its file name
+func archiveFormat(name string) (string, error) {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return ArchiveZip, nil
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return ArchiveTarGz, nil
+	case strings.HasSuffix(name, ".tar.zst"), strings.HasSuffix(name, ".tzst"):
+		return ArchiveTarZst, nil
+	}
+	return "", ErrUnknownArchiveFormat
+}
+
+// Compress creates an archive in the given directory containing the files
+// within it, or everything in the directory if no files are given. Symlinks
+// are stored as links rather than followed. The archive is written through the
+// disk quota, and is removed again if anything fails.
+func (fs *Filesystem) Compress(dir string, files []string, format string, progress ProgressFunc) (Stat, error) {
+	switch format {
+	case ArchiveZip, ArchiveTarGz, ArchiveTarZst:
+	default:
+		return Stat{}, ErrUnknownArchiveFormat
+	}
+
+	cleanedDir, err := fs.SafePath(dir)
+	if err != nil {
+		return Stat{}, err
+	}
+	base, err := fs.openDir(cleanedDir, false)
+	if err != nil {
+		return Stat{}, err
+	}
+	defer base.Close()
+
+	if len(files) == 0 {
+		names, err := base.Readdirnames(-1)
+		if err != nil {
+			return Stat{}, errors.Wrap(err, "filesystem: failed to read directory")
+		}
+		sort.Strings(names)
+		files = names
+	}
+
+	// Every source is walked relative to its opened parent directory, so a
+	// directory swapped for a symlink after this point is never followed
+	sources := make([]archiveSource, 0, len(files))
+	defer func() {
+		for _, s := range sources {
+			_ = s.dir.Close()
+		}
+	}()
+	var total int64
+	for _, f := range files {
+		p, err := fs.unresolvedPath(filepath.Join(dir, f))
+		if err != nil {
+			return Stat{}, err
+		}
+		if !isWithin(p, cleanedDir) || p == cleanedDir {
+			return Stat{}, ErrBadPathResolution
+		}
+		rel, err := filepath.Rel(cleanedDir, p)
+		if err != nil {
+			return Stat{}, err
+		}
+
+		parent, err := fs.openDir(filepath.Dir(p), false)
+		if err != nil {
+			return Stat{}, err
+		}
+		s := archiveSource{dir: parent, name: filepath.Base(p), rel: filepath.ToSlash(rel)}
+		sources = append(sources, s)
+
+		err = walkAt(int(parent.Fd()), s.name, s.rel, func(_ int, _, _ string, info os.FileInfo) error {
+			if info.Mode().IsRegular() {
+				total += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return Stat{}, err
+		}
+	}
+
+	if err := fs.HasSpaceAvailable(true); err != nil {
+		return Stat{}, err
+	}
+
+	name := fmt.Sprintf("archive-%s.%s", time.Now().Format("2006-01-02T150405"), format)
+	fd, err := unix.Openat(int(base.Fd()), name, unix.O_CREAT|unix.O_EXCL|unix.O_WRONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0o644)
+	if err != nil {
+		return Stat{}, errors.Wrap(&os.PathError{Op: "open", Path: name, Err: err}, "filesystem: failed to create archive")
+	}
+	out := os.NewFile(uintptr(fd), name)
+	remove := func() {
+		_ = out.Close()
+		_ = unix.Unlinkat(int(base.Fd()), name, 0)
+	}
+
+	self, err := out.Stat()
+	if err != nil {
+		remove()
+		return Stat{}, errors.Wrap(err, "filesystem: failed to stat archive")
+	}
+	tracker := &progressTracker{fn: progress, p: ArchiveProgress{Archive: filepath.Join(dir, name), Total: total}}
+	qw, err := fs.newQuotaWriter(out, 0)
+	if err != nil {
+		remove()
+		return Stat{}, err
+	}
+
+	if err := writeArchive(qw, format, self, sources, tracker); err != nil {
+		remove()
+		if errors.Is(err, ErrNotEnoughDiskSpace) {
+			return Stat{}, ErrNotEnoughDiskSpace
+		}
+		return Stat{}, err
+	}
+
+	fs.addDisk(qw.written)
+	if err := fs.fchown(out); err != nil {
+		_ = out.Close()
+		return Stat{}, err
+	}
+	tracker.done()
+
+	info, err := out.Stat()
+	if cerr := out.Close(); err == nil && cerr != nil {
+		err = errors.Wrap(cerr, "filesystem: failed to write archive")
+	}
+	if err != nil {
+		return Stat{}, errors.Wrap(err, "filesystem: failed to stat archive")
+	}
+	return newStat(info), nil
+}
+
+// archiveSource is an entry to be added to an archive along with the opened
+// directory it is in and its name within the archive
+type archiveSource struct {
+	dir  *os.File
+	name string
+	rel  string
+}
+
+// archiveWriter adds entries to an archive of any format
+type archiveWriter interface {
+	// add writes an entry to the archive. The reader is only set for regular
+	// files, and link only for symlinks.
+	add(name string, info os.FileInfo, link string, r io.Reader) error
+	Close() error
+}
+
+func writeArchive(w io.Writer, format string, self os.FileInfo, sources []archiveSource, tracker *progressTracker) error {
+	var aw archiveWriter
+	switch format {
+	case ArchiveZip:
+		aw = &zipWriter{zip.NewWriter(w)}
+	case ArchiveTarGz:
+		gw := gzip.NewWriter(w)
+		aw = &tarWriter{tw: tar.NewWriter(gw), compressor: gw}
+	case ArchiveTarZst:
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return errors.Wrap(err, "filesystem: failed to create zstd writer")
+		}
+		aw = &tarWriter{tw: tar.NewWriter(zw), compressor: zw}
+	}
+
+	for _, src := range sources {
+		err := walkAt(int(src.dir.Fd()), src.name, src.rel, func(dirfd int, name, rel string, info os.FileInfo) error {
+			// Never include the archive being written in itself
+			if os.SameFile(info, self) {
+				return nil
+			}
+			return addToArchive(aw, dirfd, name, rel, info, tracker)
+		})
+		if err != nil {
+			_ = aw.Close()
+			return errors.Wrap(err, "filesystem: failed to write archive")
+		}
+	}
+
+	if err := aw.Close(); err != nil {
+		return errors.Wrap(err, "filesystem: failed to write archive")
+	}
+	return nil
+}
+
+func addToArchive(aw archiveWriter, dirfd int, name, rel string, info os.FileInfo, tracker *progressTracker) error {
+	switch {
+	case info.IsDir():
+		return aw.add(rel+"/", info, "", nil)
+	case info.Mode()&os.ModeSymlink != 0:
+		buf := make([]byte, unix.PathMax)
+		n, err := unix.Readlinkat(dirfd, name, buf)
+		if err != nil {
+			return &os.PathError{Op: "readlink", Path: name, Err: err}
+		}
+		return aw.add(rel, info, string(buf[:n]), nil)
+	case info.Mode().IsRegular():
+		fd, err := unix.Openat(dirfd, name, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		f := os.NewFile(uintptr(fd), name)
+		defer f.Close()
+		return aw.add(rel, info, "", &countingReader{r: f, tracker: tracker})
+	}
+
+	// Sockets, devices and pipes cannot be meaningfully archived
+	return nil
+}
+
+type tarWriter struct {
+	tw         *tar.Writer
+	compressor io.WriteCloser
+}
+
+func (w *tarWriter) add(name string, info os.FileInfo, link string, r io.Reader) error {
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	// Ownership is meaningless outside of this host
+	hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if r != nil {
+		if _, err := io.Copy(w.tw, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *tarWriter) Close() error {
+	if err := w.tw.Close(); err != nil {
+		_ = w.compressor.Close()
+		return err
+	}
+	return w.compressor.Close()
+}
+
+type zipWriter struct {
+	zw *zip.Writer
+}
+
+func (w *zipWriter) add(name string, info os.FileInfo, link string, r io.Reader) error {
+	hdr, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if info.Mode().IsRegular() {
+		hdr.Method = zip.Deflate
+	}
+
+	out, err := w.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	switch {
+	case link != "":
+		// Zip stores the target of a symlink as its contents
+		_, err = io.WriteString(out, link)
+	case r != nil:
+		_, err = io.Copy(out, r)
+	}
+	return err
+}
+
+func (w *zipWriter) Close() error {
+	return w.zw.Close()
+}
+
+// Decompress extracts an archive into the given directory, overwriting any
+// files that already exist. Entries that would end up outside of the
+// directory, symlinks pointing outside of the root, and archives that expand
+// to more than the disk quota or a sane multiple of their own size are
+// refused. Anything extracted before an error is left in place.
+func (fs *Filesystem) Decompress(dir, file string, progress ProgressFunc) error {
+	format, err := archiveFormat(file)
+	if err != nil {
+		return err
+	}
+
+	src, st, err := fs.File(file)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	cleanedDir, err := fs.SafePath(dir)
+	if err != nil {
+		return err
+	}
+	if err := fs.mkdirAll(cleanedDir); err != nil {
+		return err
+	}
+
+	if err := fs.HasSpaceAvailable(true); err != nil {
+		return err
+	}
+
+	e := &extractor{
+		fs:      fs,
+		dir:     dir,
+		maxSize: max(st.Size()*maxCompressionRatio, minExpandedSize),
+	}
+	if e.quota, e.limited, err = fs.remainingDisk(); err != nil {
+		return err
+	}
+	tracker := &progressTracker{fn: progress, p: ArchiveProgress{Archive: file, Total: st.Size()}}
+
+	switch format {
+	case ArchiveZip:
+		err = e.extractZip(src, st.Size(), tracker)
+	case ArchiveTarGz:
+		var gr *gzip.Reader
+		if gr, err = gzip.NewReader(&countingReader{r: src, tracker: tracker}); err == nil {
+			err = e.extractTar(gr)
+			_ = gr.Close()
+		}
+	case ArchiveTarZst:
+		var zr *zstd.Decoder
+		if zr, err = zstd.NewReader(&countingReader{r: src, tracker: tracker}); err == nil {
+			err = e.extractTar(zr)
+			zr.Close()
+		}
+	}
+	if err != nil {
+		if errors.Is(err, ErrNotEnoughDiskSpace) || errors.Is(err, ErrArchiveTooLarge) || errors.Is(err, ErrBadPathResolution) {
+			return errors.Cause(err)
+		}
+		return errors.Wrap(err, "filesystem: failed to decompress archive")
+	}
+
+	tracker.done()
+	return nil
+}
+
+// ExtractTarGz extracts a gzipped tar stream into the given directory. It is
+// meant for archives created by the shard itself, such as backups, so only the
+// path and quota checks apply and not the compression ratio.
+func (fs *Filesystem) ExtractTarGz(dir string, r io.Reader) error {
+	cleanedDir, err := fs.SafePath(dir)
+	if err != nil {
+		return err
+	}
+	if err := fs.mkdirAll(cleanedDir); err != nil {
+		return err
+	}
+
+	e := &extractor{fs: fs, dir: dir, maxSize: math.MaxInt64}
+	if e.quota, e.limited, err = fs.remainingDisk(); err != nil {
+		return err
+	}
+
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return errors.Wrap(err, "filesystem: failed to decompress archive")
+	}
+	defer gr.Close()
+
+	if err := e.extractTar(gr); err != nil {
+		if errors.Is(err, ErrNotEnoughDiskSpace) || errors.Is(err, ErrBadPathResolution) {
+			return errors.Cause(err)
+		}
+		return errors.Wrap(err, "filesystem: failed to decompress archive")
+	}
+	return nil
+}
+
+// extractor writes the entries of an archive into a directory of the
+// filesystem, keeping track of how much has been written
+type extractor struct {
+	fs *Filesystem
+	// The directory being extracted into, relative to the root
+	dir string
+
+	// The bytes written so far, the most that may be written before the
+	// archive is considered a bomb, and the space left in the disk quota
+	written int64
+	maxSize int64
+	limited bool
+	quota   int64
+}
+
+func (e *extractor) extractZip(src *os.File, size int64, tracker *progressTracker) error {
+	zr, err := zip.NewReader(src, size)
+	if err != nil {
+		return err
+	}
+
+	// The sizes in the header can lie, but they are checked again while
+	// writing. This just avoids extracting half of an obviously oversized
+	// archive before failing.
+	var declared uint64
+	for _, f := range zr.File {
+		declared += f.UncompressedSize64
+	}
+	if declared > uint64(e.maxSize) {
+		return ErrArchiveTooLarge
+	}
+	if e.limited && declared > uint64(max(e.quota, 0)) {
+		return ErrNotEnoughDiskSpace
+	}
+
+	for _, f := range zr.File {
+		if err := e.extractZipFile(f); err != nil {
+			return errors.Wrap(err, f.Name)
+		}
+		tracker.add(int64(f.CompressedSize64))
+	}
+	return nil
+}
+
+func (e *extractor) extractZipFile(f *zip.File) error {
+	mode := f.Mode()
+	if mode.IsDir() {
+		return e.directory(f.Name)
+	}
+	if mode&os.ModeSymlink == 0 && !mode.IsRegular() {
+		return nil
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if mode&os.ModeSymlink != 0 {
+		target, err := io.ReadAll(io.LimitReader(rc, maxSymlinkTarget))
+		if err != nil {
+			return err
+		}
+		return e.symlink(f.Name, string(target))
+	}
+	return e.file(f.Name, mode, rc)
+}
+
+func (e *extractor) extractTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = e.directory(hdr.Name)
+		case tar.TypeReg:
+			err = e.file(hdr.Name, hdr.FileInfo().Mode(), tr)
+		case tar.TypeSymlink:
+			err = e.symlink(hdr.Name, hdr.Linkname)
+		default:
+			// Hard links, devices and pipes are skipped, none of them have any
+			// business being in an instance data directory
+		}
+		if err != nil {
+			return errors.Wrap(err, hdr.Name)
+		}
+	}
+}
+
+// path returns the root relative path of an entry. Entries are rejected rather
+// than cleaned up if they try to escape the directory being extracted into.
+func (e *extractor) path(name string) (string, error) {
+	name = strings.TrimSuffix(filepath.FromSlash(name), string(filepath.Separator))
+	if name == "" || !filepath.IsLocal(name) {
+		return "", ErrBadPathResolution
+	}
+	return filepath.Join(e.dir, name), nil
+}
+
+func (e *extractor) directory(name string) error {
+	p, err := e.path(name)
+	if err != nil {
+		return err
+	}
+	cleaned, err := e.fs.SafePath(p)
+	if err != nil {
+		return err
+	}
+	return e.fs.mkdirAll(cleaned)
+}
+
+func (e *extractor) file(name string, mode os.FileMode, r io.Reader) error {
+	p, err := e.path(name)
+	if err != nil {
+		return err
+	}
+	// Resolving the path follows any symlinks created by earlier entries, so
+	// an archive cannot write through a link to outside of the root
+	cleaned, err := e.fs.SafePath(p)
+	if err != nil {
+		return err
+	}
+
+	var existing int64
+	if st, err := os.Lstat(cleaned); err == nil {
+		if st.IsDir() {
+			return ErrIsDirectory
+		}
+		existing = st.Size()
+	}
+
+	perm := mode.Perm()
+	if perm == 0 {
+		perm = 0o644
+	}
+	f, err := e.fs.openFile(cleaned, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm, true)
+	if err != nil {
+		return err
+	}
+
+	// Truncating the file has already freed up the space it was using
+	e.quota += existing
+	e.fs.addDisk(-existing)
+
+	n, err := io.Copy(&extractWriter{w: f, e: e}, r)
+	e.fs.addDisk(n)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return e.fs.fchown(f)
+}
+
+func (e *extractor) symlink(name, target string) error {
+	p, err := e.path(name)
+	if err != nil {
+		return err
+	}
+	cleaned, err := e.fs.unresolvedPath(p)
+	if err != nil {
+		return err
+	}
+
+	// The link is harmless by itself since every path is resolved before it
+	// is used, but there is no good reason for an archive to point outside
+	// of the root
+	if target == "" || filepath.IsAbs(target) {
+		return ErrBadPathResolution
+	}
+	root, err := filepath.EvalSymlinks(e.fs.root)
+	if err != nil {
+		return errors.Wrap(err, "filesystem: failed to resolve root directory")
+	}
+	if !isWithin(filepath.Join(filepath.Dir(cleaned), target), root) {
+		return ErrBadPathResolution
+	}
+
+	dir, err := e.fs.openDir(filepath.Dir(cleaned), true)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	dirfd, base := int(dir.Fd()), filepath.Base(cleaned)
+
+	if st, err := statAt(dirfd, base); err == nil {
+		if st.Mode&unix.S_IFMT == unix.S_IFDIR {
+			return ErrIsDirectory
+		}
+		if err := unix.Unlinkat(dirfd, base, 0); err != nil {
+			return &os.PathError{Op: "unlink", Path: cleaned, Err: err}
+		}
+		if st.Mode&unix.S_IFMT == unix.S_IFREG {
+			e.quota += st.Size
+			e.fs.addDisk(-st.Size)
+		}
+	}
+
+	if err := unix.Symlinkat(target, dirfd, base); err != nil {
+		return &os.LinkError{Op: "symlink", Old: target, New: cleaned, Err: err}
+	}
+	return e.fs.chownAt(dirfd, base)
+}
+
+// extractWriter fails once an archive has written more than it is allowed
+type extractWriter struct {
+	w io.Writer
+	e *extractor
+}
+
+func (ew *extractWriter) Write(p []byte) (int, error) {
+	next := ew.e.written + int64(len(p))
+	if next > ew.e.maxSize {
+		return 0, ErrArchiveTooLarge
+	}
+	if ew.e.limited && int64(len(p)) > ew.e.quota {
+		return 0, ErrNotEnoughDiskSpace
+	}
+
+	n, err := ew.w.Write(p)
+	ew.e.written += int64(n)
+	ew.e.quota -= int64(n)
+	return n, err
+}
+
+// progressTracker calls the progress function at most once per interval
+type progressTracker struct {
+	fn   ProgressFunc
+	p    ArchiveProgress
+	last time.Time
+}
+
+func (t *progressTracker) add(n int64) {
+	t.p.Processed += n
+	if t.fn != nil && time.Since(t.last) >= progressInterval {
+		t.last = time.Now()
+		t.fn(t.p)
+	}
+}
+
+func (t *progressTracker) done() {
+	t.p.Done = true
+	t.p.Processed = t.p.Total
+	if t.fn != nil {
+		t.fn(t.p)
+	}
+}
+
+// countingReader reports the bytes read through it to a progress tracker
+type countingReader struct {
+	r       io.Reader
+	tracker *progressTracker
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.tracker.add(int64(n))
+	return n, err
+}
@@ -0,0 +1,382 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+// entry is a single file, directory or symlink in an archive fixture
+type entry struct {
+	name string
+	body string
+	// The number of zero bytes to use as the body instead
+	zeros int
+	link  string
+	dir   bool
+}
+
+func (e entry) contents() []byte {
+	if e.zeros > 0 {
+		return make([]byte, e.zeros)
+	}
+	return []byte(e.body)
+}
+
+func tarGzFixture(t *testing.T, entries []entry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0o644, Typeflag: tar.TypeReg}
+		switch {
+		case e.dir:
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0o755
+		case e.link != "":
+			hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, e.link
+		default:
+			hdr.Size = int64(len(e.contents()))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tw.Write(e.contents()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zipFixture(t *testing.T, entries []entry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		body := e.contents()
+		switch {
+		case e.dir:
+			hdr.SetMode(os.ModeDir | 0o755)
+		case e.link != "":
+			hdr.SetMode(os.ModeSymlink | 0o777)
+			body = []byte(e.link)
+		default:
+			hdr.SetMode(0o644)
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// newArchiveFilesystem returns a filesystem with its root inside of another
+// temporary directory, so that anything written just outside of the root can
+// be seen
+func newArchiveFilesystem(t *testing.T) (*Filesystem, string) {
+	t.Helper()
+
+	parent := t.TempDir()
+	fs := New(filepath.Join(parent, "root"))
+	if err := fs.EnsureRoot(); err != nil {
+		t.Fatal(err)
+	}
+	return fs, parent
+}
+
+// onlyRoot fails the test if anything other than the root was created in its
+// parent directory
+func onlyRoot(t *testing.T, parent string) {
+	t.Helper()
+
+	entries, err := os.ReadDir(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "root" {
+		t.Fatalf("expected nothing to be written outside of the root, got %v", entries)
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	fixtures := map[string]func(*testing.T, []entry) []byte{
+		"archive.tar.gz": tarGzFixture,
+		"archive.zip":    zipFixture,
+	}
+	for name, fixture := range fixtures {
+		t.Run(name, func(t *testing.T) {
+			fs, parent := newArchiveFilesystem(t)
+			archive := fixture(t, []entry{
+				{name: "dir/", dir: true},
+				{name: "dir/file", body: "hello"},
+				{name: "dir/link", link: "file"},
+				{name: "top", body: "world"},
+			})
+			if err := fs.Write(name, bytes.NewReader(archive)); err != nil {
+				t.Fatal(err)
+			}
+
+			var last ArchiveProgress
+			if err := fs.Decompress("/out", name, func(p ArchiveProgress) { last = p }); err != nil {
+				t.Fatal(err)
+			}
+			if !last.Done {
+				t.Fatal("expected the final progress to be reported")
+			}
+
+			for p, want := range map[string]string{"out/dir/file": "hello", "out/dir/link": "hello", "out/top": "world"} {
+				f, _, err := fs.File(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var b bytes.Buffer
+				_, _ = b.ReadFrom(f)
+				_ = f.Close()
+				if b.String() != want {
+					t.Fatalf("expected %s to contain %q, got %q", p, want, b.String())
+				}
+			}
+			onlyRoot(t, parent)
+		})
+	}
+}
+
+func TestDecompress_Rejected(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []entry
+		err     error
+		// Sets up the filesystem before extracting
+		setup func(t *testing.T, fs *Filesystem, parent string)
+	}{
+		{
+			name:    "parent traversal",
+			entries: []entry{{name: "../x", body: "escaped"}},
+			err:     ErrBadPathResolution,
+		},
+		{
+			name:    "nested traversal",
+			entries: []entry{{name: "a/../../../x", body: "escaped"}},
+			err:     ErrBadPathResolution,
+		},
+		{
+			name:    "absolute path",
+			entries: []entry{{name: "/x", body: "escaped"}},
+			err:     ErrBadPathResolution,
+		},
+		{
+			name:    "absolute symlink",
+			entries: []entry{{name: "link", link: "/"}, {name: "link/x", body: "escaped"}},
+			err:     ErrBadPathResolution,
+		},
+		{
+			name:    "symlink outside",
+			entries: []entry{{name: "link", link: "../../.."}, {name: "link/x", body: "escaped"}},
+			err:     ErrBadPathResolution,
+		},
+		{
+			name:    "file through existing symlink",
+			entries: []entry{{name: "link/x", body: "escaped"}},
+			err:     ErrBadPathResolution,
+			setup: func(t *testing.T, fs *Filesystem, parent string) {
+				if err := os.Symlink(parent, filepath.Join(fs.Path(), "out", "link")); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name:    "ratio bomb",
+			entries: []entry{{name: "zeros", zeros: 1 << 20}},
+			err:     ErrArchiveTooLarge,
+			setup: func(t *testing.T, fs *Filesystem, parent string) {
+				min := minExpandedSize
+				minExpandedSize = 64 * 1024
+				t.Cleanup(func() { minExpandedSize = min })
+			},
+		},
+		{
+			name:    "size bomb",
+			entries: []entry{{name: "zeros", zeros: 1 << 20}},
+			err:     ErrNotEnoughDiskSpace,
+			setup: func(t *testing.T, fs *Filesystem, parent string) {
+				fs.SetDiskLimit(512 * 1024)
+			},
+		},
+	}
+
+	fixtures := map[string]func(*testing.T, []entry) []byte{
+		"archive.tar.gz": tarGzFixture,
+		"archive.zip":    zipFixture,
+	}
+	for _, tt := range tests {
+		for name, fixture := range fixtures {
+			t.Run(tt.name+"/"+name, func(t *testing.T) {
+				fs, parent := newArchiveFilesystem(t)
+				if err := os.Mkdir(filepath.Join(fs.Path(), "out"), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(fs.Path(), name), fixture(t, tt.entries), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				if tt.setup != nil {
+					tt.setup(t, fs, parent)
+				}
+
+				if err := fs.Decompress("out", name, nil); !errors.Is(err, tt.err) {
+					t.Fatalf("expected %v, got %v", tt.err, err)
+				}
+				onlyRoot(t, parent)
+				if _, err := os.Lstat(filepath.Join(fs.Path(), "x")); !os.IsNotExist(err) {
+					t.Fatal("expected nothing to be written outside of the extraction directory")
+				}
+			})
+		}
+	}
+}
+
+func TestExtractTarGz_Rejected(t *testing.T) {
+	for _, entries := range [][]entry{
+		{{name: "../x", body: "escaped"}},
+		{{name: "/x", body: "escaped"}},
+		{{name: "link", link: "../.."}, {name: "link/x", body: "escaped"}},
+	} {
+		fs, parent := newArchiveFilesystem(t)
+		err := fs.ExtractTarGz("out", bytes.NewReader(tarGzFixture(t, entries)))
+		if !errors.Is(err, ErrBadPathResolution) {
+			t.Fatalf("expected %s to be rejected, got %v", entries[0].name, err)
+		}
+		onlyRoot(t, parent)
+	}
+}
+
+func TestCompress_RoundTrip(t *testing.T) {
+	for _, format := range []string{ArchiveZip, ArchiveTarGz, ArchiveTarZst} {
+		t.Run(format, func(t *testing.T) {
+			fs, _ := newArchiveFilesystem(t)
+			if err := fs.Write("src/a", bytes.NewReader([]byte("a"))); err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.Write("src/sub/b", bytes.NewReader([]byte("b"))); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink("a", filepath.Join(fs.Path(), "src", "link")); err != nil {
+				t.Fatal(err)
+			}
+
+			st, err := fs.Compress("src", nil, format, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.Decompress("dst", filepath.Join("src", st.Name()), nil); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, p := range []string{"dst/a", "dst/sub/b", "dst/link"} {
+				if _, err := fs.Stat(p); err != nil {
+					t.Fatalf("expected %s to be extracted: %v", p, err)
+				}
+			}
+			if target, err := os.Readlink(filepath.Join(fs.Path(), "dst", "link")); err != nil || target != "a" {
+				t.Fatalf("expected the link to be kept, got %q (%v)", target, err)
+			}
+		})
+	}
+}
+
+func TestCompress_Symlinks(t *testing.T) {
+	fs, outside := newEscapeFilesystem(t)
+
+	st, err := fs.Compress("", []string{"out-dir", "out-file", "real"}, ArchiveTarGz, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	untouched(t, outside)
+
+	f, err := os.Open(filepath.Join(fs.Path(), st.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+
+	// The links are stored as links rather than the files outside of the root
+	want := map[string]byte{"out-dir": tar.TypeSymlink, "out-file": tar.TypeSymlink, "real": tar.TypeReg}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		typ, ok := want[hdr.Name]
+		if !ok || hdr.Typeflag != typ {
+			t.Fatalf("unexpected entry %s of type %c", hdr.Name, hdr.Typeflag)
+		}
+		delete(want, hdr.Name)
+	}
+	if len(want) != 0 {
+		t.Fatalf("expected every source to be archived, missing %v", want)
+	}
+}
+
+// Simulates the instance replacing a directory with a symlink after it has
+// been seen but before it is entered
+func TestCompress_SwappedDuringWalk(t *testing.T) {
+	fs, outside := newEscapeFilesystem(t)
+	if err := fs.CreateDirectory("src/dir"); err != nil {
+		t.Fatal(err)
+	}
+	src, err := fs.openDir(filepath.Join(fs.Path(), "src"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	var names []string
+	err = walkAt(int(src.Fd()), "dir", "dir", func(dirfd int, name, rel string, info os.FileInfo) error {
+		names = append(names, rel)
+		if rel == "dir" {
+			if err := os.Remove(filepath.Join(fs.Path(), "src", "dir")); err != nil {
+				return err
+			}
+			return os.Symlink(outside, filepath.Join(fs.Path(), "src", "dir"))
+		}
+		return nil
+	})
+	if !errors.Is(err, ErrBadPathResolution) {
+		t.Fatalf("expected the swapped directory to be rejected, got %v", err)
+	}
+	if len(names) != 1 {
+		t.Fatalf("expected nothing outside of the root to be walked, got %v", names)
+	}
+}
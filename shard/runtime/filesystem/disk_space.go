@@ -0,0 +1,223 @@
+package filesystem
+
+import (
+	"io"
+	iofs "io/fs"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/pkg/errors"
+)
+
+var ErrNotEnoughDiskSpace = errors.New("filesystem: not enough disk space")
+
+// DefaultDiskCheckInterval is how long a disk usage lookup is cached for
+// before the data directory is walked again
+const DefaultDiskCheckInterval = 150 * time.Second
+
+// diskUsage tracks the disk usage of the filesystem. The usage is calculated
+// by walking the whole directory, which is expensive, so the result is cached
+// and kept up to date with the changes made through the filesystem in
+// between lookups.
+type diskUsage struct {
+	// Bytes used and the limit in bytes, where a limit of zero is unlimited
+	used  int64
+	limit int64
+
+	interval time.Duration
+
+	mu         sync.Mutex
+	lastLookup time.Time
+	// lookup is closed once the walk in progress has finished, and is nil
+	// while no walk is running
+	lookup    chan struct{}
+	lookupErr error
+}
+
+// SetDiskLimit sets the maximum number of bytes the filesystem may use, or
+// zero for no limit
+func (fs *Filesystem) SetDiskLimit(limit int64) {
+	atomic.StoreInt64(&fs.disk.limit, limit)
+}
+
+// SetDiskCheckInterval sets how long a disk usage lookup is cached for
+func (fs *Filesystem) SetDiskCheckInterval(d time.Duration) {
+	fs.disk.mu.Lock()
+	defer fs.disk.mu.Unlock()
+	fs.disk.interval = d
+}
+
+// MaxDisk returns the disk limit in bytes, or zero if there is no limit
+func (fs *Filesystem) MaxDisk() int64 {
+	return atomic.LoadInt64(&fs.disk.limit)
+}
+
+// CachedUsage returns the last known disk usage in bytes without triggering
+// a lookup. It is zero until the first lookup has completed.
+func (fs *Filesystem) CachedUsage() int64 {
+	return atomic.LoadInt64(&fs.disk.used)
+}
+
+// DiskUsage returns the disk usage in bytes. If the cached value is stale it
+// is recalculated, unless allowStale is set, in which case the cached value is
+// returned and the recalculation happens in the background. The first lookup
+// always blocks, since nothing is known about the usage before it, and so does
+// a lookup that is not allowed to be stale while another is in progress.
+func (fs *Filesystem) DiskUsage(allowStale bool) (int64, error) {
+	fs.disk.mu.Lock()
+	cold := fs.disk.lastLookup.IsZero()
+	if !cold && time.Since(fs.disk.lastLookup) <= fs.disk.interval {
+		fs.disk.mu.Unlock()
+		return fs.CachedUsage(), nil
+	}
+
+	done := fs.disk.lookup
+	if done == nil {
+		done = make(chan struct{})
+		fs.disk.lookup = done
+		go fs.updateDiskUsage(done)
+	}
+	fs.disk.mu.Unlock()
+
+	if allowStale && !cold {
+		return fs.CachedUsage(), nil
+	}
+
+	<-done
+	fs.disk.mu.Lock()
+	err := fs.disk.lookupErr
+	fs.disk.mu.Unlock()
+	return fs.CachedUsage(), err
+}
+
+// updateDiskUsage walks the whole directory to calculate the disk usage,
+// closing done once it has finished
+func (fs *Filesystem) updateDiskUsage(done chan struct{}) {
+	size, err := directorySize(fs.root)
+	if err != nil {
+		log.With("root", fs.root).Warn("failed to calculate disk usage", "err", err)
+	}
+
+	fs.disk.mu.Lock()
+	if err == nil {
+		atomic.StoreInt64(&fs.disk.used, size)
+		fs.disk.lastLookup = time.Now()
+	}
+	fs.disk.lookupErr = err
+	fs.disk.lookup = nil
+	fs.disk.mu.Unlock()
+
+	close(done)
+}
+
+// remainingDisk returns the number of bytes left in the quota, or false if
+// there is no limit
+func (fs *Filesystem) remainingDisk() (int64, bool, error) {
+	limit := fs.MaxDisk()
+	if limit == 0 {
+		return 0, false, nil
+	}
+	used, err := fs.DiskUsage(true)
+	if err != nil {
+		return 0, true, err
+	}
+	return limit - used, true, nil
+}
+
+// HasSpaceAvailable returns ErrNotEnoughDiskSpace if the filesystem is using
+// all the space it is allowed
+func (fs *Filesystem) HasSpaceAvailable(allowStale bool) error {
+	if fs.MaxDisk() == 0 {
+		return nil
+	}
+
+	used, err := fs.DiskUsage(allowStale)
+	if err != nil {
+		return err
+	}
+	if used >= fs.MaxDisk() {
+		return ErrNotEnoughDiskSpace
+	}
+	return nil
+}
+
+// HasSpaceFor returns ErrNotEnoughDiskSpace if writing the given number of
+// bytes would exceed the disk limit
+func (fs *Filesystem) HasSpaceFor(size int64) error {
+	if fs.MaxDisk() == 0 || size <= 0 {
+		return nil
+	}
+
+	used, err := fs.DiskUsage(true)
+	if err != nil {
+		return err
+	}
+	if used+size > fs.MaxDisk() {
+		return ErrNotEnoughDiskSpace
+	}
+	return nil
+}
+
+// addDisk adjusts the cached disk usage after a change was made through the
+// filesystem, so that it stays accurate between lookups
+func (fs *Filesystem) addDisk(delta int64) {
+	if atomic.AddInt64(&fs.disk.used, delta) < 0 {
+		atomic.StoreInt64(&fs.disk.used, 0)
+	}
+}
+
+// directorySize returns the combined size of every file within a directory.
+// Symlinks are not followed.
+func directorySize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			// Files can disappear while walking a live directory
+			if errors.Is(err, iofs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, iofs.ErrNotExist) {
+		return 0, errors.Wrap(err, "filesystem: failed to calculate disk usage")
+	}
+	return size, nil
+}
+
+// quotaWriter wraps a writer and fails once more bytes have been written than
+// are available in the quota
+type quotaWriter struct {
+	w         io.Writer
+	remaining int64
+	limited   bool
+	written   int64
+}
+
+// newQuotaWriter returns a writer limited to the space left in the quota, plus
+// the given number of bytes that will be freed once the write completes
+func (fs *Filesystem) newQuotaWriter(w io.Writer, freed int64) (*quotaWriter, error) {
+	remaining, limited, err := fs.remainingDisk()
+	if err != nil {
+		return nil, err
+	}
+	return &quotaWriter{w: w, limited: limited, remaining: remaining + freed}, nil
+}
+
+func (qw *quotaWriter) Write(p []byte) (int, error) {
+	if qw.limited && qw.written+int64(len(p)) > qw.remaining {
+		return 0, ErrNotEnoughDiskSpace
+	}
+	n, err := qw.w.Write(p)
+	qw.written += int64(n)
+	return n, err
+}
@@ -0,0 +1,167 @@
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newFilesystem returns a filesystem rooted in a temporary directory that
+// already holds the given number of bytes, written without going through the
+// filesystem as if they were left by a previous run of the shard
+func newFilesystem(t *testing.T, existing int) *Filesystem {
+	t.Helper()
+
+	root := t.TempDir()
+	if existing > 0 {
+		if err := os.WriteFile(filepath.Join(root, "existing"), make([]byte, existing), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return New(root)
+}
+
+func TestDiskUsage_ColdCache(t *testing.T) {
+	fs := newFilesystem(t, 900)
+
+	if used := fs.CachedUsage(); used != 0 {
+		t.Fatalf("expected nothing cached before the first lookup, got %d", used)
+	}
+	// A stale value is not good enough when there is no value at all
+	used, err := fs.DiskUsage(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used != 900 {
+		t.Fatalf("expected the first lookup to walk the directory, got %d", used)
+	}
+}
+
+func TestDiskUsage_WaitsForLookup(t *testing.T) {
+	fs := newFilesystem(t, 900)
+
+	var wg sync.WaitGroup
+	for n := 0; n < 10; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if used, err := fs.DiskUsage(false); err != nil || used != 900 {
+				t.Errorf("expected 900 bytes, got %d (%v)", used, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestDiskUsage_StaleRefresh(t *testing.T) {
+	fs := newFilesystem(t, 100)
+	fs.SetDiskCheckInterval(time.Millisecond)
+
+	if _, err := fs.DiskUsage(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(fs.Path(), "more"), make([]byte, 50), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	if used, err := fs.DiskUsage(false); err != nil || used != 150 {
+		t.Fatalf("expected a stale value to be recalculated, got %d (%v)", used, err)
+	}
+}
+
+func TestQuota_ColdCache(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(fs *Filesystem) error
+	}{
+		{"write", func(fs *Filesystem) error {
+			return fs.Write("file", bytes.NewReader(make([]byte, 200)))
+		}},
+		{"open write", func(fs *Filesystem) error {
+			w, err := fs.OpenWrite("file", os.O_CREATE)
+			if err != nil {
+				return err
+			}
+			defer w.Close()
+			_, err = w.WriteAt(make([]byte, 200), 0)
+			return err
+		}},
+		{"copy", func(fs *Filesystem) error {
+			if err := os.WriteFile(filepath.Join(fs.Path(), "small"), make([]byte, 20), 0o644); err != nil {
+				return err
+			}
+			return fs.Copy("small", "copied")
+		}},
+		{"compress", func(fs *Filesystem) error {
+			_, err := fs.Compress("/", []string{"existing"}, ArchiveTarGz, nil)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Leaves less room than even an empty archive needs
+			fs := newFilesystem(t, 990)
+			fs.SetDiskLimit(1000)
+
+			if err := tt.write(fs); !errors.Is(err, ErrNotEnoughDiskSpace) {
+				t.Fatalf("expected the files already on disk to count against the quota, got %v", err)
+			}
+		})
+	}
+}
+
+func TestQuota_Write(t *testing.T) {
+	fs := newFilesystem(t, 0)
+	fs.SetDiskLimit(1000)
+
+	if err := fs.Write("a", bytes.NewReader(make([]byte, 600))); err != nil {
+		t.Fatal(err)
+	}
+	if used := fs.CachedUsage(); used != 600 {
+		t.Fatalf("expected 600 bytes used, got %d", used)
+	}
+
+	if err := fs.Write("b", bytes.NewReader(make([]byte, 600))); !errors.Is(err, ErrNotEnoughDiskSpace) {
+		t.Fatalf("expected a write past the quota to fail, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(fs.Path(), "b")); !os.IsNotExist(err) {
+		t.Fatal("expected nothing to be left behind by the failed write")
+	}
+
+	// Replacing a file frees the space it was using
+	if err := fs.Write("a", bytes.NewReader(make([]byte, 900))); err != nil {
+		t.Fatalf("expected replacing a file to reuse its space, got %v", err)
+	}
+	if used := fs.CachedUsage(); used != 900 {
+		t.Fatalf("expected 900 bytes used, got %d", used)
+	}
+
+	if err := fs.HasSpaceFor(200); !errors.Is(err, ErrNotEnoughDiskSpace) {
+		t.Fatalf("expected no space for 200 more bytes, got %v", err)
+	}
+	if err := fs.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.HasSpaceAvailable(false); err != nil {
+		t.Fatalf("expected space after deleting, got %v", err)
+	}
+}
+
+func TestQuota_HasSpaceAvailable(t *testing.T) {
+	fs := newFilesystem(t, 1000)
+	fs.SetDiskLimit(1000)
+
+	if err := fs.HasSpaceAvailable(true); !errors.Is(err, ErrNotEnoughDiskSpace) {
+		t.Fatalf("expected a full filesystem on the first lookup, got %v", err)
+	}
+
+	fs.SetDiskLimit(0)
+	if err := fs.HasSpaceAvailable(false); err != nil {
+		t.Fatalf("expected no limit to always have space, got %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package filesystem
+
+import (
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// FileWriter is a file opened for random access writes. It keeps the disk
+// usage up to date as the file grows, and refuses writes that would grow it
+// past the disk limit.
+type FileWriter struct {
+	fs *Filesystem
+	f  *os.File
+
+	mu   sync.Mutex
+	size int64
+}
+
+// OpenWrite opens a file for writing with the given os.OpenFile flags,
+// creating any missing parent directories. O_APPEND is not supported since
+// every write is made at an explicit offset. The caller must close the file.
+func (fs *Filesystem) OpenWrite(p string, flag int) (*FileWriter, error) {
+	cleaned, err := fs.SafePath(p)
+	if err != nil {
+		return nil, err
+	}
+	if fs.isRoot(cleaned) {
+		return nil, ErrIsDirectory
+	}
+
+	var existing int64
+	st, err := fs.lstat(cleaned)
+	created := err != nil
+	if err == nil {
+		if st.IsDir() {
+			return nil, ErrIsDirectory
+		}
+		existing = st.Size()
+	}
+
+	if err := fs.HasSpaceAvailable(true); err != nil {
+		return nil, err
+	}
+
+	flag &^= os.O_APPEND | os.O_RDONLY | os.O_RDWR
+	f, err := fs.openFile(cleaned, flag|os.O_WRONLY, 0o644, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if flag&os.O_TRUNC != 0 {
+		fs.addDisk(-existing)
+		existing = 0
+	}
+	if created {
+		if err := fs.fchown(f); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+
+	return &FileWriter{fs: fs, f: f, size: existing}, nil
+}
+
+// WriteAt writes to the file at the given offset
+func (w *FileWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if grow := off + int64(len(p)) - w.size; grow > 0 {
+		if err := w.fs.HasSpaceFor(grow); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.f.WriteAt(p, off)
+	if end := off + int64(n); end > w.size {
+		w.fs.addDisk(end - w.size)
+		w.size = end
+	}
+	if err != nil {
+		return n, errors.Wrap(err, "filesystem: failed to write file")
+	}
+	return n, nil
+}
+
+// Close closes the file
+func (w *FileWriter) Close() error {
+	return w.f.Close()
+}
@@ -1,7 +1,509 @@
 package filesystem
 
-import "sync"
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	ErrBadPathResolution = errors.New("filesystem: path resolves outside of the root directory")
+	ErrIsDirectory       = errors.New("filesystem: path is a directory")
+	ErrNotDirectory      = errors.New("filesystem: path is not a directory")
+)
+
+// Filesystem provides access to the data directory of an instance. Every path
+// passed to it is relative to the root directory, and is resolved in a way
+// that symlinks cannot be used to escape the root.
 type Filesystem struct {
 	sync.RWMutex
+
+	root string
+
+	// The owner applied to everything created through the filesystem, or -1
+	// to leave the owner as the shard user
+	uid int
+	gid int
+
+	disk diskUsage
+}
+
+// New returns a filesystem rooted at the given directory. The directory does
+// not need to exist yet.
+func New(root string) *Filesystem {
+	return &Filesystem{
+		root: filepath.Clean(root),
+		uid:  -1,
+		gid:  -1,
+		disk: diskUsage{interval: DefaultDiskCheckInterval},
+	}
+}
+
+// Path returns the root directory of the filesystem on the host
+func (fs *Filesystem) Path() string {
+	return fs.root
+}
+
+// SetOwner sets the user and group that new files and directories are owned
+// by. Use -1 to leave either unchanged.
+func (fs *Filesystem) SetOwner(uid, gid int) {
+	fs.Lock()
+	defer fs.Unlock()
+	fs.uid = uid
+	fs.gid = gid
+}
+
+// EnsureRoot creates the root directory if it does not exist
+func (fs *Filesystem) EnsureRoot() error {
+	if err := os.MkdirAll(fs.root, 0o755); err != nil {
+		return errors.Wrap(err, "filesystem: failed to create root directory")
+	}
+	return fs.chown(fs.root)
+}
+
+// ChownAll applies the owner to everything within the root directory, such as
+// after an install script running as root has created files. Symlinks are
+// changed rather than followed.
+func (fs *Filesystem) ChownAll() error {
+	return filepath.Walk(fs.root, func(p string, _ os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return errors.Wrap(err, "filesystem: failed to walk root directory")
+		}
+		return fs.chown(p)
+	})
+}
+
+// SafePath resolves a path relative to the root into an absolute path on the
+// host, following any symlinks. An error is returned if the resolved path is
+// outside the root. The path does not need to exist, in which case the
+// deepest existing parent is resolved instead.
+func (fs *Filesystem) SafePath(p string) (string, error) {
+	root, err := filepath.EvalSymlinks(fs.root)
+	if err != nil {
+		return "", errors.Wrap(err, "filesystem: failed to resolve root directory")
+	}
+
+	joined := filepath.Join(root, filepath.Clean("/"+p))
+
+	// Walk up the path until we hit something that exists, then resolve that
+	// and add the missing parts back on to the end
+	existing := joined
+	var missing []string
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			existing = resolved
+			break
+		}
+		if !os.IsNotExist(err) {
+			return "", errors.Wrap(err, "filesystem: failed to resolve path")
+		}
+		// A dangling symlink cannot be resolved to check where it points, and
+		// creating anything through it could escape the root
+		if _, err := os.Lstat(existing); err == nil {
+			return "", ErrBadPathResolution
+		}
+
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return "", ErrBadPathResolution
+		}
+		missing = append([]string{filepath.Base(existing)}, missing...)
+		existing = parent
+	}
+
+	resolved := filepath.Join(append([]string{existing}, missing...)...)
+	if !isWithin(resolved, root) {
+		return "", ErrBadPathResolution
+	}
+	return resolved, nil
+}
+
+// unresolvedPath resolves the parent of a path but not the final element, so
+// that operations on a symlink act on the link itself rather than its target
+func (fs *Filesystem) unresolvedPath(p string) (string, error) {
+	p = filepath.Clean("/" + p)
+	parent, err := fs.SafePath(filepath.Dir(p))
+	if err != nil {
+		return "", err
+	}
+
+	cleaned := filepath.Join(parent, filepath.Base(p))
+	if cleaned == parent || fs.isRoot(cleaned) {
+		return "", ErrBadPathResolution
+	}
+	return cleaned, nil
+}
+
+// isWithin determines if the path is the directory or inside of it
+func isWithin(path, dir string) bool {
+	if path == dir {
+		return true
+	}
+	return strings.HasPrefix(path, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// isRoot determines if the resolved path is the root of the filesystem
+func (fs *Filesystem) isRoot(resolved string) bool {
+	root, err := filepath.EvalSymlinks(fs.root)
+	return err == nil && resolved == root
+}
+
+func (fs *Filesystem) owner() (int, int) {
+	fs.RLock()
+	defer fs.RUnlock()
+	return fs.uid, fs.gid
+}
+
+func (fs *Filesystem) chown(p string) error {
+	uid, gid := fs.owner()
+	if uid < 0 && gid < 0 {
+		return nil
+	}
+	if err := os.Lchown(p, uid, gid); err != nil {
+		return errors.Wrap(err, "filesystem: failed to change owner")
+	}
+	return nil
+}
+
+// chownAt applies the owner to an entry in a directory without following
+// symlinks
+func (fs *Filesystem) chownAt(dirfd int, name string) error {
+	uid, gid := fs.owner()
+	if uid < 0 && gid < 0 {
+		return nil
+	}
+	if err := unix.Fchownat(dirfd, name, uid, gid, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return errors.Wrap(&os.PathError{Op: "chown", Path: name, Err: err}, "filesystem: failed to change owner")
+	}
+	return nil
+}
+
+// fchown applies the owner to an open file
+func (fs *Filesystem) fchown(f *os.File) error {
+	uid, gid := fs.owner()
+	if uid < 0 && gid < 0 {
+		return nil
+	}
+	if err := f.Chown(uid, gid); err != nil {
+		return errors.Wrap(err, "filesystem: failed to change owner")
+	}
+	return nil
+}
+
+// mkdirAll creates a directory and any missing parents, applying the owner to
+// every directory it creates. The path must already be resolved.
+func (fs *Filesystem) mkdirAll(p string) error {
+	dir, err := fs.openDir(p, true)
+	if err != nil {
+		return err
+	}
+	return dir.Close()
+}
+
+// ListDirectory returns the contents of a directory, sorted by name
+func (fs *Filesystem) ListDirectory(p string) ([]Stat, error) {
+	cleaned, err := fs.SafePath(p)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := fs.openDir(cleaned, false)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, errors.Wrap(err, "filesystem: failed to read directory")
+	}
+	sort.Strings(names)
+
+	out := make([]Stat, 0, len(names))
+	for _, name := range names {
+		info, err := lstatAt(int(dir.Fd()), name)
+		if err != nil {
+			// The file was removed while listing
+			continue
+		}
+		out = append(out, newStat(info))
+	}
+	return out, nil
+}
+
+// Stat returns information about a file or directory
+func (fs *Filesystem) Stat(p string) (Stat, error) {
+	cleaned, err := fs.SafePath(p)
+	if err != nil {
+		return Stat{}, err
+	}
+
+	info, err := fs.lstat(cleaned)
+	if err != nil {
+		return Stat{}, err
+	}
+	return newStat(info), nil
+}
+
+// File opens a file for reading. The caller must close the file.
+func (fs *Filesystem) File(p string) (*os.File, Stat, error) {
+	cleaned, err := fs.SafePath(p)
+	if err != nil {
+		return nil, Stat{}, err
+	}
+	if fs.isRoot(cleaned) {
+		return nil, Stat{}, ErrIsDirectory
+	}
+
+	f, err := fs.openFile(cleaned, os.O_RDONLY, 0, false)
+	if err != nil {
+		return nil, Stat{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, Stat{}, errors.Wrap(err, "filesystem: failed to stat file")
+	}
+	if info.IsDir() {
+		_ = f.Close()
+		return nil, Stat{}, ErrIsDirectory
+	}
+
+	return f, newStat(info), nil
+}
+
+// Write writes the contents of the reader to a file, creating it and any
+// missing parent directories if needed, and replacing it otherwise. The
+// contents are written to a temporary file first, so the existing file is
+// left untouched if the write fails or would exceed the disk limit.
+func (fs *Filesystem) Write(p string, r io.Reader) error {
+	cleaned, err := fs.SafePath(p)
+	if err != nil {
+		return err
+	}
+	if fs.isRoot(cleaned) {
+		return ErrIsDirectory
+	}
+
+	if err := fs.HasSpaceAvailable(true); err != nil {
+		return err
+	}
+
+	dir, err := fs.openDir(filepath.Dir(cleaned), true)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	dirfd, name := int(dir.Fd()), filepath.Base(cleaned)
+
+	var existing int64
+	mode := os.FileMode(0o644)
+	if st, err := statAt(dirfd, name); err == nil {
+		switch st.Mode & unix.S_IFMT {
+		case unix.S_IFDIR:
+			return ErrIsDirectory
+		case unix.S_IFLNK:
+			// SafePath resolved any symlink, so this one appeared since
+			return ErrBadPathResolution
+		}
+		existing = st.Size
+		mode = os.FileMode(st.Mode).Perm()
+	}
+
+	tmp, tmpName, err := createTempAt(dirfd, name, mode)
+	if err != nil {
+		return errors.Wrap(err, "filesystem: failed to open file for writing")
+	}
+	defer unix.Unlinkat(dirfd, tmpName, 0)
+
+	// Replacing the file frees up the space it is currently using
+	qw, err := fs.newQuotaWriter(tmp, existing)
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if _, err := io.Copy(qw, r); err != nil {
+		_ = tmp.Close()
+		if errors.Is(err, ErrNotEnoughDiskSpace) {
+			return ErrNotEnoughDiskSpace
+		}
+		return errors.Wrap(err, "filesystem: failed to write file")
+	}
+
+	// The mode is set explicitly since creating the file applies the umask
+	if err := tmp.Chmod(mode); err != nil {
+		_ = tmp.Close()
+		return errors.Wrap(err, "filesystem: failed to set file mode")
+	}
+	if err := fs.fchown(tmp); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "filesystem: failed to write file")
+	}
+	if err := unix.Renameat(dirfd, tmpName, dirfd, name); err != nil {
+		return errors.Wrap(&os.LinkError{Op: "rename", Old: tmpName, New: cleaned, Err: err}, "filesystem: failed to write file")
+	}
+
+	fs.addDisk(qw.written - existing)
+	return nil
+}
+
+// CreateDirectory creates a directory and any missing parents
+func (fs *Filesystem) CreateDirectory(p string) error {
+	cleaned, err := fs.SafePath(p)
+	if err != nil {
+		return err
+	}
+	return fs.mkdirAll(cleaned)
+}
+
+// Rename moves a file or directory. The destination must not exist.
+func (fs *Filesystem) Rename(from, to string) error {
+	cleanedFrom, err := fs.unresolvedPath(from)
+	if err != nil {
+		return err
+	}
+	cleanedTo, err := fs.unresolvedPath(to)
+	if err != nil {
+		return err
+	}
+
+	fromDir, err := fs.openDir(filepath.Dir(cleanedFrom), false)
+	if err != nil {
+		return err
+	}
+	defer fromDir.Close()
+	toDir, err := fs.openDir(filepath.Dir(cleanedTo), true)
+	if err != nil {
+		return err
+	}
+	defer toDir.Close()
+
+	if _, err := statAt(int(toDir.Fd()), filepath.Base(cleanedTo)); err == nil {
+		return os.ErrExist
+	}
+	if err := unix.Renameat(int(fromDir.Fd()), filepath.Base(cleanedFrom), int(toDir.Fd()), filepath.Base(cleanedTo)); err != nil {
+		return &os.LinkError{Op: "rename", Old: cleanedFrom, New: cleanedTo, Err: err}
+	}
+	return nil
+}
+
+// Copy copies a file to a new location. The destination must not exist.
+func (fs *Filesystem) Copy(from, to string) error {
+	src, st, err := fs.File(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	cleanedTo, err := fs.SafePath(to)
+	if err != nil {
+		return err
+	}
+	if _, err := fs.lstat(cleanedTo); err == nil {
+		return os.ErrExist
+	}
+	if err := fs.HasSpaceFor(st.Size()); err != nil {
+		return err
+	}
+
+	dst, err := fs.openFile(cleanedTo, os.O_CREATE|os.O_EXCL|os.O_WRONLY, st.Mode().Perm(), true)
+	if err != nil {
+		return errors.Wrap(err, "filesystem: failed to create file")
+	}
+	defer dst.Close()
+
+	n, err := io.Copy(dst, src)
+	fs.addDisk(n)
+	if err != nil {
+		return errors.Wrap(err, "filesystem: failed to copy file")
+	}
+	return fs.fchown(dst)
+}
+
+// Delete removes a file or directory and everything within it. Symlinks are
+// removed themselves rather than what they point to.
+func (fs *Filesystem) Delete(p string) error {
+	cleaned, err := fs.unresolvedPath(p)
+	if err != nil {
+		return err
+	}
+
+	dir, err := fs.openDir(filepath.Dir(cleaned), false)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	if _, err := statAt(int(dir.Fd()), filepath.Base(cleaned)); err != nil {
+		return err
+	}
+	size, err := removeAt(int(dir.Fd()), filepath.Base(cleaned))
+	fs.addDisk(-size)
+	if err != nil {
+		return errors.Wrap(err, "filesystem: failed to delete")
+	}
+	return nil
+}
+
+// TruncateRootDirectory removes everything within the root directory, leaving
+// the directory itself in place
+func (fs *Filesystem) TruncateRootDirectory() error {
+	entries, err := os.ReadDir(fs.root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "filesystem: failed to read root directory")
+	}
+	for _, e := range entries {
+		if err := fs.Delete(e.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveRootDirectory removes the root directory and everything within it
+func (fs *Filesystem) RemoveRootDirectory() error {
+	if err := os.RemoveAll(fs.root); err != nil {
+		return errors.Wrap(err, "filesystem: failed to remove root directory")
+	}
+	fs.addDisk(-fs.CachedUsage())
+	return nil
+}
+
+// Chmod changes the permissions of a file or directory
+func (fs *Filesystem) Chmod(p string, mode os.FileMode) error {
+	cleaned, err := fs.SafePath(p)
+	if err != nil {
+		return err
+	}
+
+	// The file is opened rather than changed by path so that a symlink
+	// swapped in after resolving cannot redirect the change. O_NONBLOCK stops
+	// opening a named pipe from waiting for a writer.
+	var f *os.File
+	if fs.isRoot(cleaned) {
+		f, err = fs.openDir(cleaned, false)
+	} else {
+		f, err = fs.openFile(cleaned, unix.O_RDONLY|unix.O_NONBLOCK, 0, false)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Chmod(mode.Perm())
 }
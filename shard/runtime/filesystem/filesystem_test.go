@@ -0,0 +1,399 @@
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newEscapeFilesystem returns an empty filesystem alongside a directory outside
+// of its root holding a single file, with symlinks in the root leading to both
+func newEscapeFilesystem(t *testing.T) (*Filesystem, string) {
+	t.Helper()
+
+	fs := newFilesystem(t, 0)
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	links := map[string]string{
+		"out-dir":  outside,
+		"out-file": filepath.Join(outside, "secret"),
+		"dangling": filepath.Join(outside, "missing"),
+		"in-file":  "real",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(fs.Path(), name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(fs.Path(), "real"), []byte("real"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return fs, outside
+}
+
+// untouched fails the test if anything outside of the root was changed
+func untouched(t *testing.T, outside string) {
+	t.Helper()
+
+	entries, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "secret" {
+		t.Fatalf("expected only the secret outside of the root, got %v", entries)
+	}
+	st, err := os.Stat(filepath.Join(outside, "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(outside, "secret")); string(b) != "secret" || st.Mode().Perm() != 0o600 {
+		t.Fatalf("expected the secret to be unchanged, got %q with mode %v", b, st.Mode())
+	}
+}
+
+// readFile opens a file through the filesystem and closes it again
+func readFile(fs *Filesystem, p string) error {
+	f, _, err := fs.File(p)
+	if err == nil {
+		_ = f.Close()
+	}
+	return err
+}
+
+func TestSafePath(t *testing.T) {
+	fs, _ := newEscapeFilesystem(t)
+	root, err := filepath.EvalSymlinks(fs.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want string
+		err  error
+	}{
+		{"real", "real", nil},
+		{"/real", "real", nil},
+		{"", "", nil},
+		{"/", "", nil},
+		{"../../etc/passwd", "etc/passwd", nil},
+		{"a/../../real", "real", nil},
+		{"/etc/passwd", "etc/passwd", nil},
+		{"missing/deeper/file", "missing/deeper/file", nil},
+		{"in-file", "real", nil},
+		{"out-dir", "", ErrBadPathResolution},
+		{"out-dir/secret", "", ErrBadPathResolution},
+		{"out-dir/missing/file", "", ErrBadPathResolution},
+		{"out-file", "", ErrBadPathResolution},
+		{"dangling", "", ErrBadPathResolution},
+		{"dangling/file", "", ErrBadPathResolution},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := fs.SafePath(tt.path)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("expected %v, got %q (%v)", tt.err, got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Join(root, tt.want); got != want {
+				t.Fatalf("expected %s, got %s", want, got)
+			}
+		})
+	}
+}
+
+func TestUnresolvedPath(t *testing.T) {
+	fs, _ := newEscapeFilesystem(t)
+	root, err := filepath.EvalSymlinks(fs.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The link itself is returned rather than where it leads
+	for _, p := range []string{"out-dir", "out-file", "dangling", "in-file", "../missing"} {
+		got, err := fs.unresolvedPath(p)
+		if err != nil {
+			t.Fatalf("%s: %v", p, err)
+		}
+		if want := filepath.Join(root, filepath.Base(p)); got != want {
+			t.Fatalf("%s: expected %s, got %s", p, want, got)
+		}
+	}
+
+	for _, p := range []string{"", "/", "..", "out-dir/secret", "dangling/file"} {
+		if got, err := fs.unresolvedPath(p); !errors.Is(err, ErrBadPathResolution) {
+			t.Fatalf("%s: expected the path to be rejected, got %q (%v)", p, got, err)
+		}
+	}
+}
+
+func TestFilesystem_SymlinkEscape(t *testing.T) {
+	tests := []struct {
+		name string
+		op   func(fs *Filesystem) error
+	}{
+		{"write through directory link", func(fs *Filesystem) error {
+			return fs.Write("out-dir/new", strings.NewReader("x"))
+		}},
+		{"write through file link", func(fs *Filesystem) error {
+			return fs.Write("out-file", strings.NewReader("x"))
+		}},
+		{"write through dangling link", func(fs *Filesystem) error {
+			return fs.Write("dangling", strings.NewReader("x"))
+		}},
+		{"open write through file link", func(fs *Filesystem) error {
+			_, err := fs.OpenWrite("out-file", os.O_TRUNC)
+			return err
+		}},
+		{"create directory through link", func(fs *Filesystem) error {
+			return fs.CreateDirectory("out-dir/new")
+		}},
+		{"copy out", func(fs *Filesystem) error {
+			return fs.Copy("real", "out-dir/copied")
+		}},
+		{"copy in", func(fs *Filesystem) error {
+			return fs.Copy("out-file", "copied")
+		}},
+		{"chmod through link", func(fs *Filesystem) error {
+			return fs.Chmod("out-file", 0o777)
+		}},
+		{"rename out", func(fs *Filesystem) error {
+			return fs.Rename("real", "out-dir/moved")
+		}},
+		{"rename in", func(fs *Filesystem) error {
+			return fs.Rename("out-dir/secret", "moved")
+		}},
+		{"delete through link", func(fs *Filesystem) error {
+			return fs.Delete("out-dir/secret")
+		}},
+		{"read through directory link", func(fs *Filesystem) error {
+			return readFile(fs, "out-dir/secret")
+		}},
+		{"read through file link", func(fs *Filesystem) error {
+			return readFile(fs, "out-file")
+		}},
+		{"list through link", func(fs *Filesystem) error {
+			_, err := fs.ListDirectory("out-dir")
+			return err
+		}},
+		{"stat through link", func(fs *Filesystem) error {
+			_, err := fs.Stat("out-dir/secret")
+			return err
+		}},
+		{"compress through link", func(fs *Filesystem) error {
+			_, err := fs.Compress("out-dir", nil, ArchiveTarGz, nil)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, outside := newEscapeFilesystem(t)
+			if err := tt.op(fs); !errors.Is(err, ErrBadPathResolution) {
+				t.Fatalf("expected the operation to be rejected, got %v", err)
+			}
+			untouched(t, outside)
+		})
+	}
+}
+
+func TestFilesystem_SymlinkItself(t *testing.T) {
+	fs, outside := newEscapeFilesystem(t)
+
+	// Deleting and renaming act on the link rather than what it points to
+	if err := fs.Rename("out-dir", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Delete("moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Delete("dangling"); err != nil {
+		t.Fatal(err)
+	}
+	untouched(t, outside)
+
+	// Links within the root are followed
+	if err := fs.Write("in-file", strings.NewReader("changed")); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(fs.Path(), "real")); string(b) != "changed" {
+		t.Fatalf("expected the link target to be written, got %q", b)
+	}
+}
+
+// Simulates the instance replacing a directory with a symlink after the path
+// has been checked but before it is used
+func TestFilesystem_SwappedDirectory(t *testing.T) {
+	tests := []struct {
+		name string
+		op   func(fs *Filesystem, resolved string) error
+	}{
+		{"open file", func(fs *Filesystem, resolved string) error {
+			_, err := fs.openFile(filepath.Join(resolved, "new"), os.O_CREATE|os.O_WRONLY, 0o644, true)
+			return err
+		}},
+		{"create directory", func(fs *Filesystem, resolved string) error {
+			return fs.mkdirAll(filepath.Join(resolved, "new"))
+		}},
+		{"open directory", func(fs *Filesystem, resolved string) error {
+			_, err := fs.openDir(resolved, false)
+			return err
+		}},
+		{"read file", func(fs *Filesystem, resolved string) error {
+			f, err := fs.openFile(filepath.Join(resolved, "secret"), os.O_RDONLY, 0, false)
+			if err == nil {
+				_ = f.Close()
+			}
+			return err
+		}},
+		{"stat file", func(fs *Filesystem, resolved string) error {
+			_, err := fs.lstat(filepath.Join(resolved, "secret"))
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, outside := newEscapeFilesystem(t)
+			resolved, err := fs.SafePath("dir")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.Symlink(outside, resolved); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.op(fs, resolved); !errors.Is(err, ErrBadPathResolution) {
+				t.Fatalf("expected the swapped directory to be rejected, got %v", err)
+			}
+			untouched(t, outside)
+		})
+	}
+}
+
+func TestFilesystem_Write(t *testing.T) {
+	fs := newFilesystem(t, 0)
+
+	if err := fs.Write("a/b/c", bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Chmod("a/b/c", 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// Replacing a file keeps its mode
+	if err := fs.Write("a/b/c", bytes.NewReader([]byte("hello again"))); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := fs.Stat("a/b/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Size() != 11 || st.Mode().Perm() != 0o600 {
+		t.Fatalf("expected 11 bytes with mode 0600, got %d bytes with %v", st.Size(), st.Mode())
+	}
+
+	entries, err := os.ReadDir(filepath.Join(fs.Path(), "a", "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected no temporary files to be left behind, got %v", entries)
+	}
+
+	if err := fs.Write("a/b", bytes.NewReader(nil)); !errors.Is(err, ErrIsDirectory) {
+		t.Fatalf("expected writing over a directory to fail, got %v", err)
+	}
+	if err := fs.Write("a/b/c/d", bytes.NewReader(nil)); err == nil {
+		t.Fatalf("expected writing beneath a file to fail, got %v", err)
+	}
+}
+
+func TestFilesystem_RenameAndDelete(t *testing.T) {
+	fs := newFilesystem(t, 0)
+	for _, p := range []string{"dir/a", "dir/sub/b", "other"} {
+		if err := fs.Write(p, bytes.NewReader(make([]byte, 100))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := fs.Rename("other", "dir/a"); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("expected renaming over a file to fail, got %v", err)
+	}
+	if err := fs.Rename("dir", "moved/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("moved/dir/sub/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Delete("moved"); err != nil {
+		t.Fatal(err)
+	}
+	if used := fs.CachedUsage(); used != 100 {
+		t.Fatalf("expected deleting to free 200 bytes, got %d used", used)
+	}
+	if err := fs.Delete("moved"); !os.IsNotExist(err) {
+		t.Fatalf("expected deleting a missing path to fail, got %v", err)
+	}
+	if err := fs.Delete("/"); !errors.Is(err, ErrBadPathResolution) {
+		t.Fatalf("expected deleting the root to fail, got %v", err)
+	}
+}
+
+func TestFilesystem_Read(t *testing.T) {
+	fs, _ := newEscapeFilesystem(t)
+	if err := fs.Write("dir/b", strings.NewReader("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Write("dir/a", strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	f, st, err := fs.File("in-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	_, _ = b.ReadFrom(f)
+	_ = f.Close()
+	if b.String() != "real" || st.Size() != 4 {
+		t.Fatalf("expected the link target to be read, got %q", b.String())
+	}
+
+	stats, err := fs.ListDirectory("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 || stats[0].Name() != "a" || stats[1].Name() != "b" {
+		t.Fatalf("expected the entries sorted by name, got %v", stats)
+	}
+	if stats, err := fs.ListDirectory("/"); err != nil || len(stats) != 6 {
+		t.Fatalf("expected the root to be listed, got %d entries (%v)", len(stats), err)
+	}
+	if st, err := fs.Stat("/"); err != nil || !st.IsDir() {
+		t.Fatalf("expected the root to be a directory, got %v", err)
+	}
+
+	if _, _, err := fs.File("dir"); err != ErrIsDirectory {
+		t.Fatalf("expected ErrIsDirectory, got %v", err)
+	}
+	if _, _, err := fs.File("/"); err != ErrIsDirectory {
+		t.Fatalf("expected ErrIsDirectory for the root, got %v", err)
+	}
+	if _, err := fs.ListDirectory("real"); err != ErrNotDirectory {
+		t.Fatalf("expected ErrNotDirectory, got %v", err)
+	}
+	if _, _, err := fs.File("missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected a missing file to not exist, got %v", err)
+	}
+}
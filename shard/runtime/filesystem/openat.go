@@ -0,0 +1,253 @@
+package filesystem
+
+import (
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// SafePath only checks where a path leads at the time it is called, and
+// anything that can write to the root (such as the instance itself) could
+// swap a directory for a symlink before the path is used. Every operation
+// instead opens the resolved parent directory one element at a time from the
+// root without following symlinks, and then acts relative to that directory,
+// so a swapped path fails rather than escaping the root.
+
+const dirFlags = unix.O_RDONLY | unix.O_DIRECTORY | unix.O_NOFOLLOW | unix.O_CLOEXEC
+
+// openDir opens a directory that has been resolved by SafePath. Missing
+// directories are created along the way if create is set.
+func (fs *Filesystem) openDir(resolved string, create bool) (*os.File, error) {
+	root, err := filepath.EvalSymlinks(fs.root)
+	if err != nil {
+		return nil, errors.Wrap(err, "filesystem: failed to resolve root directory")
+	}
+	if !isWithin(resolved, root) {
+		return nil, ErrBadPathResolution
+	}
+
+	fd, err := unix.Open(root, dirFlags&^unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, errors.Wrap(&os.PathError{Op: "open", Path: root, Err: err}, "filesystem: failed to open root directory")
+	}
+
+	rel := strings.TrimPrefix(strings.TrimPrefix(resolved, root), string(filepath.Separator))
+	if rel != "" {
+		for _, name := range strings.Split(rel, string(filepath.Separator)) {
+			next, err := fs.openDirAt(fd, name, create)
+			_ = unix.Close(fd)
+			if err != nil {
+				return nil, err
+			}
+			fd = next
+		}
+	}
+	return os.NewFile(uintptr(fd), resolved), nil
+}
+
+// openDirAt opens a single directory within a parent
+func (fs *Filesystem) openDirAt(dirfd int, name string, create bool) (int, error) {
+	fd, err := unix.Openat(dirfd, name, dirFlags, 0)
+	if err == unix.ENOENT && create {
+		if err := unix.Mkdirat(dirfd, name, 0o755); err == nil {
+			if err := fs.chownAt(dirfd, name); err != nil {
+				return -1, err
+			}
+		} else if err != unix.EEXIST {
+			return -1, errors.Wrap(&os.PathError{Op: "mkdir", Path: name, Err: err}, "filesystem: failed to create directory")
+		}
+		fd, err = unix.Openat(dirfd, name, dirFlags, 0)
+	}
+	if err != nil {
+		return -1, dirError(dirfd, name, err)
+	}
+	return fd, nil
+}
+
+// dirError converts an error from opening a directory, separating symlinks
+// that appeared after the path was resolved from files in the way
+func dirError(dirfd int, name string, err error) error {
+	switch err {
+	case unix.ELOOP:
+		return ErrBadPathResolution
+	case unix.ENOTDIR:
+		var st unix.Stat_t
+		if unix.Fstatat(dirfd, name, &st, unix.AT_SYMLINK_NOFOLLOW) == nil && st.Mode&unix.S_IFMT == unix.S_IFLNK {
+			return ErrBadPathResolution
+		}
+		return ErrNotDirectory
+	}
+	return &os.PathError{Op: "open", Path: name, Err: err}
+}
+
+// openFile opens a file that has been resolved by SafePath without following
+// a symlink in its place, creating any missing parent directories if create
+// is set
+func (fs *Filesystem) openFile(resolved string, flag int, perm os.FileMode, create bool) (*os.File, error) {
+	dir, err := fs.openDir(filepath.Dir(resolved), create)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	fd, err := unix.Openat(int(dir.Fd()), filepath.Base(resolved), flag|unix.O_NOFOLLOW|unix.O_CLOEXEC, uint32(perm.Perm()))
+	switch err {
+	case nil:
+		return os.NewFile(uintptr(fd), resolved), nil
+	case unix.ELOOP:
+		return nil, ErrBadPathResolution
+	case unix.EISDIR:
+		return nil, ErrIsDirectory
+	}
+	return nil, &os.PathError{Op: "open", Path: resolved, Err: err}
+}
+
+// statAt returns information about an entry in a directory without following
+// symlinks
+func statAt(dirfd int, name string) (unix.Stat_t, error) {
+	var st unix.Stat_t
+	if err := unix.Fstatat(dirfd, name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return st, &os.PathError{Op: "lstat", Path: name, Err: err}
+	}
+	return st, nil
+}
+
+// lstatAt returns information about an entry in a directory without following
+// symlinks. The entry is opened by itself so that the information comes from
+// the file descriptor rather than a path.
+func lstatAt(dirfd int, name string) (os.FileInfo, error) {
+	fd, err := unix.Openat(dirfd, name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: err}
+	}
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close()
+	return f.Stat()
+}
+
+// lstat returns information about a path that has been resolved by SafePath
+// without following a symlink in its place
+func (fs *Filesystem) lstat(resolved string) (os.FileInfo, error) {
+	if fs.isRoot(resolved) {
+		dir, err := fs.openDir(resolved, false)
+		if err != nil {
+			return nil, err
+		}
+		defer dir.Close()
+		return dir.Stat()
+	}
+
+	dir, err := fs.openDir(filepath.Dir(resolved), false)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	return lstatAt(int(dir.Fd()), filepath.Base(resolved))
+}
+
+// createTempAt creates a new hidden file next to the named file in a
+// directory, returning the file and its name
+func createTempAt(dirfd int, name string, perm os.FileMode) (*os.File, string, error) {
+	for try := 0; ; try++ {
+		tmp := "." + name + "." + strconv.FormatUint(rand.Uint64(), 36) + ".tmp"
+		fd, err := unix.Openat(dirfd, tmp, unix.O_CREAT|unix.O_EXCL|unix.O_WRONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, uint32(perm.Perm()))
+		if err == nil {
+			return os.NewFile(uintptr(fd), tmp), tmp, nil
+		}
+		if err != unix.EEXIST || try >= 100 {
+			return nil, "", &os.PathError{Op: "open", Path: tmp, Err: err}
+		}
+	}
+}
+
+// removeAt removes an entry in a directory and everything within it without
+// following symlinks. The combined size of the files removed is returned,
+// even if removing some of them failed.
+func removeAt(dirfd int, name string) (int64, error) {
+	st, err := statAt(dirfd, name)
+	if err != nil {
+		return 0, err
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		if err := unix.Unlinkat(dirfd, name, 0); err != nil {
+			return 0, &os.PathError{Op: "unlink", Path: name, Err: err}
+		}
+		if st.Mode&unix.S_IFMT == unix.S_IFREG {
+			return st.Size, nil
+		}
+		return 0, nil
+	}
+
+	fd, err := unix.Openat(dirfd, name, dirFlags, 0)
+	if err != nil {
+		return 0, dirError(dirfd, name, err)
+	}
+	dir := os.NewFile(uintptr(fd), name)
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		_ = dir.Close()
+		return 0, errors.Wrap(err, "filesystem: failed to read directory")
+	}
+
+	var size int64
+	for _, n := range names {
+		s, rerr := removeAt(fd, n)
+		size += s
+		// Anything removed by something else in the meantime is already gone
+		if rerr != nil && !errors.Is(rerr, os.ErrNotExist) && err == nil {
+			err = rerr
+		}
+	}
+	_ = dir.Close()
+	if err != nil {
+		return size, err
+	}
+
+	if err := unix.Unlinkat(dirfd, name, unix.AT_REMOVEDIR); err != nil {
+		return size, &os.PathError{Op: "rmdir", Path: name, Err: err}
+	}
+	return size, nil
+}
+
+// walkFunc is called by walkAt for every entry, with the directory it is in,
+// its name within that directory and its path relative to where the walk
+// started
+type walkFunc func(dirfd int, name, rel string, info os.FileInfo) error
+
+// walkAt calls fn for an entry in a directory and, if it is a directory, for
+// everything within it in lexical order. Symlinks are passed to fn rather than
+// followed, and every directory is opened relative to its parent so that one
+// swapped for a symlink during the walk fails rather than being entered.
+func walkAt(dirfd int, name, rel string, fn walkFunc) error {
+	info, err := lstatAt(dirfd, name)
+	if err != nil {
+		return err
+	}
+	if err := fn(dirfd, name, rel, info); err != nil || !info.IsDir() {
+		return err
+	}
+
+	fd, err := unix.Openat(dirfd, name, dirFlags, 0)
+	if err != nil {
+		return dirError(dirfd, name, err)
+	}
+	dir := os.NewFile(uintptr(fd), name)
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return errors.Wrap(err, "filesystem: failed to read directory")
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		if err := walkAt(fd, n, rel+"/"+n, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package filesystem
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Stat describes a file or directory within the filesystem
+type Stat struct {
+	os.FileInfo
+}
+
+func newStat(info os.FileInfo) Stat {
+	return Stat{FileInfo: info}
+}
+
+// IsSymlink determines if the file is a symlink
+func (s Stat) IsSymlink() bool {
+	return s.Mode()&os.ModeSymlink != 0
+}
+
+func (s Stat) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Name      string    `json:"name"`
+		Size      int64     `json:"size"`
+		Mode      string    `json:"mode"`
+		ModeBits  string    `json:"mode_bits"`
+		Modified  time.Time `json:"modified"`
+		IsFile    bool      `json:"is_file"`
+		IsSymlink bool      `json:"is_symlink"`
+	}{
+		Name:      s.Name(),
+		Size:      s.Size(),
+		Mode:      s.Mode().String(),
+		ModeBits:  strconv.FormatUint(uint64(s.Mode().Perm()), 8),
+		Modified:  s.ModTime(),
+		IsFile:    !s.IsDir(),
+		IsSymlink: s.IsSymlink(),
+	})
+}
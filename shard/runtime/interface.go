@@ -2,8 +2,10 @@ package runtime
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"prismarine/shard/runtime/events"
+	"prismarine/shard/runtime/filesystem"
 	"sync"
 	"time"
 
@@ -16,6 +18,15 @@ const (
 	DockerImagePullStarted   = "docker image pull started"
 	DockerImagePullStatus    = "docker image pull status"
 	DockerImagePullCompleted = "docker image pull completed"
+	CrashEvent               = "crashed"
+	CompressProgressEvent    = "compress progress"
+	DecompressProgressEvent  = "decompress progress"
+	BackupCompletedEvent     = "backup completed"
+	BackupRestoreEvent       = "backup restore completed"
+	TransferStatusEvent      = "transfer status"
+	InstallStartedEvent      = "install started"
+	InstallCompletedEvent    = "install completed"
+	StartupTimeoutEvent      = "startup timeout"
 )
 
 const (
@@ -47,6 +58,13 @@ type Instance interface {
 	// different events that are fired by the runtime
 	Events() *events.Bus
 
+	// Filesystem returns the sandboxed data directory of the instance
+	Filesystem() *filesystem.Filesystem
+
+	// Sink returns the sink pool with the given name, which fans out output
+	// from the instance to any number of listeners
+	Sink(name events.SinkName) *events.SinkPool
+
 	// Exists determines in the server instance exists
 	Exists() (bool, error)
 
@@ -69,6 +87,10 @@ type Instance interface {
 	// does not stop in the given duration, it will either error or terminate
 	WaitForStop(ctx context.Context, duration time.Duration, terminate bool, skipLock bool, wait int) error
 
+	// Restart stops the instance, waiting for it to exit, and then starts it
+	// again. Both actions wait up to wait seconds for the power lock.
+	Restart(ctx context.Context, wait int) error
+
 	// Terminate stops a running server instance using the provided signal. An
 	// error is not thrown if it is already stopped
 	Terminate(ctx context.Context, signal os.Signal, skipLock bool, wait int) error
@@ -106,6 +128,51 @@ type Instance interface {
 	// SetLogCallback sets the callback that the container's log
 	// output will be passed to
 	SetLogCallback(func([]byte))
+
+	// Stats returns the latest resource usage snapshot of the instance
+	Stats() Stats
+
+	// Install runs the install script of the instance in a one-shot container
+	// with the data directory mounted, streaming its output to the install
+	// sink. The instance must be offline.
+	Install(ctx context.Context) error
+
+	// Reinstall stops the instance, waiting for it to exit, and then runs the
+	// install script again
+	Reinstall(ctx context.Context) error
+
+	// CancelInstall kills the install container if an installation is
+	// running
+	CancelInstall()
+
+	// IsInstalling returns true while the install script is running
+	IsInstalling() bool
+
+	// IsRestoring returns true while a backup is being restored
+	IsRestoring() bool
+
+	// SetRestoring marks the instance as restoring a backup, which keeps it
+	// from starting until it is unset. It returns false if the instance was
+	// already in that state, so only one caller can claim a restore.
+	SetRestoring(bool) bool
+
+	// IsTransferring returns true while the instance is being moved to or
+	// from another shard
+	IsTransferring() bool
+
+	// SetTransferring marks the instance as transferring, which keeps it from
+	// starting until it is unset. It returns false if the instance was
+	// already in that state, so only one caller can claim a transfer.
+	SetTransferring(bool) bool
+
+	// Update replaces the configuration of the instance. Resource limits are
+	// applied straight away, while anything the container has to be recreated
+	// for is left pending until the instance is next started
+	Update(ctx context.Context, cfg *Configuration) (ConfigurationDiff, error)
+
+	// IsPendingRestart returns true if the configuration has changes that
+	// only apply once the instance is restarted
+	IsPendingRestart() bool
 }
 
 type RuntimeInstance struct {
@@ -118,10 +185,22 @@ type RuntimeInstance struct {
 	Installing   *AtomicBool
 	Restoring    *AtomicBool
 	Transferring *AtomicBool
+	// PendingRestart is set when settings changed that the container has to
+	// be recreated for
+	PendingRestart *AtomicBool
 
 	Powerlock *Locker
 
+	Fs *filesystem.Filesystem
+
+	Crash   *CrashHandler
+	Startup *StartupDetector
+
+	statsMu sync.RWMutex
+	stats   Stats
+
 	Events *events.Bus
+	Sinks  map[events.SinkName]*events.SinkPool
 
 	Log *log.Logger
 }
@@ -137,3 +216,41 @@ func (r *RuntimeInstance) Context() context.Context {
 	defer r.RUnlock()
 	return r.Ctx
 }
+
+func (r *RuntimeInstance) IsInstalling() bool {
+	return r.Installing.Load()
+}
+
+func (r *RuntimeInstance) IsRestoring() bool {
+	return r.Restoring.Load()
+}
+
+func (r *RuntimeInstance) SetRestoring(v bool) bool {
+	return r.Restoring.SwapIf(v)
+}
+
+func (r *RuntimeInstance) IsTransferring() bool {
+	return r.Transferring.Load()
+}
+
+func (r *RuntimeInstance) SetTransferring(v bool) bool {
+	return r.Transferring.SwapIf(v)
+}
+
+func (r *RuntimeInstance) IsPendingRestart() bool {
+	return r.PendingRestart.Load()
+}
+
+func (r *RuntimeInstance) Filesystem() *filesystem.Filesystem {
+	return r.Fs
+}
+
+func (r *RuntimeInstance) Sink(name events.SinkName) *events.SinkPool {
+	r.RLock()
+	defer r.RUnlock()
+	sink, ok := r.Sinks[name]
+	if !ok {
+		panic(fmt.Sprintf("runtime: attempt to access nil sink: %s", name))
+	}
+	return sink
+}
@@ -0,0 +1,205 @@
+package runtime
+
+import (
+	"context"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/pkg/errors"
+)
+
+// StartupMatcher is a rule matched against every line of output while an
+// instance is starting
+type StartupMatcher struct {
+	// Value is a plain substring, such as "Done (" for Minecraft, unless Regex
+	// is set
+	Value string `json:"value"`
+	// Regex treats the value as a regular expression
+	Regex bool `json:"regex"`
+}
+
+// StartupConfiguration controls how an instance is detected as having
+// finished starting
+type StartupConfiguration struct {
+	// Done are the rules marking the instance as running. Without any rules
+	// the instance is running as soon as its process has started
+	Done []StartupMatcher `json:"done"`
+
+	// Timeout is the number of seconds the instance may take to match a rule
+	// before the startup timeout event is published. Zero disables it
+	Timeout int `json:"timeout"`
+
+	// TerminateOnTimeout kills the instance when the timeout passes rather
+	// than only publishing the event
+	TerminateOnTimeout bool `json:"terminate_on_timeout"`
+}
+
+// Validate checks that the rules can be compiled
+func (c StartupConfiguration) Validate() error {
+	if c.Timeout < 0 {
+		return errors.New("runtime: startup timeout cannot be negative")
+	}
+	_, err := c.compile()
+	return err
+}
+
+func (c StartupConfiguration) compile() ([]*regexp.Regexp, error) {
+	out := make([]*regexp.Regexp, 0, len(c.Done))
+	for _, m := range c.Done {
+		if m.Value == "" {
+			return nil, errors.New("runtime: startup rule cannot be empty")
+		}
+
+		expr := m.Value
+		if !m.Regex {
+			expr = regexp.QuoteMeta(m.Value)
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "runtime: invalid startup rule: %s", m.Value)
+		}
+		out = append(out, re)
+	}
+	return out, nil
+}
+
+// StartupTimeoutReport is published with the StartupTimeoutEvent
+type StartupTimeoutReport struct {
+	Timeout int `json:"timeout"`
+	// Terminate is true if the instance is being killed
+	Terminate bool `json:"terminate"`
+}
+
+// StartupDetector moves an instance from starting to running once a line of
+// its output matches one of the startup rules
+type StartupDetector struct {
+	mu sync.Mutex
+
+	instance Instance
+	matchers []*regexp.Regexp
+	timer    *time.Timer
+	// Incremented every time detection begins or ends, so that a timeout
+	// firing late does not affect the next start
+	generation int
+}
+
+// NewStartupDetector returns a detector for the instance. Detection does not
+// happen until Begin is called.
+func NewStartupDetector(i Instance) *StartupDetector {
+	return &StartupDetector{instance: i}
+}
+
+// Begin loads the current startup rules and starts the timeout. It must be
+// called before the process starts so that no output is missed, and returns
+// false if there are no rules, in which case the caller should move the
+// instance to running itself once the process has started.
+func (d *StartupDetector) Begin() bool {
+	cfg := d.instance.Config().Snapshot().Startup
+	matchers, err := cfg.compile()
+	if err != nil {
+		// Rules are validated when the configuration is loaded, so this
+		// should never happen
+		log.With("instance", d.instance.Id()).Warn("ignoring invalid startup rules", "err", err)
+		matchers = nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.stopTimer()
+	d.matchers = matchers
+	if len(matchers) > 0 && cfg.Timeout > 0 {
+		generation := d.generation
+		d.timer = time.AfterFunc(time.Duration(cfg.Timeout)*time.Second, func() {
+			d.onTimeout(cfg, generation)
+		})
+	}
+	return len(matchers) > 0
+}
+
+// Cancel stops detection, such as when the instance failed to start
+func (d *StartupDetector) Cancel() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stopTimer()
+	d.matchers = nil
+}
+
+// Line checks a line of output against the rules, moving the instance to
+// running on the first match
+func (d *StartupDetector) Line(line []byte) {
+	d.mu.Lock()
+	if len(d.matchers) == 0 {
+		d.mu.Unlock()
+		return
+	}
+
+	matched := false
+	for _, re := range d.matchers {
+		if re.Match(line) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		d.mu.Unlock()
+		return
+	}
+
+	d.stopTimer()
+	d.matchers = nil
+	d.mu.Unlock()
+
+	if d.instance.State() == ProcessStartingState {
+		d.instance.SetState(ProcessRunningState)
+	}
+}
+
+// stopTimer stops the timeout. The caller must hold the lock.
+func (d *StartupDetector) stopTimer() {
+	d.generation++
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+}
+
+func (d *StartupDetector) onTimeout(cfg StartupConfiguration, generation int) {
+	d.mu.Lock()
+	if generation != d.generation {
+		d.mu.Unlock()
+		return
+	}
+	d.timer = nil
+	// Only a warning is published unless terminating, so a rule matching
+	// late still moves the instance to running
+	if cfg.TerminateOnTimeout {
+		d.stopTimer()
+		d.matchers = nil
+	}
+	d.mu.Unlock()
+
+	if d.instance.State() != ProcessStartingState {
+		return
+	}
+
+	l := log.With("instance", d.instance.Id()).With("timeout", cfg.Timeout)
+	l.Warn("instance did not finish starting within the startup timeout", "terminate", cfg.TerminateOnTimeout)
+
+	d.instance.Events().Publish(StartupTimeoutEvent, StartupTimeoutReport{
+		Timeout:   cfg.Timeout,
+		Terminate: cfg.TerminateOnTimeout,
+	})
+
+	if !cfg.TerminateOnTimeout {
+		return
+	}
+	ctx, cancel := context.WithTimeout(d.instance.Context(), time.Minute)
+	defer cancel()
+	if err := d.instance.Terminate(ctx, os.Kill, false, 0); err != nil {
+		l.Error("failed to terminate instance after startup timeout", "err", err)
+	}
+}
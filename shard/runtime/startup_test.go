@@ -0,0 +1,184 @@
+package runtime
+
+import (
+	"testing"
+)
+
+func TestStartupConfiguration_Validate(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  StartupConfiguration
+		ok   bool
+	}{
+		{"none", StartupConfiguration{}, true},
+		{"plain", StartupConfiguration{Done: []StartupMatcher{{Value: "Done ("}}}, true},
+		{"regex", StartupConfiguration{Done: []StartupMatcher{{Value: `Done \(\d+`, Regex: true}}}, true},
+		{"invalid regex", StartupConfiguration{Done: []StartupMatcher{{Value: "Done (", Regex: true}}}, false},
+		{"empty rule", StartupConfiguration{Done: []StartupMatcher{{}}}, false},
+		{"negative timeout", StartupConfiguration{Timeout: -1}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: expected valid to be %t, got %v", tt.name, tt.ok, err)
+		}
+	}
+}
+
+func TestStartupDetector_Line(t *testing.T) {
+	tests := []struct {
+		name    string
+		matcher StartupMatcher
+		line    string
+		match   bool
+	}{
+		{"plain", StartupMatcher{Value: "Done ("}, `[12:00:00 INFO]: Done (1.2s)! For help, type "help"`, true},
+		{"plain is not a regex", StartupMatcher{Value: "Done (.*)"}, "Done (1.2s)", false},
+		{"plain no match", StartupMatcher{Value: "Done ("}, "Loading libraries", false},
+		{"regex", StartupMatcher{Value: `^\[.*\]: Done \(\d+\.\d+s\)`, Regex: true}, "[12:00:00 INFO]: Done (1.2s)!", true},
+		{"regex no match", StartupMatcher{Value: `^Done`, Regex: true}, "[12:00:00 INFO]: Done (1.2s)!", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := newFakeInstance(t, Configuration{Startup: StartupConfiguration{Done: []StartupMatcher{tt.matcher}}})
+			d := NewStartupDetector(i)
+			if !d.Begin() {
+				t.Fatal("expected detection to begin")
+			}
+			i.SetState(ProcessStartingState)
+
+			d.Line([]byte(tt.line))
+			want := ProcessStartingState
+			if tt.match {
+				want = ProcessRunningState
+			}
+			if got := i.State(); got != want {
+				t.Fatalf("expected %s, got %s", want, got)
+			}
+		})
+	}
+}
+
+func TestStartupDetector_NoRules(t *testing.T) {
+	i := newFakeInstance(t, Configuration{})
+	d := NewStartupDetector(i)
+	if d.Begin() {
+		t.Fatal("expected no detection without rules")
+	}
+	i.SetState(ProcessStartingState)
+	d.Line([]byte("Done (1.2s)!"))
+	if i.State() != ProcessStartingState {
+		t.Fatal("expected the state to be left to the caller")
+	}
+}
+
+func TestStartupDetector_MatchesOnce(t *testing.T) {
+	i := newFakeInstance(t, Configuration{Startup: StartupConfiguration{Done: []StartupMatcher{{Value: "Done ("}}}})
+	d := NewStartupDetector(i)
+	d.Begin()
+	i.SetState(ProcessStartingState)
+
+	d.Line([]byte("Done (1.2s)!"))
+	// A later start without Begin must not be moved to running
+	i.SetState(ProcessStartingState)
+	d.Line([]byte("Done (1.2s)!"))
+	if i.State() != ProcessStartingState {
+		t.Fatal("expected the rules to stop matching after the first match")
+	}
+}
+
+// currentGeneration returns the generation of the detector
+func (d *StartupDetector) currentGeneration() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.generation
+}
+
+func TestStartupDetector_Timeout(t *testing.T) {
+	cfg := StartupConfiguration{Done: []StartupMatcher{{Value: "Done ("}}, Timeout: 60}
+	i := newFakeInstance(t, Configuration{Startup: cfg})
+	timeouts := i.subscribe(StartupTimeoutEvent)
+	d := NewStartupDetector(i)
+	d.Begin()
+	i.SetState(ProcessStartingState)
+
+	d.onTimeout(cfg, d.currentGeneration())
+	r := expectEvent(t, timeouts).Data.(StartupTimeoutReport)
+	if r.Timeout != 60 || r.Terminate {
+		t.Fatalf("expected a warning only, got %+v", r)
+	}
+	if _, terminated := i.counts(); terminated != 0 {
+		t.Fatal("expected the instance not to be terminated")
+	}
+
+	// A rule matching late still moves the instance to running
+	d.Line([]byte("Done (90.1s)!"))
+	if i.State() != ProcessRunningState {
+		t.Fatalf("expected a late match to move to running, got %s", i.State())
+	}
+}
+
+func TestStartupDetector_TimeoutTerminate(t *testing.T) {
+	cfg := StartupConfiguration{Done: []StartupMatcher{{Value: "Done ("}}, Timeout: 60, TerminateOnTimeout: true}
+	i := newFakeInstance(t, Configuration{Startup: cfg})
+	timeouts := i.subscribe(StartupTimeoutEvent)
+	d := NewStartupDetector(i)
+	d.Begin()
+	i.SetState(ProcessStartingState)
+
+	d.onTimeout(cfg, d.currentGeneration())
+	if r := expectEvent(t, timeouts).Data.(StartupTimeoutReport); !r.Terminate {
+		t.Fatalf("expected the report to say the instance is terminated, got %+v", r)
+	}
+	if _, terminated := i.counts(); terminated != 1 {
+		t.Fatalf("expected the instance to be terminated once, got %d", terminated)
+	}
+
+	i.SetState(ProcessStartingState)
+	d.Line([]byte("Done (90.1s)!"))
+	if i.State() != ProcessStartingState {
+		t.Fatal("expected detection to end once terminated")
+	}
+}
+
+func TestStartupDetector_StaleTimeout(t *testing.T) {
+	cfg := StartupConfiguration{Done: []StartupMatcher{{Value: "Done ("}}, Timeout: 60, TerminateOnTimeout: true}
+	i := newFakeInstance(t, Configuration{Startup: cfg})
+	timeouts := i.subscribe(StartupTimeoutEvent)
+	d := NewStartupDetector(i)
+
+	// A timeout from a start that was cancelled fires after the next start
+	// began, and must not affect it
+	d.Begin()
+	stale := d.currentGeneration()
+	d.Cancel()
+	d.Begin()
+	i.SetState(ProcessStartingState)
+
+	d.onTimeout(cfg, stale)
+	expectNoEvent(t, timeouts)
+	if _, terminated := i.counts(); terminated != 0 {
+		t.Fatal("expected a stale timeout not to terminate the instance")
+	}
+
+	d.Line([]byte("Done (1.2s)!"))
+	if i.State() != ProcessRunningState {
+		t.Fatal("expected the current start to still be detected")
+	}
+}
+
+func TestStartupDetector_TimeoutAfterStart(t *testing.T) {
+	cfg := StartupConfiguration{Done: []StartupMatcher{{Value: "Done ("}}, Timeout: 60, TerminateOnTimeout: true}
+	i := newFakeInstance(t, Configuration{Startup: cfg})
+	timeouts := i.subscribe(StartupTimeoutEvent)
+	d := NewStartupDetector(i)
+	d.Begin()
+	generation := d.currentGeneration()
+	i.SetState(ProcessStartingState)
+
+	d.Line([]byte("Done (1.2s)!"))
+	d.onTimeout(cfg, generation)
+	expectNoEvent(t, timeouts)
+	if i.State() != ProcessRunningState {
+		t.Fatal("expected a timeout after the match to be ignored")
+	}
+}
@@ -0,0 +1,50 @@
+package runtime
+
+// Stats is a snapshot of the resource usage of an instance
+type Stats struct {
+	// Memory is the memory used by the process in bytes, excluding the page
+	// cache
+	Memory      uint64 `json:"memory_bytes"`
+	MemoryLimit uint64 `json:"memory_limit_bytes"`
+
+	// CpuAbsolute is the cpu usage where 100 is one full core
+	CpuAbsolute float64 `json:"cpu_absolute"`
+	// CpuPercent is the cpu usage as a percentage of the cpu limit of the
+	// instance, or of the whole host if there is no limit
+	CpuPercent float64 `json:"cpu_percent"`
+
+	Network NetworkStats `json:"network"`
+	BlockIo BlockIoStats `json:"block_io"`
+
+	// Disk is the disk space used by the data directory in bytes, and
+	// DiskLimit the quota, where zero is unlimited
+	Disk      int64 `json:"disk_bytes"`
+	DiskLimit int64 `json:"disk_limit_bytes"`
+
+	// Uptime is how long the process has been running in milliseconds
+	Uptime int64 `json:"uptime"`
+}
+
+type NetworkStats struct {
+	RxBytes uint64 `json:"rx_bytes"`
+	TxBytes uint64 `json:"tx_bytes"`
+}
+
+type BlockIoStats struct {
+	ReadBytes  uint64 `json:"read_bytes"`
+	WriteBytes uint64 `json:"write_bytes"`
+}
+
+// Stats returns the latest resource usage snapshot of the instance
+func (r *RuntimeInstance) Stats() Stats {
+	r.statsMu.RLock()
+	defer r.statsMu.RUnlock()
+	return r.stats
+}
+
+// SetStats replaces the latest resource usage snapshot of the instance
+func (r *RuntimeInstance) SetStats(s Stats) {
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+	r.stats = s
+}
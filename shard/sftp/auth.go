@@ -0,0 +1,175 @@
+package sftp
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"prismarine/shard/remote"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+)
+
+var ErrInvalidCredentials = errors.New("sftp: invalid credentials")
+
+// AuthRequest is a login attempt for a user on a single instance
+type AuthRequest struct {
+	// Username is the full login name, in "user.instanceuuid" form
+	Username string
+	User     string
+	Instance string
+
+	// Type is either remote.SftpAuthPassword or remote.SftpAuthPublicKey, and
+	// decides which of Password or PublicKey is set
+	Type      string
+	Password  string
+	PublicKey ssh.PublicKey
+
+	Ip            string
+	ClientVersion string
+}
+
+// AuthResult is the access a user was granted after a successful login
+type AuthResult struct {
+	// Instance is the uuid of the instance the user was granted access to
+	Instance    string
+	User        string
+	Permissions []string
+}
+
+// Authenticator validates the credentials of an SFTP login. It returns
+// ErrInvalidCredentials if the credentials are not valid for the instance.
+type Authenticator interface {
+	Authenticate(ctx context.Context, req AuthRequest) (AuthResult, error)
+}
+
+// PanelAuthenticator validates credentials against the panel
+type PanelAuthenticator struct {
+	client *remote.Client
+}
+
+func NewPanelAuthenticator(client *remote.Client) *PanelAuthenticator {
+	return &PanelAuthenticator{client: client}
+}
+
+func (a *PanelAuthenticator) Authenticate(ctx context.Context, req AuthRequest) (AuthResult, error) {
+	password := req.Password
+	if req.Type == remote.SftpAuthPublicKey {
+		password = string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(req.PublicKey)))
+	}
+
+	res, err := a.client.ValidateSftpCredentials(ctx, remote.SftpAuthRequest{
+		Type:          req.Type,
+		Username:      req.Username,
+		Password:      password,
+		Ip:            req.Ip,
+		ClientVersion: req.ClientVersion,
+	})
+	if err != nil {
+		var rerr *remote.RequestError
+		if errors.As(err, &rerr) && rerr.Status >= 400 && rerr.Status < 500 {
+			return AuthResult{}, ErrInvalidCredentials
+		}
+		return AuthResult{}, err
+	}
+
+	return AuthResult{Instance: res.Server, User: res.User, Permissions: res.Permissions}, nil
+}
+
+// FileUser is a user in the users file
+type FileUser struct {
+	Username string `yaml:"username"`
+	// Password is a bcrypt hash. Leave it empty to only allow public keys
+	Password string `yaml:"password"`
+	// PublicKeys are in authorized_keys format
+	PublicKeys []string `yaml:"public_keys"`
+	// Instances are the uuids of the instances the user can access, or "*"
+	// for every instance
+	Instances   []string `yaml:"instances"`
+	Permissions []string `yaml:"permissions"`
+}
+
+// FileAuthenticator validates credentials against a local users file, which
+// is useful for development and testing without a panel
+type FileAuthenticator struct {
+	users map[string]fileUser
+}
+
+type fileUser struct {
+	FileUser
+	keys []ssh.PublicKey
+}
+
+// NewFileAuthenticator reads the users file at the given path
+func NewFileAuthenticator(path string) (*FileAuthenticator, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "sftp: failed to read users file")
+	}
+
+	var data struct {
+		Users []FileUser `yaml:"users"`
+	}
+	if err := yaml.Unmarshal(b, &data); err != nil {
+		return nil, errors.Wrap(err, "sftp: failed to parse users file")
+	}
+
+	a := &FileAuthenticator{users: make(map[string]fileUser, len(data.Users))}
+	for _, u := range data.Users {
+		fu := fileUser{FileUser: u}
+		for _, k := range u.PublicKeys {
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k))
+			if err != nil {
+				return nil, errors.Wrapf(err, "sftp: invalid public key for user %s", u.Username)
+			}
+			fu.keys = append(fu.keys, key)
+		}
+		a.users[u.Username] = fu
+	}
+	return a, nil
+}
+
+func (a *FileAuthenticator) Authenticate(_ context.Context, req AuthRequest) (AuthResult, error) {
+	u, ok := a.users[req.User]
+	if !ok || !u.hasInstance(req.Instance) {
+		return AuthResult{}, ErrInvalidCredentials
+	}
+
+	switch req.Type {
+	case remote.SftpAuthPassword:
+		if u.Password == "" || bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(req.Password)) != nil {
+			return AuthResult{}, ErrInvalidCredentials
+		}
+	case remote.SftpAuthPublicKey:
+		if !u.hasKey(req.PublicKey) {
+			return AuthResult{}, ErrInvalidCredentials
+		}
+	default:
+		return AuthResult{}, ErrInvalidCredentials
+	}
+
+	return AuthResult{Instance: req.Instance, User: u.Username, Permissions: u.Permissions}, nil
+}
+
+func (u fileUser) hasInstance(uuid string) bool {
+	for _, i := range u.Instances {
+		if i == "*" || i == uuid {
+			return true
+		}
+	}
+	return false
+}
+
+func (u fileUser) hasKey(key ssh.PublicKey) bool {
+	if key == nil {
+		return false
+	}
+	for _, k := range u.keys {
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+package sftp
+
+import (
+	"io"
+	"os"
+	"prismarine/shard/runtime/filesystem"
+
+	"github.com/charmbracelet/log"
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+)
+
+const (
+	PermissionAll             = "*"
+	PermissionFileRead        = "file.read"
+	PermissionFileReadContent = "file.read-content"
+	PermissionFileCreate      = "file.create"
+	PermissionFileUpdate      = "file.update"
+	PermissionFileDelete      = "file.delete"
+)
+
+// handler serves the SFTP requests of a single session from the filesystem of
+// an instance
+type handler struct {
+	fs          *filesystem.Filesystem
+	permissions []string
+	readOnly    bool
+	log         *log.Logger
+}
+
+func (h *handler) handlers() sftp.Handlers {
+	return sftp.Handlers{
+		FileGet:  h,
+		FilePut:  h,
+		FileCmd:  h,
+		FileList: h,
+	}
+}
+
+// can determines if the user is allowed to perform an action. Anything other
+// than reading is refused when the server is read only.
+func (h *handler) can(permission string) bool {
+	if h.readOnly && permission != PermissionFileRead && permission != PermissionFileReadContent {
+		return false
+	}
+	for _, p := range h.permissions {
+		if p == PermissionAll || p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Fileread opens a file for reading
+func (h *handler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	if !h.can(PermissionFileReadContent) {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+
+	f, _, err := h.fs.File(r.Filepath)
+	if err != nil {
+		return nil, h.error(r, err)
+	}
+	return f, nil
+}
+
+// Filewrite opens a file for writing, creating it if needed
+func (h *handler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	permission := PermissionFileUpdate
+	if _, err := h.fs.Stat(r.Filepath); errors.Is(err, os.ErrNotExist) {
+		permission = PermissionFileCreate
+	}
+	if !h.can(permission) {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+
+	pflags := r.Pflags()
+	flag := os.O_WRONLY
+	if pflags.Creat {
+		flag |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flag |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flag |= os.O_EXCL
+	}
+
+	w, err := h.fs.OpenWrite(r.Filepath, flag)
+	if err != nil {
+		return nil, h.error(r, err)
+	}
+	return w, nil
+}
+
+// Filecmd handles every request that changes a file without reading or
+// writing its contents
+func (h *handler) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Setstat":
+		if !h.can(PermissionFileUpdate) {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+		// Ownership and times are managed by the shard, only the mode can be
+		// changed
+		if r.AttrFlags().Permissions {
+			return h.error(r, h.fs.Chmod(r.Filepath, r.Attributes().FileMode()))
+		}
+		return nil
+	case "Rename":
+		if !h.can(PermissionFileUpdate) {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+		return h.error(r, h.fs.Rename(r.Filepath, r.Target))
+	case "Rmdir", "Remove":
+		if !h.can(PermissionFileDelete) {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+		return h.error(r, h.fs.Delete(r.Filepath))
+	case "Mkdir":
+		if !h.can(PermissionFileCreate) {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+		return h.error(r, h.fs.CreateDirectory(r.Filepath))
+	}
+
+	// Links are not supported since they would need to be validated against
+	// the root just like extracted archives are
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// Filelist handles directory listings and stats
+func (h *handler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	if !h.can(PermissionFileRead) {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+
+	switch r.Method {
+	case "List":
+		stats, err := h.fs.ListDirectory(r.Filepath)
+		if err != nil {
+			return nil, h.error(r, err)
+		}
+		files := make(listerAt, len(stats))
+		for idx, st := range stats {
+			files[idx] = st.FileInfo
+		}
+		return files, nil
+	case "Stat", "Lstat":
+		st, err := h.fs.Stat(r.Filepath)
+		if err != nil {
+			return nil, h.error(r, err)
+		}
+		return listerAt{st.FileInfo}, nil
+	}
+
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// error converts a filesystem error into the closest SFTP status. Anything
+// unexpected is logged since the client only sees a generic failure.
+func (h *handler) error(r *sftp.Request, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, os.ErrNotExist):
+		return sftp.ErrSSHFxNoSuchFile
+	case errors.Is(err, filesystem.ErrBadPathResolution), errors.Is(err, os.ErrPermission):
+		return sftp.ErrSSHFxPermissionDenied
+	case errors.Is(err, filesystem.ErrNotEnoughDiskSpace),
+		errors.Is(err, filesystem.ErrIsDirectory),
+		errors.Is(err, filesystem.ErrNotDirectory),
+		errors.Is(err, os.ErrExist):
+		return sftp.ErrSSHFxFailure
+	}
+
+	h.log.With("method", r.Method).With("path", r.Filepath).Error("failed to handle sftp request", "err", err)
+	return sftp.ErrSSHFxFailure
+}
+
+// listerAt serves a fixed list of files
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(out []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(out, l[offset:])
+	if n < len(out) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,280 @@
+package sftp
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"prismarine/shard/config"
+	"prismarine/shard/manager"
+	"prismarine/shard/remote"
+	"prismarine/shard/runtime"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// authTimeout is how long the authenticator has to validate a login
+const authTimeout = 15 * time.Second
+
+// Server is an SFTP server that gives users access to the data directories of
+// instances. Users log in as "user.instanceuuid" and are confined to the
+// filesystem of that instance.
+type Server struct {
+	lookup   func(uuid string) runtime.Instance
+	auth     Authenticator
+	readOnly bool
+	config   *ssh.ServerConfig
+	log      *log.Logger
+}
+
+// New creates an SFTP server for the instances of the manager using the
+// configured host key, which is generated if it does not exist yet
+func New(m *manager.Manager, auth Authenticator) (*Server, error) {
+	cfg := config.Get().Sftp
+
+	signer, err := loadHostKey(cfg.HostKey)
+	if err != nil {
+		return nil, err
+	}
+
+	lookup := func(uuid string) runtime.Instance {
+		i, _ := m.Get(uuid)
+		return i
+	}
+	return newServer(lookup, auth, cfg.ReadOnly, signer), nil
+}
+
+func newServer(lookup func(uuid string) runtime.Instance, auth Authenticator, readOnly bool, signer ssh.Signer) *Server {
+	s := &Server{
+		lookup:   lookup,
+		auth:     auth,
+		readOnly: readOnly,
+		log:      log.With("component", "sftp"),
+	}
+	s.config = &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return s.authenticate(conn, AuthRequest{Type: remote.SftpAuthPassword, Password: string(password)})
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return s.authenticate(conn, AuthRequest{Type: remote.SftpAuthPublicKey, PublicKey: key})
+		},
+	}
+	s.config.AddHostKey(signer)
+	return s
+}
+
+// Run listens on the configured address and serves connections until the
+// context is canceled
+func (s *Server) Run(ctx context.Context) error {
+	l, err := net.Listen("tcp", config.Get().SftpAddress())
+	if err != nil {
+		return errors.Wrap(err, "sftp: failed to listen")
+	}
+	s.log.Info("sftp server listening", "address", l.Addr().String())
+	return s.Serve(ctx, l)
+}
+
+// Serve accepts connections from the listener until the context is canceled.
+// The listener is closed when Serve returns.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		_ = l.Close()
+	}()
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.Wrap(err, "sftp: failed to accept connection")
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// parseUsername splits a login name into the user and the instance uuid. The
+// user itself may contain dots, so the uuid is everything after the last one.
+func parseUsername(username string) (string, string, error) {
+	idx := strings.LastIndex(username, ".")
+	if idx <= 0 || idx == len(username)-1 {
+		return "", "", ErrInvalidCredentials
+	}
+	return username[:idx], username[idx+1:], nil
+}
+
+func (s *Server) authenticate(conn ssh.ConnMetadata, req AuthRequest) (*ssh.Permissions, error) {
+	user, uuid, err := parseUsername(conn.User())
+	if err != nil {
+		return nil, err
+	}
+
+	// Do not let the authenticator decide if the instance exists, since the
+	// panel may know about instances this shard does not
+	i := s.lookup(uuid)
+	if i == nil || i.Config().Snapshot().Suspended {
+		return nil, ErrInvalidCredentials
+	}
+
+	req.Username = conn.User()
+	req.User = user
+	req.Instance = uuid
+	req.ClientVersion = string(conn.ClientVersion())
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		req.Ip = host
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), authTimeout)
+	defer cancel()
+
+	res, err := s.auth.Authenticate(ctx, req)
+	if err != nil {
+		if !errors.Is(err, ErrInvalidCredentials) {
+			s.log.With("username", req.Username).Error("failed to validate sftp credentials", "err", err)
+		}
+		return nil, ErrInvalidCredentials
+	}
+	if res.Instance != uuid {
+		return nil, ErrInvalidCredentials
+	}
+
+	s.log.With("username", req.Username).With("ip", req.Ip).Debug("sftp login", "type", req.Type)
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			"user":        res.User,
+			"instance":    uuid,
+			"permissions": strings.Join(res.Permissions, ","),
+		},
+	}, nil
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	sc, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		s.log.Debug("sftp handshake failed", "ip", conn.RemoteAddr().String(), "err", err)
+		return
+	}
+	defer sc.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			_ = nc.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		ch, creqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go s.handleSession(sc, ch, creqs)
+	}
+}
+
+// handleSession waits for the client to request the sftp subsystem and then
+// serves it. There is no shell, so every other request is refused.
+func (s *Server) handleSession(sc *ssh.ServerConn, ch ssh.Channel, reqs <-chan *ssh.Request) {
+	serving := false
+	for req := range reqs {
+		// The payload is a length prefixed string with the subsystem name
+		ok := !serving && req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+		if req.WantReply {
+			_ = req.Reply(ok, nil)
+		}
+		if !ok {
+			continue
+		}
+
+		h, err := s.handler(sc.Permissions)
+		if err != nil {
+			_ = ch.Close()
+			return
+		}
+		serving = true
+		go func() {
+			defer ch.Close()
+			rs := sftp.NewRequestServer(ch, h.handlers())
+			if err := rs.Serve(); err != nil && err != io.EOF {
+				s.log.With("user", sc.User()).Debug("sftp session ended with an error", "err", err)
+			}
+			_ = rs.Close()
+		}()
+	}
+	if !serving {
+		_ = ch.Close()
+	}
+}
+
+// handler creates the request handler for an authenticated session. The
+// instance is looked up again since it may have been removed since login.
+func (s *Server) handler(perms *ssh.Permissions) (*handler, error) {
+	uuid := perms.Extensions["instance"]
+	i := s.lookup(uuid)
+	if i == nil {
+		return nil, errors.New("sftp: instance no longer exists")
+	}
+
+	var permissions []string
+	if p := perms.Extensions["permissions"]; p != "" {
+		permissions = strings.Split(p, ",")
+	}
+
+	return &handler{
+		fs:          i.Filesystem(),
+		permissions: permissions,
+		readOnly:    s.readOnly,
+		log:         s.log.With("instance", uuid).With("user", perms.Extensions["user"]),
+	}, nil
+}
+
+// loadHostKey reads the private key at the given path, generating a new
+// ed25519 key if it does not exist
+func loadHostKey(path string) (ssh.Signer, error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return nil, errors.Wrap(err, "sftp: failed to parse host key")
+		}
+		return signer, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "sftp: failed to read host key")
+	}
+
+	log.With("path", path).Info("generating sftp host key")
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "sftp: failed to generate host key")
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "sftp: failed to marshal host key")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, errors.Wrap(err, "sftp: failed to create host key directory")
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		return nil, errors.Wrap(err, "sftp: failed to write host key")
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "sftp: failed to load host key")
+	}
+	return signer, nil
+}
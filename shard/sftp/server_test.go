@@ -0,0 +1,284 @@
+package sftp
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"prismarine/shard/runtime"
+	"prismarine/shard/runtime/filesystem"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+const testInstanceId = "0b2e8e3a-8a4b-4f6e-9d6c-2f0d3a7c1e55"
+
+// testInstance implements just enough of an instance for the server, any
+// other method panics
+type testInstance struct {
+	runtime.Instance
+	cfg *runtime.Configuration
+	fs  *filesystem.Filesystem
+}
+
+func (i *testInstance) Id() string                         { return i.cfg.Uuid }
+func (i *testInstance) Config() *runtime.Configuration     { return i.cfg }
+func (i *testInstance) Filesystem() *filesystem.Filesystem { return i.fs }
+
+// startServer serves an instance over SFTP using a users file with a read
+// write user "alice" and a read only user "bob", both with the password
+// "password"
+func startServer(t *testing.T) (*testInstance, string) {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := filepath.Join(t.TempDir(), "users.yml")
+	err = os.WriteFile(users, []byte(`users:
+  - username: alice
+    password: `+string(hash)+`
+    instances: ["*"]
+    permissions: ["*"]
+  - username: bob
+    password: `+string(hash)+`
+    instances: ["`+testInstanceId+`"]
+    permissions: ["file.read", "file.read-content"]
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := NewFileAuthenticator(users)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := &testInstance{
+		cfg: &runtime.Configuration{RWMutex: &sync.RWMutex{}, Uuid: testInstanceId},
+		fs:  filesystem.New(t.TempDir()),
+	}
+	lookup := func(uuid string) runtime.Instance {
+		if uuid == i.Id() {
+			return i
+		}
+		return nil
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		_ = newServer(lookup, auth, false, signer).Serve(ctx, l)
+	}()
+
+	return i, l.Addr().String()
+}
+
+func dial(addr, username, password string) (*sftp.Client, error) {
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            username,
+		Auth:            []ssh.AuthMethod{ssh.Password(password)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	c, err := sftp.NewClient(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func TestServer_Login(t *testing.T) {
+	_, addr := startServer(t)
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		ok       bool
+	}{
+		{"valid", "alice." + testInstanceId, "password", true},
+		{"wrong password", "alice." + testInstanceId, "hunter2", false},
+		{"unknown user", "carol." + testInstanceId, "password", false},
+		{"unknown instance", "alice.00000000-0000-0000-0000-000000000000", "password", false},
+		{"missing instance", "alice", "password", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := dial(addr, tt.username, tt.password)
+			if tt.ok && err != nil {
+				t.Fatalf("expected login to succeed, got %v", err)
+			}
+			if !tt.ok && err == nil {
+				c.Close()
+				t.Fatal("expected login to fail")
+			}
+			if c != nil {
+				c.Close()
+			}
+		})
+	}
+}
+
+func TestServer_ReadWrite(t *testing.T) {
+	i, addr := startServer(t)
+
+	c, err := dial(addr, "alice."+testInstanceId, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.MkdirAll("/world/region"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := c.Create("/world/level.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	b, err := os.ReadFile(filepath.Join(i.fs.Path(), "world", "level.dat"))
+	if err != nil || string(b) != "hello world" {
+		t.Fatalf("expected file to be written, got %q (%v)", b, err)
+	}
+
+	r, err := c.Open("/world/level.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = io.ReadAll(r)
+	r.Close()
+	if err != nil || string(b) != "hello world" {
+		t.Fatalf("expected to read file back, got %q (%v)", b, err)
+	}
+
+	entries, err := c.ReadDir("/world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+
+	if err := c.Rename("/world/level.dat", "/world/level.dat_old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Remove("/world/level.dat_old"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Stat("/world/level.dat_old"); !os.IsNotExist(err) {
+		t.Fatalf("expected file to be removed, got %v", err)
+	}
+}
+
+func TestServer_EscapeRoot(t *testing.T) {
+	i, addr := startServer(t)
+
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(i.fs.Path(), "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := dial(addr, "alice."+testInstanceId, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Create("/escape/evil"); err == nil {
+		t.Fatal("expected writing through a symlink outside the root to fail")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "evil")); !os.IsNotExist(err) {
+		t.Fatal("expected no file to be created outside the root")
+	}
+}
+
+func TestServer_ReadOnlyUser(t *testing.T) {
+	i, addr := startServer(t)
+	if err := i.fs.Write("server.properties", strings.NewReader("motd=hi")); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := dial(addr, "bob."+testInstanceId, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	r, err := c.Open("/server.properties")
+	if err != nil {
+		t.Fatalf("expected read only user to read files, got %v", err)
+	}
+	r.Close()
+
+	if _, err := c.Create("/new.txt"); err == nil {
+		t.Fatal("expected read only user to be refused creating a file")
+	}
+	if err := c.Remove("/server.properties"); err == nil {
+		t.Fatal("expected read only user to be refused deleting a file")
+	}
+	if err := c.Mkdir("/dir"); err == nil {
+		t.Fatal("expected read only user to be refused creating a directory")
+	}
+}
+
+func TestServer_Quota(t *testing.T) {
+	i, addr := startServer(t)
+	i.fs.SetDiskLimit(1024)
+
+	c, err := dial(addr, "alice."+testInstanceId, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	f, err := c.Create("/small.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(make([]byte, 512)); err != nil {
+		t.Fatalf("expected write within the quota to succeed, got %v", err)
+	}
+	f.Close()
+
+	f, err = c.Create("/large.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(make([]byte, 1024))
+	f.Close()
+	if err == nil {
+		t.Fatal("expected write past the quota to fail")
+	}
+	if used := i.fs.CachedUsage(); used > 1024 {
+		t.Fatalf("expected usage to stay within the quota, got %d", used)
+	}
+}
@@ -0,0 +1,69 @@
+package transfer
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseToken(t *testing.T) {
+	key := []byte("target-token")
+	valid := Claims{Subject: "instance", ExpiresAt: time.Now().Add(time.Minute).Unix()}
+
+	signed := func(key []byte, c Claims) string {
+		token, err := SignToken(key, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	// resign replaces the header of a valid token and signs it again with the
+	// right key, so only the header is wrong
+	resign := func(header string) string {
+		parts := strings.Split(signed(key, valid), ".")
+		unsigned := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + parts[1]
+		return unsigned + "." + sign(key, unsigned)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", signed(key, valid), true},
+		{"wrong key", signed([]byte("other-token"), valid), false},
+		{"tampered claims", func() string {
+			parts := strings.Split(signed(key, valid), ".")
+			other := strings.Split(signed(key, Claims{Subject: "other", ExpiresAt: valid.ExpiresAt}), ".")
+			return parts[0] + "." + other[1] + "." + parts[2]
+		}(), false},
+		{"no signature", strings.Join(strings.Split(signed(key, valid), ".")[:2], ".") + ".", false},
+		{"alg none", resign(`{"alg":"none","typ":"JWT"}`), false},
+		{"other alg", resign(`{"alg":"HS512","typ":"JWT"}`), false},
+		{"header order", resign(`{"typ":"JWT","alg":"HS256"}`), false},
+		{"expired", signed(key, Claims{Subject: "instance", ExpiresAt: time.Now().Add(-time.Second).Unix()}), false},
+		{"no expiry", signed(key, Claims{Subject: "instance"}), false},
+		{"empty subject", signed(key, Claims{ExpiresAt: valid.ExpiresAt}), false},
+		{"too few parts", "a.b", false},
+		{"too many parts", signed(key, valid) + ".x", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ParseToken(key, tt.token)
+			if tt.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if *c != valid {
+					t.Fatalf("expected %+v, got %+v", valid, c)
+				}
+				return
+			}
+			if err != ErrInvalidToken {
+				t.Fatalf("expected ErrInvalidToken, got %v", err)
+			}
+		})
+	}
+}
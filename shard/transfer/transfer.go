@@ -0,0 +1,276 @@
+package transfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"prismarine/shard/backup"
+	"prismarine/shard/manager"
+	"prismarine/shard/remote"
+	"prismarine/shard/runtime"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	StatusStarted = "started"
+	StatusFailure = "failure"
+	StatusSuccess = "success"
+)
+
+// Names of the parts in the multipart body sent to the target shard. The
+// archive must come before the checksum.
+const (
+	archivePart  = "archive"
+	checksumPart = "checksum"
+)
+
+// stopTimeout is how long an instance is given to stop before a transfer
+// terminates it
+const stopTimeout = 2 * time.Minute
+
+var (
+	ErrInstanceExists   = errors.New("transfer: instance already exists on this shard")
+	ErrChecksumMismatch = errors.New("transfer: archive checksum does not match")
+)
+
+// Target is the shard an instance is being transferred to
+type Target struct {
+	// Url is the transfer endpoint of the target shard
+	Url string `json:"url"`
+	// Token is the signed token the target uses to authorize the transfer
+	Token string `json:"token"`
+}
+
+// Send transfers an instance to the target shard. The instance is claimed for
+// the transfer before it is stopped, so that it is kept from starting while
+// its data directory is streamed to the target. The result is reported to the
+// panel, and the instance is only removed from this shard once the target has
+// confirmed that it was recreated.
+func Send(ctx context.Context, m *manager.Manager, i runtime.Instance, target Target) (err error) {
+	if !i.SetTransferring(true) {
+		return runtime.ErrInstanceTransferring
+	}
+	if i.IsInstalling() {
+		i.SetTransferring(false)
+		return runtime.ErrInstanceInstalling
+	} else if i.IsRestoring() {
+		i.SetTransferring(false)
+		return runtime.ErrInstanceRestoring
+	}
+
+	i.Events().Publish(runtime.TransferStatusEvent, StatusStarted)
+
+	l := log.With("instance", i.Id())
+	l.Info("transferring instance", "target", target.Url)
+
+	defer func() {
+		if err == nil {
+			return
+		}
+		i.SetTransferring(false)
+		i.Events().Publish(runtime.TransferStatusEvent, StatusFailure)
+		if rerr := m.Client().SetTransferStatus(context.Background(), i.Id(), remote.TransferStatusRequest{Successful: false}); rerr != nil {
+			l.Warn("failed to report transfer failure to panel", "err", rerr)
+		}
+	}()
+
+	if i.State() != runtime.ProcessOfflineState {
+		// Skipping the lock gets past the claim made above
+		if err := i.WaitForStop(ctx, stopTimeout, true, true, 0); err != nil {
+			return errors.Wrap(err, "transfer: failed to stop instance")
+		}
+	}
+	if err := push(ctx, i, target); err != nil {
+		return err
+	}
+
+	i.Events().Publish(runtime.TransferStatusEvent, StatusSuccess)
+	if err := m.Client().SetTransferStatus(ctx, i.Id(), remote.TransferStatusRequest{Successful: true}); err != nil {
+		// The instance already lives on the target, so cleaning up must go
+		// ahead regardless
+		l.Warn("failed to report transfer success to panel", "err", err)
+	}
+
+	cleanup(m, i)
+	l.Info("instance transferred")
+	return nil
+}
+
+// push streams the archive and its checksum to the target, returning once the
+// target has responded
+func push(ctx context.Context, i runtime.Instance, target Target) error {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	go func() {
+		pw.CloseWithError(writeBody(ctx, mw, i))
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.Url, pr)
+	if err != nil {
+		_ = pr.Close()
+		return errors.Wrap(err, "transfer: failed to create request")
+	}
+	req.Header.Set("Authorization", "Bearer "+target.Token)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	// The archive can be huge, so rely on the context rather than a timeout
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		_ = pr.Close()
+		return errors.Wrap(err, "transfer: failed to send archive")
+	}
+	defer res.Body.Close()
+	// Unblock the writer if the target responded before reading everything
+	_ = pr.Close()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		var body struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(res.Body).Decode(&body)
+		return errors.Errorf("transfer: target responded with status %d: %s", res.StatusCode, body.Error)
+	}
+	return nil
+}
+
+func writeBody(ctx context.Context, mw *multipart.Writer, i runtime.Instance) error {
+	part, err := mw.CreateFormFile(archivePart, "archive.tar.gz")
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	if err := backup.WriteArchive(ctx, io.MultiWriter(part, h), i.Filesystem()); err != nil {
+		return err
+	}
+	if err := mw.WriteField(checksumPart, hex.EncodeToString(h.Sum(nil))); err != nil {
+		return err
+	}
+	return mw.Close()
+}
+
+// cleanup removes an instance that now lives on another shard
+func cleanup(m *manager.Manager, i runtime.Instance) {
+	l := log.With("instance", i.Id())
+
+	i.ContextCancel()
+	if err := i.Destroy(); err != nil {
+		l.Warn("failed to remove transferred instance", "err", err)
+	}
+	if err := i.Filesystem().RemoveRootDirectory(); err != nil {
+		l.Warn("failed to remove transferred instance files", "err", err)
+	}
+
+	id := i.Id()
+	m.Remove(func(match runtime.Instance) bool {
+		return match.Id() == id
+	})
+}
+
+// Receive recreates an instance transferred from another shard. The settings
+// are loaded from the panel and the data directory is extracted from the
+// archive in the body, which is rejected if its checksum does not match. The
+// instance is only added to the manager once everything has succeeded.
+func Receive(ctx context.Context, m *manager.Manager, uuid string, r *multipart.Reader) (err error) {
+	// The uuid is reserved for the whole receive, so that it cannot be
+	// received twice or created while the files are being extracted
+	if err := m.Reserve(uuid); err != nil {
+		if errors.Is(err, manager.ErrInstanceExists) {
+			return ErrInstanceExists
+		}
+		return err
+	}
+	defer m.Release(uuid)
+
+	data, err := m.Client().GetServerConfiguration(ctx, uuid)
+	if err != nil {
+		return errors.Wrap(err, "transfer: failed to load server configuration")
+	}
+	i, err := m.InitServer(data)
+	if err != nil {
+		return err
+	}
+
+	l := log.With("instance", uuid)
+	l.Info("receiving transferred instance")
+
+	i.SetTransferring(true)
+	defer func() {
+		if err == nil {
+			return
+		}
+		i.ContextCancel()
+		if derr := i.Destroy(); derr != nil {
+			l.Warn("failed to remove partially transferred instance", "err", derr)
+		}
+		if rerr := i.Filesystem().RemoveRootDirectory(); rerr != nil {
+			l.Warn("failed to remove partially transferred instance files", "err", rerr)
+		}
+	}()
+
+	if err := i.Filesystem().EnsureRoot(); err != nil {
+		return err
+	}
+	if err := extract(i, r); err != nil {
+		return err
+	}
+
+	if err := i.Create(); err != nil {
+		return err
+	}
+
+	i.SetTransferring(false)
+	m.Add(i)
+	l.Info("transferred instance received")
+	return nil
+}
+
+// extract reads the archive and checksum parts of the body into the data
+// directory of the instance
+func extract(i runtime.Instance, r *multipart.Reader) error {
+	var checksum string
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "transfer: failed to read request body")
+		}
+
+		switch part.FormName() {
+		case archivePart:
+			h := sha256.New()
+			tr := io.TeeReader(part, h)
+			if err := i.Filesystem().ExtractTarGz("/", tr); err != nil {
+				return err
+			}
+			// Include anything after the end of the tar in the checksum
+			if _, err := io.Copy(io.Discard, tr); err != nil {
+				return errors.Wrap(err, "transfer: failed to read archive")
+			}
+			checksum = hex.EncodeToString(h.Sum(nil))
+		case checksumPart:
+			if checksum == "" {
+				return errors.New("transfer: checksum was sent before the archive")
+			}
+			b, err := io.ReadAll(io.LimitReader(part, 128))
+			if err != nil {
+				return errors.Wrap(err, "transfer: failed to read checksum")
+			}
+			if string(b) != checksum {
+				return ErrChecksumMismatch
+			}
+			return nil
+		}
+	}
+	return errors.New("transfer: request body is missing the archive or checksum")
+}
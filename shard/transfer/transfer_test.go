@@ -0,0 +1,331 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"prismarine/shard/backup"
+	"prismarine/shard/config"
+	"prismarine/shard/manager"
+	"prismarine/shard/remote"
+	"prismarine/shard/runtime"
+	"prismarine/shard/runtime/events"
+	"prismarine/shard/runtime/filesystem"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var targetKey = []byte("target-token")
+
+// testInstance implements just enough of an instance to be transferred, any
+// other method panics
+type testInstance struct {
+	runtime.Instance
+	fs           *filesystem.Filesystem
+	bus          *events.Bus
+	transferring *runtime.AtomicBool
+	restoring    bool
+	running      bool
+	destroyed    bool
+
+	// Called while the instance is being stopped
+	onStop func()
+}
+
+func newTestInstance(t *testing.T, files map[string]string) *testInstance {
+	t.Helper()
+
+	i := &testInstance{
+		fs:           filesystem.New(t.TempDir()),
+		bus:          events.NewBus(),
+		transferring: runtime.NewAtomicBool(false),
+	}
+	for name, body := range files {
+		if err := i.fs.Write(name, strings.NewReader(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return i
+}
+
+func (i *testInstance) Id() string                         { return "instance" }
+func (i *testInstance) Filesystem() *filesystem.Filesystem { return i.fs }
+func (i *testInstance) Events() *events.Bus                { return i.bus }
+func (i *testInstance) IsInstalling() bool                 { return false }
+func (i *testInstance) IsRestoring() bool                  { return i.restoring }
+func (i *testInstance) IsTransferring() bool               { return i.transferring.Load() }
+func (i *testInstance) SetTransferring(v bool) bool        { return i.transferring.SwapIf(v) }
+func (i *testInstance) ContextCancel()                     {}
+func (i *testInstance) Destroy() error                     { i.destroyed = true; return nil }
+func (i *testInstance) State() string {
+	if i.running {
+		return runtime.ProcessRunningState
+	}
+	return runtime.ProcessOfflineState
+}
+
+func (i *testInstance) WaitForStop(_ context.Context, _ time.Duration, _ bool, skipLock bool, _ int) error {
+	// Like the docker runtime, the claim only lets the transfer itself through
+	if !skipLock && i.IsTransferring() {
+		return runtime.ErrInstanceTransferring
+	}
+	if i.onStop != nil {
+		i.onStop()
+	}
+	i.running = false
+	return nil
+}
+
+// fakePanel records the transfer statuses reported to it, and has no servers
+type fakePanel struct {
+	mu       sync.Mutex
+	statuses []remote.TransferStatusRequest
+}
+
+func (p *fakePanel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/servers"):
+		_ = json.NewEncoder(w).Encode(map[string]any{"data": []any{}})
+	case strings.HasSuffix(r.URL.Path, "/transfer"):
+		var body remote.TransferStatusRequest
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		p.mu.Lock()
+		p.statuses = append(p.statuses, body)
+		p.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func setup(t *testing.T) (*manager.Manager, *fakePanel) {
+	t.Helper()
+
+	cfg := config.Default()
+	cfg.System.RootDirectory = t.TempDir()
+	config.Set(cfg)
+	t.Cleanup(func() { config.Set(nil) })
+
+	p := &fakePanel{}
+	srv := httptest.NewServer(p)
+	t.Cleanup(srv.Close)
+
+	m, err := manager.NewManager(context.Background(), remote.New(srv.URL, remote.WithRetries(1, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, p
+}
+
+// newTarget returns a server receiving transfers the same way as the transfer
+// endpoint, extracting into the filesystem of the given instance. The result
+// of every transfer is sent on the channel.
+func newTarget(t *testing.T, dest *testInstance) (*httptest.Server, chan error) {
+	t.Helper()
+
+	results := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := func() error {
+			if _, err := ParseToken(targetKey, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")); err != nil {
+				return err
+			}
+			_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil {
+				return err
+			}
+			return extract(dest, multipart.NewReader(r.Body, params["boundary"]))
+		}()
+		results <- err
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, results
+}
+
+func newToken(t *testing.T) string {
+	t.Helper()
+	token, err := SignToken(targetKey, Claims{Subject: "instance", ExpiresAt: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestSend(t *testing.T) {
+	m, panel := setup(t)
+	files := map[string]string{"server.properties": "motd=hello", "world/level.dat": "level"}
+	i := newTestInstance(t, files)
+	i.running = true
+	m.Add(i)
+
+	i.onStop = func() {
+		if !i.IsTransferring() {
+			t.Error("expected the transfer to be claimed before stopping")
+		}
+		if err := Send(context.Background(), m, i, Target{}); err != runtime.ErrInstanceTransferring {
+			t.Errorf("expected a second transfer to be refused, got %v", err)
+		}
+	}
+
+	dest := newTestInstance(t, nil)
+	srv, results := newTarget(t, dest)
+	if err := Send(context.Background(), m, i, Target{Url: srv.URL, Token: newToken(t)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-results; err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range files {
+		if got, err := os.ReadFile(filepath.Join(dest.fs.Path(), name)); err != nil || string(got) != want {
+			t.Fatalf("expected %s to be transferred (%v)", name, err)
+		}
+	}
+	if _, err := os.Stat(i.fs.Path()); !os.IsNotExist(err) {
+		t.Fatal("expected the files to be removed from the source")
+	}
+	if _, ok := m.Get("instance"); ok || !i.destroyed {
+		t.Fatal("expected the instance to be removed from the source")
+	}
+	if len(panel.statuses) != 1 || !panel.statuses[0].Successful {
+		t.Fatalf("expected success to be reported, got %+v", panel.statuses)
+	}
+}
+
+func TestSend_Failure(t *testing.T) {
+	m, panel := setup(t)
+	i := newTestInstance(t, map[string]string{"server.properties": "motd=hello"})
+	m.Add(i)
+
+	dest := newTestInstance(t, nil)
+	srv, results := newTarget(t, dest)
+	err := Send(context.Background(), m, i, Target{Url: srv.URL, Token: "invalid"})
+	if err == nil {
+		t.Fatal("expected the transfer to fail")
+	}
+	if err := <-results; err != ErrInvalidToken {
+		t.Fatalf("expected the target to refuse the token, got %v", err)
+	}
+
+	if i.IsTransferring() {
+		t.Fatal("expected the transfer to be released")
+	}
+	if _, ok := m.Get("instance"); !ok || i.destroyed {
+		t.Fatal("expected the instance to be kept on the source")
+	}
+	if _, err := i.fs.Stat("server.properties"); err != nil {
+		t.Fatal("expected the files to be kept on the source")
+	}
+	if len(panel.statuses) != 1 || panel.statuses[0].Successful {
+		t.Fatalf("expected failure to be reported, got %+v", panel.statuses)
+	}
+}
+
+func TestSend_Refused(t *testing.T) {
+	m, panel := setup(t)
+	i := newTestInstance(t, nil)
+	i.restoring = true
+	i.running = true
+	i.onStop = func() { t.Error("expected the instance not to be stopped") }
+
+	if err := Send(context.Background(), m, i, Target{}); err != runtime.ErrInstanceRestoring {
+		t.Fatalf("expected ErrInstanceRestoring, got %v", err)
+	}
+	if i.IsTransferring() {
+		t.Fatal("expected the transfer to be released")
+	}
+	if len(panel.statuses) != 0 {
+		t.Fatalf("expected nothing to be reported, got %+v", panel.statuses)
+	}
+}
+
+func TestReceive_Reserved(t *testing.T) {
+	m, _ := setup(t)
+
+	// The instance is being created or received by something else
+	if err := m.Reserve("instance"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Receive(context.Background(), m, "instance", nil); err != ErrInstanceExists {
+		t.Fatalf("expected ErrInstanceExists, got %v", err)
+	}
+	m.Release("instance")
+
+	if err := Receive(context.Background(), m, "instance", nil); err == ErrInstanceExists {
+		t.Fatal("expected the uuid to be free once released")
+	}
+	// The failed receive releases the uuid again
+	if err := m.Reserve("instance"); err != nil {
+		t.Fatalf("expected the uuid to be released, got %v", err)
+	}
+}
+
+func TestReceive_BadBody(t *testing.T) {
+	src := newTestInstance(t, map[string]string{"server.properties": "motd=hello"})
+	var archive bytes.Buffer
+	if err := backup.WriteArchive(context.Background(), &archive, src.fs); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		parts [][2]string
+		err   error
+	}{
+		{"checksum mismatch", [][2]string{{archivePart, archive.String()}, {checksumPart, strings.Repeat("0", 64)}}, ErrChecksumMismatch},
+		{"checksum first", [][2]string{{checksumPart, strings.Repeat("0", 64)}, {archivePart, archive.String()}}, nil},
+		{"no checksum", [][2]string{{archivePart, archive.String()}}, nil},
+		{"no archive", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := newTestInstance(t, nil)
+			srv, results := newTarget(t, dest)
+
+			var body bytes.Buffer
+			mw := multipart.NewWriter(&body)
+			for _, p := range tt.parts {
+				if err := mw.WriteField(p[0], p[1]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := mw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			req, err := http.NewRequest(http.MethodPost, srv.URL, &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+newToken(t))
+			req.Header.Set("Content-Type", mw.FormDataContentType())
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = res.Body.Close()
+
+			err = <-results
+			if res.StatusCode != http.StatusBadRequest || err == nil {
+				t.Fatalf("expected the transfer to be rejected, got status %d", res.StatusCode)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+}